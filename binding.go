@@ -0,0 +1,188 @@
+package quictun
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// Channel binding ties an upgrade request to the QUIC session it was sent on,
+// so that an observed or relayed upgrade request can not be replayed on
+// another session.
+// Before sending the upgrade request, the client requests a binding nonce with
+// a request carrying the BindingHeader with the value "new", for which the
+// server generates a nonce and stores it with the QUIC session. The binding
+// request is authenticated like the upgrade request, with tokens bound to the
+// value "new" instead of a nonce, so that the server does not answer it for
+// anyone but its clients. The client
+// sends the nonce back in the upgrade request and, if tokens are used, includes
+// it in the MAC of the token. The server only accepts the nonce on the same
+// session and only once, and binds the session once the upgrade request was
+// authenticated as well.
+
+// BindingHeader is the name of the header field carrying binding nonces.
+const BindingHeader = "QTP-Binding"
+
+// bindingRequest is the value of the BindingHeader requesting a new nonce.
+const bindingRequest = "new"
+
+const (
+	// DefaultMaxBindings is the default max number of sessions with binding
+	// state.
+	DefaultMaxBindings = 1 << 16
+
+	// DefaultMaxBindingsPerAddr is the default max number of sessions with
+	// binding state per remote IP address.
+	DefaultMaxBindingsPerAddr = 16
+)
+
+var (
+	// ErrTooManyBindings is returned by IssueBinding if the max number of
+	// sessions with binding state is reached, in total or for the remote
+	// address of the session.
+	ErrTooManyBindings = errors.New("too many sessions with binding state")
+
+	errSessionNotBound   = errors.New("session was not bound to an upgrade request")
+	errBindingNotChecked = errors.New("no binding nonce was checked for the session")
+)
+
+type sessionBinding struct {
+	addr    string // remote IP address of the session
+	nonce   string // outstanding nonce, empty once it was used
+	checked bool   // whether a nonce was successfully checked
+	bound   bool   // whether the session was bound with BindSession
+	acl     ACL    // restricts the destinations of the session, see BindSession
+}
+
+// IssueBinding generates a new binding nonce for the given QUIC session, which
+// must be sent to the client in the BindingHeader.
+// A previously issued nonce for the same session becomes invalid.
+// The binding state of a session is kept until it is closed. Once it is kept
+// for MaxBindings sessions in total or for MaxBindingsPerAddr sessions from
+// the same remote IP address, ErrTooManyBindings is returned for other
+// sessions.
+func (s *Server) IssueBinding(session quic.Session) (nonce string, err error) {
+	var raw [16]byte
+	if _, err = rand.Read(raw[:]); err != nil {
+		return "", err
+	}
+	nonce = base64.RawURLEncoding.EncodeToString(raw[:])
+
+	s.bindingsLock.Lock()
+	if s.bindings == nil {
+		s.bindings = make(map[quic.Session]*sessionBinding)
+		s.bindingsPerAddr = make(map[string]int)
+	}
+	b, ok := s.bindings[session]
+	if !ok {
+		max, maxPerAddr := s.MaxBindings, s.MaxBindingsPerAddr
+		if max == 0 {
+			max = DefaultMaxBindings
+		}
+		if maxPerAddr == 0 {
+			maxPerAddr = DefaultMaxBindingsPerAddr
+		}
+		addr := remoteIP(session)
+		if len(s.bindings) >= max || s.bindingsPerAddr[addr] >= maxPerAddr {
+			s.bindingsLock.Unlock()
+			return "", ErrTooManyBindings
+		}
+		b = &sessionBinding{addr: addr}
+		s.bindings[session] = b
+		s.bindingsPerAddr[addr]++
+
+		// forget the binding once the session is closed
+		go func() {
+			<-session.Context().Done()
+			s.bindingsLock.Lock()
+			delete(s.bindings, session)
+			if s.bindingsPerAddr[addr]--; s.bindingsPerAddr[addr] == 0 {
+				delete(s.bindingsPerAddr, addr)
+			}
+			s.bindingsLock.Unlock()
+		}()
+	}
+	b.nonce = nonce
+	s.bindingsLock.Unlock()
+	return nonce, nil
+}
+
+// CheckBinding checks whether the given nonce was issued for the given QUIC
+// session. Every nonce can only be checked once. The session is not bound
+// before the upgrade request was authenticated as well, see BindSession.
+func (s *Server) CheckBinding(session quic.Session, nonce string) bool {
+	s.bindingsLock.Lock()
+	defer s.bindingsLock.Unlock()
+	b, ok := s.bindings[session]
+	if !ok || b.nonce == "" || nonce == "" {
+		return false
+	}
+	valid := subtle.ConstantTimeCompare([]byte(b.nonce), []byte(nonce)) == 1
+	b.nonce = ""
+	b.checked = valid
+	return valid
+}
+
+// IsBindingRequest returns whether the request with the given header requests a
+// new binding nonce, which must be answered with IssueBinding once the request
+// was authenticated. Tokens of binding requests are bound to the value of
+// their BindingHeader.
+func IsBindingRequest(header http.Header) bool {
+	return header.Get("Upgrade") == "" && header.Get(BindingHeader) == bindingRequest
+}
+
+// BindSession binds the given session to the upgrade request, once the binding
+// nonce of the request was checked with CheckBinding and the request was
+// authenticated. It must be called before the session is upgraded.
+// If acl is not nil, it restricts the destinations of the tunneled connections
+// of the session in addition to the ACL of the server, e.g. according to the
+// policy of the authenticated user.
+func (s *Server) BindSession(session quic.Session, acl ACL) error {
+	s.bindingsLock.Lock()
+	defer s.bindingsLock.Unlock()
+	b, ok := s.bindings[session]
+	if !ok || !b.checked {
+		return errBindingNotChecked
+	}
+	b.bound = true
+	b.acl = acl
+	return nil
+}
+
+// remoteIP returns the IP address of the client of the given session.
+func remoteIP(session quic.Session) string {
+	addr := session.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// sessionACL returns the ACL of the given session set with BindSession, if
+// any.
+func (s *Server) sessionACL(session quic.Session) ACL {
+	s.bindingsLock.Lock()
+	defer s.bindingsLock.Unlock()
+	if b, ok := s.bindings[session]; ok {
+		return b.acl
+	}
+	return nil
+}
+
+// isBound returns whether the given session was bound with BindSession.
+func (s *Server) isBound(session quic.Session) bool {
+	s.bindingsLock.Lock()
+	b, ok := s.bindings[session]
+	bound := ok && b.bound
+	s.bindingsLock.Unlock()
+	return bound
+}
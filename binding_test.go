@@ -0,0 +1,258 @@
+package quictun
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+type mockSession struct {
+	ctx      context.Context
+	cancel   context.CancelFunc
+	closeErr error
+	remote   net.Addr
+	state    quic.ConnectionState
+	stream   quic.Stream      // returned by OpenStreamSync
+	streams  chan quic.Stream // if set, returned by OpenStream and OpenStreamSync
+}
+
+func newMockSession() *mockSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mockSession{ctx: ctx, cancel: cancel}
+}
+
+var errNotImplemented = errors.New("not implemented")
+
+func (s *mockSession) AcceptStream() (quic.Stream, error) { return nil, errNotImplemented }
+func (s *mockSession) LocalAddr() net.Addr                { return nil }
+func (s *mockSession) RemoteAddr() net.Addr               { return s.remote }
+func (s *mockSession) Context() context.Context           { return s.ctx }
+
+func (s *mockSession) ConnectionState() quic.ConnectionState { return s.state }
+
+func (s *mockSession) OpenStream() (quic.Stream, error) {
+	if s.streams == nil {
+		return nil, errNotImplemented
+	}
+	return <-s.streams, nil
+}
+
+func (s *mockSession) OpenStreamSync() (quic.Stream, error) {
+	if s.streams == nil {
+		return s.stream, nil
+	}
+	return <-s.streams, nil
+}
+func (s *mockSession) Close(err error) error {
+	s.closeErr = err
+	s.cancel()
+	return nil
+}
+
+func TestBinding(t *testing.T) {
+	s := &Server{RequireBinding: true}
+	session, other := newMockSession(), newMockSession()
+	defer session.Close(nil)
+	defer other.Close(nil)
+
+	if s.CheckBinding(session, "") {
+		t.Fatal("empty nonce was accepted")
+	}
+
+	nonce, err := s.IssueBinding(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CheckBinding(other, nonce) {
+		t.Fatal("nonce was accepted for another session")
+	}
+	if !s.CheckBinding(session, nonce) {
+		t.Fatal("valid nonce was rejected")
+	}
+	if s.CheckBinding(session, nonce) {
+		t.Fatal("nonce was accepted twice")
+	}
+	if s.isBound(session) {
+		t.Fatal("session is bound before the upgrade request was authenticated")
+	}
+	if err = s.BindSession(session, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isBound(session) || s.isBound(other) {
+		t.Fatal("wrong sessions are bound")
+	}
+
+	// only the latest nonce is valid
+	first, _ := s.IssueBinding(other)
+	second, _ := s.IssueBinding(other)
+	if s.CheckBinding(other, first) {
+		t.Fatal("outdated nonce was accepted")
+	}
+	if s.CheckBinding(other, second) {
+		t.Fatal("nonce was accepted after a failed check")
+	}
+	if err = s.BindSession(other, nil); err != errBindingNotChecked {
+		t.Fatalf("session without a checked nonce: expected %v, got %v", errBindingNotChecked, err)
+	}
+
+	// unbound sessions are closed by Upgrade
+	s.Upgrade(other)
+	if other.closeErr != errSessionNotBound {
+		t.Fatalf("unbound session was closed with %v, expected %v", other.closeErr, errSessionNotBound)
+	}
+
+	// closed sessions are forgotten
+	session.Close(nil)
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.bindingsLock.Lock()
+		_, ok := s.bindings[session]
+		s.bindingsLock.Unlock()
+		if !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("binding of closed session was not removed")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxBindings(t *testing.T) {
+	s := &Server{MaxBindings: 1}
+	session, other := newMockSession(), newMockSession()
+	defer other.Close(nil)
+
+	if _, err := s.IssueBinding(session); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.IssueBinding(session); err != nil {
+		t.Fatalf("new nonce for the same session failed: %v", err)
+	}
+	if _, err := s.IssueBinding(other); err != ErrTooManyBindings {
+		t.Fatalf("expected ErrTooManyBindings, got %v", err)
+	}
+
+	// closing a session makes room for another one
+	session.Close(nil)
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := s.IssueBinding(other)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("binding for another session still fails: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestMaxBindingsPerAddr(t *testing.T) {
+	s := &Server{MaxBindingsPerAddr: 2}
+	port := 1024
+	newSession := func(addr string) *mockSession {
+		session := newMockSession()
+		session.remote = &net.UDPAddr{IP: net.ParseIP(addr), Port: port}
+		port++
+		return session
+	}
+	first, second := newSession("192.0.2.1"), newSession("192.0.2.1")
+	defer second.Close(nil)
+	for _, session := range []*mockSession{first, second} {
+		if _, err := s.IssueBinding(session); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	third, other := newSession("192.0.2.1"), newSession("192.0.2.2")
+	defer third.Close(nil)
+	defer other.Close(nil)
+	if _, err := s.IssueBinding(third); err != ErrTooManyBindings {
+		t.Fatalf("expected ErrTooManyBindings for a third session of the address, got %v", err)
+	}
+	if _, err := s.IssueBinding(other); err != nil {
+		t.Fatalf("binding for another address failed: %v", err)
+	}
+
+	// closing a session makes room for another one of the same address
+	first.Close(nil)
+	deadline := time.Now().Add(time.Second)
+	for {
+		_, err := s.IssueBinding(third)
+		if err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("binding for another session of the address still fails: %v", err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// aclFunc is an ACL implemented by a function.
+type aclFunc func(addr string) bool
+
+func (f aclFunc) Allow(addr string) bool { return f(addr) }
+
+func TestBindSession(t *testing.T) {
+	s := &Server{ACL: aclFunc(func(addr string) bool { return addr != "localhost:22" })}
+	session := newMockSession()
+	defer session.Close(nil)
+	webOnly := aclFunc(func(addr string) bool { return strings.HasSuffix(addr, ":443") })
+
+	if err := s.BindSession(session, webOnly); err != errBindingNotChecked {
+		t.Fatalf("session without binding: expected %v, got %v", errBindingNotChecked, err)
+	}
+	nonce, err := s.IssueBinding(session)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.BindSession(session, webOnly); err != errBindingNotChecked {
+		t.Fatalf("unchecked nonce: expected %v, got %v", errBindingNotChecked, err)
+	}
+	if !s.CheckBinding(session, nonce) {
+		t.Fatal("valid nonce was rejected")
+	}
+	if err = s.BindSession(session, webOnly); err != nil {
+		t.Fatal(err)
+	}
+	if !s.isBound(session) {
+		t.Fatal("session is not bound")
+	}
+
+	// the ACL of the session applies in addition to the one of the server
+	acl := s.sessionACL(session)
+	for _, addr := range []string{"localhost:22", "example.com:25"} {
+		if _, err := s.dial(addr, acl); err != ErrNotAllowed {
+			t.Errorf("%s: expected %v, got %v", addr, ErrNotAllowed, err)
+		}
+	}
+}
+
+func TestIsBindingRequest(t *testing.T) {
+	tests := []struct {
+		binding  string
+		upgrade  string
+		expected bool
+	}{
+		{"new", "", true},
+		{"", "", false},
+		{"nonce", "", false},
+		{"new", "QTP/0.1", false},
+	}
+	for _, test := range tests {
+		header := http.Header{}
+		header.Set(BindingHeader, test.binding)
+		header.Set("Upgrade", test.upgrade)
+		if IsBindingRequest(header) != test.expected {
+			t.Errorf("IsBindingRequest(%v) is %t, expected %t", header, !test.expected, test.expected)
+		}
+	}
+}
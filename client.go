@@ -2,31 +2,43 @@ package quictun
 
 import (
 	"bufio"
+	"crypto/rand"
 	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
-	"math/rand"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/julienschmidt/quictun/internal/atomic"
+	"github.com/julienschmidt/quictun/h2quic"
+	"github.com/julienschmidt/quictun/internal/clientstate"
 	"github.com/julienschmidt/quictun/internal/socks"
-	"golang.org/x/net/http2"
-	"golang.org/x/net/http2/hpack"
 
 	quic "github.com/lucas-clemente/quic-go"
 )
 
-const protocolIdentifier = "QTP/0.1"
+// sequenceRotation is the sequence number at which the client deliberately
+// rotates its ID, well before the sequence number would overflow.
+const sequenceRotation = math.MaxUint32 - 1<<16
+
+var dialAddr = quic.DialAddr
 
 var (
 	ErrInvalidResponse   = errors.New("server returned an invalid response")
 	ErrInvalidSequence   = errors.New("client sequence number invalid")
 	ErrNotAQuictunServer = errors.New("server does not seems to be a quictun server")
+	ErrUpgradeRejected   = errors.New("server did not accept the upgrade request")
 	ErrWrongCredentials  = errors.New("authentication credentials seems to be wrong")
+	ErrInviteRejected    = errors.New("server did not accept the invite")
 )
 
 // Client holds the configuration and state of a quictun client
@@ -37,141 +49,492 @@ type Client struct {
 	UserAgent   string
 	TlsCfg      *tls.Config
 	QuicConfig  *quic.Config
-	DialTimeout time.Duration
+	DialTimeout time.Duration // max duration of the QUIC handshake, overrides QuicConfig.HandshakeTimeout
+
+	// TokenAuth enables authentication by a replay protection token, which is
+	// derived from the credentials in the TunnelAddr. The credentials
+	// themselves and the sequence number are not sent then. Tokens are always
+	// bound to the session, see ChannelBinding.
+	TokenAuth bool
+
+	// Certificate authenticates the client by a certificate token signed with
+	// the key of the certificate, instead of by credentials or a sequence
+	// number. The certificate chain is sent in the upgrade request, since the
+	// QUIC handshake does not support client certificates. Credentials in the
+	// TunnelAddr are not sent then.
+	Certificate *tls.Certificate
+
+	// BearerToken returns a token, e.g. a JWT, which authenticates the client
+	// in the Authorization header instead of the credentials in the
+	// TunnelAddr. It is called for every binding and upgrade request. Servers
+	// accept every token in only one upgrade request, thus it must return a
+	// new token for every session. The sequence number protects the upgrade request
+	// against replays, thus it must not be combined with TokenAuth or
+	// Certificate.
+	BearerToken func() (string, error)
+
+	// Invite is an invite, which is redeemed for a user with a generated
+	// password before the first upgrade request. The client authenticates
+	// with replay protection tokens of that user then, see Invite. The
+	// credentials are persisted in the StateFile, if set, otherwise the
+	// invite is redeemed again after a restart, which fails once the invite
+	// was redeemed by its max number of clients.
+	Invite string
+
+	// ChannelBinding makes the client request a binding nonce from the server
+	// before the upgrade request, which binds the upgrade request and the token
+	// to the QUIC session. Clients authenticating with tokens or a BearerToken
+	// always do so.
+	ChannelBinding bool
+
+	// StateFile is the path of a file in which the client ID and the sequence
+	// number are persisted, so that they survive restarts of the client.
+	// If empty, a new client ID is generated on every start.
+	StateFile string
+
+	// Sessions is the number of parallel QUIC sessions to the server.
+	// Every tunneled connection is placed on the session with the fewest open
+	// streams, so that a lossy or flow control limited session does not slow
+	// down all connections. Sessions are connected on demand and reconnected
+	// independently of each other. Defaults to 1.
+	Sessions int
+
+	// Versions are the offered protocol versions in order of preference.
+	// Defaults to SupportedVersions.
+	Versions []string
+
+	// UserTag is sent as metadata with every tunneled connection, e.g. for
+	// logging and accounting on the server. Requires QTP/0.2.
+	UserTag string
+
+	// IdleTimeout is the duration after which the server closes tunneled
+	// connections without any traffic. Requires QTP/0.2.
+	IdleTimeout time.Duration
+
+	// Padding configures the padding of the traffic sent to the server.
+	// Requires QTP/0.2.
+	Padding Padding
+
+	// Profile controls the encoding of the requests of the client, so that they
+	// resemble the requests of a browser. A UserAgent, if set, takes precedence
+	// over the one of the profile. Defaults to ProfileChrome.
+	Profile *HeaderProfile
+
+	// Cover configures cover traffic, which is sent on every session. Cover
+	// traffic requires a server which keeps serving HTTP requests on upgraded
+	// sessions. nil disables cover traffic.
+	Cover *CoverTraffic
+
+	// Pins are the pins of keys in the certificate chain of the server. If
+	// set, the chain must contain a pinned key instead of being issued by a CA
+	// trusted according to TlsCfg, which allows self-hosted servers to use
+	// self-signed certificates without disabling the verification.
+	Pins []Pin
+
+	// PinFallback accepts chains without a pinned key if they are valid
+	// according to TlsCfg.
+	PinFallback bool
+
+	// Classify returns the priority class of a tunneled connection to the given
+	// destination. Defaults to ClassifyByPort(DefaultPortPriorities).
+	Classify func(host string, port int) Priority
 
 	// state
-	session   quic.Session
-	connected atomic.Bool
+	lock       sync.Mutex       // guards the session pool
+	sessions   []*clientSession // nil for disconnected sessions
+	connecting []bool           // whether the session is currently connecting
+	connectErr error            // error of the last failed connection attempt
+	connected  *sync.Cond       // signaled when a connection attempt finished
 
 	// replay protection
+	replayLock     sync.Mutex // serializes upgrade requests, guards the fields below
 	clientID       uint64
 	sequenceNumber uint32
+	state          *clientstate.File
+	stateKey       string // key of the state of the tunnel server
+	inviteUser     string // credentials of the redeemed invite
+	invitePassword string
+
+	derivedUser     string // credentials of derivedKey
+	derivedPassword string
+	derivedKey      []byte // token key, see tokenKey
+}
+
+// generateClientID generates a new random client ID and restarts the sequence.
+func (c *Client) generateClientID() error {
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+	c.clientID = binary.BigEndian.Uint64(id[:])
+	c.sequenceNumber = 0
+	return nil
+}
+
+// loadState initializes the replay protection state, either from the state
+// file or with a new client ID.
+func (c *Client) loadState() error {
+	if c.StateFile == "" {
+		return c.generateClientID()
+	}
+
+	uri, err := url.ParseRequestURI(c.TunnelAddr)
+	if err != nil {
+		return err
+	}
+	c.stateKey = authorityAddr(uri.Hostname(), uri.Port())
+	c.state, err = clientstate.Open(c.StateFile)
+	if err != nil {
+		return fmt.Errorf("Failed to open state file: %s", err)
+	}
+	if state, ok := c.state.Get(c.stateKey); ok {
+		c.clientID = state.ClientID
+		c.sequenceNumber = state.SequenceNumber
+		c.inviteUser = state.User
+		c.invitePassword = state.Password
+		return nil
+	}
+	return c.generateClientID()
+}
+
+// nextSequenceNumber increments the sequence number, rotating the client ID if
+// necessary. The new state is persisted before it is used.
+func (c *Client) nextSequenceNumber() error {
+	if c.sequenceNumber >= sequenceRotation {
+		if err := c.generateClientID(); err != nil {
+			return err
+		}
+	}
+	c.sequenceNumber++
+	return c.saveState()
+}
+
+// saveState persists the replay protection state and the credentials of the
+// redeemed invite, if a state file is used.
+func (c *Client) saveState() error {
+	if c.state == nil {
+		return nil
+	}
+	return c.state.Put(c.stateKey, clientstate.State{
+		ClientID:       c.clientID,
+		SequenceNumber: c.sequenceNumber,
+		User:           c.inviteUser,
+		Password:       c.invitePassword,
+	})
+}
 
-	// header
-	headerStream quic.Stream
-	hDecoder     *hpack.Decoder
-	h2framer     *http2.Framer
+// tokenKey returns the token key derived from the given credentials. The key
+// of the last credentials is kept, as deriving it is expensive.
+// c.replayLock must be held.
+func (c *Client) tokenKey(user, password string) []byte {
+	if c.derivedKey == nil || user != c.derivedUser || password != c.derivedPassword {
+		c.derivedKey = DeriveTokenKey(user, password)
+		c.derivedUser, c.derivedPassword = user, password
+	}
+	return c.derivedKey
 }
 
-func (c *Client) generateClientID() {
-	// generate clientID
-	rand.Seed(time.Now().UnixNano())
-	c.clientID = rand.Uint64()
+// usesTokens reports whether the client authenticates with tokens instead of
+// sequence numbers.
+func (c *Client) usesTokens() bool {
+	return c.TokenAuth || c.Certificate != nil || c.Invite != ""
+}
+
+// quicConfig returns the QUIC config of the client with the DialTimeout
+// applied. c.QuicConfig is not modified.
+func (c *Client) quicConfig() *quic.Config {
+	if c.DialTimeout <= 0 {
+		return c.QuicConfig
+	}
+	var cfg quic.Config
+	if c.QuicConfig != nil {
+		cfg = *c.QuicConfig
+	}
+	cfg.HandshakeTimeout = c.DialTimeout
+	return &cfg
 }
 
-func (c *Client) connect() error {
+// connect opens and upgrades a new QUIC session to the tunnel server.
+func (c *Client) connect() (cs *clientSession, err error) {
 	authURL := c.TunnelAddr
 
 	// extract hostname from auth url
 	uri, err := url.ParseRequestURI(authURL)
 	if err != nil {
-		log.Fatal("Invalid Auth URL: ", err)
-		return err
+		return nil, fmt.Errorf("Invalid Auth URL: %s", err)
 	}
 	hostname := authorityAddr(uri.Hostname(), uri.Port())
 	fmt.Println("Connecting to", hostname)
 
-	c.session, err = quic.DialAddr(hostname, c.TlsCfg, c.QuicConfig)
+	tlsCfg := c.TlsCfg
+	if len(c.Pins) > 0 {
+		tlsCfg = c.pinnedTLSConfig()
+	}
+	session, err := dialAddr(hostname, tlsCfg, c.quicConfig())
 	if err != nil {
-		log.Fatal("Dial Err: ", err)
-		return err
+		return nil, fmt.Errorf("Dial Err: %s", err)
+	}
+	defer func() {
+		if err != nil {
+			session.Close(err)
+		}
+	}()
+
+	// Fail closed, if the certificate chain of the server does not match the
+	// pins, before anything is sent on the session.
+	if len(c.Pins) > 0 {
+		if err = c.verifySession(session, uri.Hostname()); err != nil {
+			return nil, err
+		}
 	}
 
 	// once the version has been negotiated, open the header stream
-	c.headerStream, err = c.session.OpenStream()
+	cs, err = newClientSession(session, c.profile())
 	if err != nil {
-		log.Fatal("OpenStream Err: ", err)
-		return err
+		return nil, fmt.Errorf("OpenStream Err: %s", err)
 	}
-	//fmt.Println("Header StreamID:", c.headerStream.StreamID())
 
-	dataStream, err := c.session.OpenStreamSync()
-	if err != nil {
-		log.Fatal("OpenStreamSync Err: ", err)
+	// visit the website first, like a browser would
+	site := *uri
+	site.User = nil
+	if c.Cover != nil && len(c.Cover.Pages) > 0 {
+		if err = c.loadPage(cs, &site); err != nil {
+			return nil, fmt.Errorf("cover traffic: %s", err)
+		}
+	}
+
+	// redeem the invite, unless it was already redeemed
+	if c.Invite != "" {
+		if err = c.redeemInvite(cs, authURL); err != nil {
+			return nil, err
+		}
+	}
+
+	// request a nonce binding the upgrade request to this session
+	var binding string
+	if c.ChannelBinding || c.usesTokens() || c.BearerToken != nil {
+		binding, err = c.requestBinding(cs, authURL)
+		if err != nil {
+			return nil, err
+		}
 	}
-	//fmt.Println("Data StreamID:", dataStream.StreamID())
 
 	// build HTTP request
 	// The authorization credentials are automatically encoded from the URL
 	req, err := http.NewRequest("GET", authURL, nil)
 	if err != nil {
-		log.Fatal("NewRequest Err: ", err)
-		return err
+		return nil, fmt.Errorf("NewRequest Err: %s", err)
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
 	}
-	req.Header.Set("User-Agent", c.UserAgent)
 
 	// request protocol upgrade
 	req.Header.Set("Connection", "Upgrade")
-	req.Header.Set("Upgrade", protocolIdentifier)
+	req.Header.Set("Upgrade", strings.Join(c.versions(), ", "))
+	req.Header.Set(h2quic.MixedModeHeader, "1")
+	if binding != "" {
+		req.Header.Set(BindingHeader, binding)
+	}
+
+	// Upgrade requests are serialized, so that the server receives the
+	// sequence numbers in order, even if multiple sessions connect at once.
+	c.replayLock.Lock()
+	defer c.replayLock.Unlock()
 
 	// replay protection
-	c.sequenceNumber++
-	req.Header.Set("QTP", fmt.Sprintf("%016X%08X", c.clientID, c.sequenceNumber))
+	if err = c.authenticate(req, binding); err != nil {
+		return nil, err
+	}
 
-	rw := newRequestWriter(c.headerStream)
-	endStream := true //endStream := !hasBody
 	fmt.Println("requesting", authURL)
-	err = rw.WriteRequest(req, dataStream.StreamID(), endStream)
+	rsp, body, err := cs.roundTrip(req)
 	if err != nil {
-		log.Fatal("WriteHeaders Err: ", err)
+		return nil, err
 	}
-
-	fmt.Println("Waiting...")
-	// read frames from headerStream
-	c.h2framer = http2.NewFramer(nil, c.headerStream)
-	c.hDecoder = hpack.NewDecoder(4096, func(hf hpack.HeaderField) {})
-
-	frame, err := c.h2framer.ReadFrame()
-	if err != nil {
-		// c.headerErr = qerr.Error(qerr.HeadersStreamDataDecompressFailure, "cannot read frame")
-		log.Fatal("cannot read frame: ", err)
+	go discardBody(body)
+	if rsp.StatusCode != http.StatusSwitchingProtocols {
+		return nil, c.rejection(rsp.StatusCode)
 	}
-	hframe, ok := frame.(*http2.HeadersFrame)
-	if !ok {
-		// c.headerErr = qerr.Error(qerr.InvalidHeadersStreamData, "not a headers frame")
-		log.Fatal("not a headers frame: ", err)
+	header := rsp.Header
+	if header.Get("Connection") != "Upgrade" {
+		return nil, ErrInvalidResponse
 	}
-	mhframe := &http2.MetaHeadersFrame{HeadersFrame: hframe}
-	mhframe.Fields, err = c.hDecoder.DecodeFull(hframe.HeaderBlockFragment())
-	if err != nil {
-		// c.headerErr = qerr.Error(qerr.InvalidHeadersStreamData, "cannot read header fields")
-		log.Fatal("cannot read header fields: ", err)
+	// the server must select one of the offered versions
+	cs.version = header.Get("Upgrade")
+	if !containsString(c.versions(), cs.version) {
+		return nil, ErrNotAQuictunServer
 	}
+	// in mixed mode, the server keeps serving HTTP requests
+	cs.mixed = header.Get(h2quic.MixedModeHeader) == "1"
+	if c.Cover != nil && len(c.Cover.Pages) > 0 {
+		go c.coverTraffic(cs, &site)
+	}
+	return cs, nil
+}
 
-	//fmt.Println("Frame for StreamID:", hframe.StreamID)
-
-	rsp, err := responseFromHeaders(mhframe)
-	if err != nil {
-		log.Fatal("responseFromHeaders: ", err)
+// authenticate adds the credentials and the replay protection to the upgrade
+// request or the binding request, which is bound to the given binding nonce
+// or, for binding requests, to the bindingRequest value. Binding requests are
+// authenticated like upgrade requests, so that the server only issues binding
+// nonces to clients it would accept.
+// c.replayLock must be held.
+func (c *Client) authenticate(req *http.Request, binding string) error {
+	if c.BearerToken != nil {
+		token, err := c.BearerToken()
+		if err != nil {
+			return fmt.Errorf("bearer token: %s", err)
+		}
+		req.URL.User = nil
+		req.Header.Set("Authorization", "Bearer "+token)
 	}
-	switch rsp.StatusCode {
-	case http.StatusSwitchingProtocols:
-		header := rsp.Header
-		if header.Get("Connection") != "Upgrade" {
-			return ErrInvalidResponse
+
+	switch {
+	case c.Certificate != nil:
+		req.URL.User = nil
+		token, chain, err := newCertificateToken(c.Certificate, req.URL.Host, binding, time.Now())
+		if err != nil {
+			return err
 		}
-		if header.Get("Upgrade") != protocolIdentifier {
-			return ErrNotAQuictunServer
+		req.Header.Set("QTP", token)
+		req.Header.Set(CertificateHeader, chain)
+	case c.TokenAuth || c.Invite != "":
+		username, password := c.inviteUser, c.invitePassword
+		if c.Invite == "" {
+			user := req.URL.User
+			if user == nil {
+				return ErrWrongCredentials
+			}
+			username = user.Username()
+			password, _ = user.Password()
 		}
-		return nil
+		req.URL.User = nil
+		token, err := newToken(c.tokenKey(username, password), username, req.URL.Host, binding, time.Now())
+		if err != nil {
+			return err
+		}
+		req.Header.Set("QTP", token)
+	default:
+		if err := c.nextSequenceNumber(); err != nil {
+			return err
+		}
+		req.Header.Set("QTP", fmt.Sprintf("%016X%08X", c.clientID, c.sequenceNumber))
+	}
+	return nil
+}
+
+// rejection returns the error for a binding or upgrade request, which the
+// server answered with the given status instead of accepting it.
+// c.replayLock must be held.
+func (c *Client) rejection(status int) error {
+	switch status {
+	case http.StatusUpgradeRequired:
+		return ErrUnsupportedVersion
 	case http.StatusUnauthorized, http.StatusForbidden:
 		return ErrWrongCredentials
 	case http.StatusBadRequest:
-		c.generateClientID()
+		if c.usesTokens() {
+			return ErrInvalidToken
+		}
+		if err := c.generateClientID(); err != nil {
+			return err
+		}
 		return ErrInvalidSequence
 	default:
-		return ErrInvalidResponse
+		// Probe resistant servers answer failed requests like any other
+		// request, thus the cause of the failure is unknown. A new client
+		// ID is generated in case the sequence number was rejected.
+		if !c.usesTokens() {
+			if err := c.generateClientID(); err != nil {
+				return err
+			}
+		}
+		return ErrUpgradeRejected
 	}
 }
 
-func (c *Client) watchCancel() {
-	session := c.session
-	if session == nil {
-		fmt.Println("session is nil")
-		return
+// requestBinding requests a binding nonce for the current session, see
+// IsBindingRequest.
+func (c *Client) requestBinding(cs *clientSession, authURL string) (string, error) {
+	req, err := http.NewRequest("GET", authURL, nil)
+	if err != nil {
+		return "", err
+	}
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	req.Header.Set(BindingHeader, bindingRequest)
+
+	c.replayLock.Lock()
+	defer c.replayLock.Unlock()
+	if err = c.authenticate(req, bindingRequest); err != nil {
+		return "", err
+	}
+
+	rsp, body, err := cs.roundTrip(req)
+	if err != nil {
+		return "", err
+	}
+	go discardBody(body)
+	if rsp.StatusCode != http.StatusNoContent {
+		return "", c.rejection(rsp.StatusCode)
+	}
+	binding := rsp.Header.Get(BindingHeader)
+	if binding == "" {
+		return "", ErrNotAQuictunServer
+	}
+	return binding, nil
+}
+
+// redeemInvite redeems the invite for a user with a generated password, see
+// Invite. Once redeemed, the credentials are kept and persisted.
+func (c *Client) redeemInvite(cs *clientSession, authURL string) error {
+	c.replayLock.Lock()
+	defer c.replayLock.Unlock()
+	if c.inviteUser != "" {
+		return nil
+	}
+	// The password is kept for retries, for which the server creates the same
+	// user again.
+	if c.invitePassword == "" {
+		var password [24]byte
+		if _, err := rand.Read(password[:]); err != nil {
+			return err
+		}
+		c.invitePassword = base64.RawURLEncoding.EncodeToString(password[:])
+	}
+
+	req, err := http.NewRequest("GET", authURL, nil)
+	if err != nil {
+		return err
+	}
+	req.URL.User = nil
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	req.Header.Set(InviteHeader, c.Invite)
+	req.Header.Set(InvitePasswordHeader, c.invitePassword)
+
+	rsp, body, err := cs.roundTrip(req)
+	if err != nil {
+		return err
+	}
+	go discardBody(body)
+	user := rsp.Header.Get(InviteUserHeader)
+	if rsp.StatusCode != http.StatusNoContent || user == "" {
+		return ErrInviteRejected
 	}
+	c.inviteUser = user
+	if err = c.saveState(); err != nil {
+		return fmt.Errorf("Failed to save the credentials of the invite: %s", err)
+	}
+	fmt.Println("Redeemed invite as user", user)
+	return nil
+}
 
-	ctx := session.Context()
+// watchCancel removes the given session from the pool once it is closed.
+func (c *Client) watchCancel(i int, cs *clientSession) {
+	ctx := cs.session.Context()
 	if ctx == nil {
 		fmt.Println("ctx is nil")
 		return
@@ -180,7 +543,76 @@ func (c *Client) watchCancel() {
 	// TODO: add graceful shutdown channel
 	<-ctx.Done()
 	fmt.Println("session closed", ctx.Err())
-	c.connected.Set(false)
+	c.lock.Lock()
+	if c.sessions[i] == cs {
+		c.sessions[i] = nil
+	}
+	c.lock.Unlock()
+}
+
+// connectSession connects the i-th session of the pool.
+func (c *Client) connectSession(i int) {
+	cs, err := c.connect()
+
+	c.lock.Lock()
+	c.connecting[i] = false
+	if err != nil {
+		fmt.Println("Failed to connect to tunnel host:", err)
+		c.connectErr = err
+	} else {
+		c.sessions[i] = cs
+		// start watcher which removes the session when it is closed
+		go c.watchCancel(i, cs)
+	}
+	c.connected.Broadcast()
+	c.lock.Unlock()
+}
+
+// openStream opens a new stream on the least loaded session of the pool.
+// Disconnected sessions are connected in the background. Only if no session
+// is connected at all, it waits for the connection attempts.
+// The returned session's stream count must be decremented once the stream is
+// no longer used.
+func (c *Client) openStream() (quic.Stream, *clientSession, error) {
+	c.lock.Lock()
+	for i, cs := range c.sessions {
+		if cs == nil && !c.connecting[i] {
+			c.connecting[i] = true
+			go c.connectSession(i)
+		}
+	}
+
+	var best *clientSession
+	for {
+		connecting := false
+		for i, cs := range c.sessions {
+			if cs == nil {
+				connecting = connecting || c.connecting[i]
+				continue
+			}
+			if best == nil || atomic.LoadInt32(&cs.streams) < atomic.LoadInt32(&best.streams) {
+				best = cs
+			}
+		}
+		if best != nil || !connecting {
+			break
+		}
+		c.connected.Wait()
+	}
+	if best == nil {
+		err := c.connectErr
+		c.lock.Unlock()
+		return nil, nil, err
+	}
+	atomic.AddInt32(&best.streams, 1)
+	c.lock.Unlock()
+
+	stream, err := best.openTunnelStream()
+	if err != nil {
+		atomic.AddInt32(&best.streams, -1)
+		return nil, nil, err
+	}
+	return stream, best, nil
 }
 
 func (c *Client) tunnelConn(local net.Conn) {
@@ -209,44 +641,93 @@ func (c *Client) tunnelConn(local net.Conn) {
 	switch req.Cmd() {
 	case socks.CmdConnect:
 		fmt.Println("[Connect]")
-		if err = socks.SendReply(local, socks.StatusSucceeded, nil); err != nil {
-			fmt.Println(err)
-			local.Close()
-			return
-		}
-
 	default:
 		socks.SendReply(local, socks.StatusCmdNotSupported, nil)
 		local.Close()
 		return
 	}
 
-	// TODO: check connected status again and reconnect if necessary
-	stream, err := c.session.OpenStreamSync()
+	stream, cs, err := c.openStream()
 	if err != nil {
 		fmt.Println("open stream err", err)
+		socks.SendReply(local, socks.StatusGeneralFailure, nil)
+		local.Close()
+		return
+	}
+	defer atomic.AddInt32(&cs.streams, -1)
+
+	prio := c.classify(req.Dest().String())
+	streamWr := cs.sched.NewFlow(prio.weight()).Writer(stream)
+	switch cs.version {
+	case VersionQTP02:
+		c.tunnelQTP02(local, localRd, req, stream, streamWr, prio)
+	default:
+		c.tunnelQTP01(local, localRd, req, stream, streamWr, prio)
+	}
+}
+
+// tunnelQTP01 tunnels a SOCKS connection over a stream in the framing of
+// QTP/0.1: The stream starts with the SOCKS request, which carries the
+// priority class in the reserved field, followed by the raw data.
+// The server does not reply, thus the connection is reported as successful to
+// the SOCKS client right away.
+func (c *Client) tunnelQTP01(local net.Conn, localRd *bufio.Reader, req socks.Request, stream quic.Stream, streamWr io.WriteCloser, prio Priority) {
+	err := socks.SendReply(local, socks.StatusSucceeded, nil)
+	if err == nil {
+		header := append([]byte(nil), req...)
+		header[2] = byte(prio)
+		if _, err = localRd.Discard(len(req)); err == nil {
+			_, err = streamWr.Write(header)
+		}
+	}
+	if err != nil {
+		fmt.Println(err)
+		stream.Reset(err)
 		local.Close()
 		return
 	}
 
-	fmt.Println("Start proxying...")
-	go proxy(local, stream) // recv from stream and send to local
-	proxy(stream, localRd)  // recv from local and send to stream
+	fmt.Println("Start proxying...", prio)
+	done := make(chan struct{})
+	go func() {
+		proxy(local, stream) // recv from stream and send to local
+		close(done)
+	}()
+	proxy(streamWr, localRd) // recv from local and send to stream
+	<-done
 }
 
 // Close closes the client
 func (c *Client) close(err error) error {
-	if c.session == nil {
-		return nil
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var firstErr error
+	for _, cs := range c.sessions {
+		if cs == nil {
+			continue
+		}
+		if cerr := cs.session.Close(err); firstErr == nil {
+			firstErr = cerr
+		}
 	}
-	return c.session.Close(err)
+	return firstErr
 }
 
 // Run starts the client to accept incoming SOCKS connections, which are tunneled
 // to the configured quictun server.
-// The tunnel connection is opened only on-demand.
+// The tunnel sessions are opened only on-demand.
 func (c *Client) Run() error {
-	c.generateClientID()
+	if err := c.loadState(); err != nil {
+		return err
+	}
+
+	numSessions := c.Sessions
+	if numSessions < 1 {
+		numSessions = 1
+	}
+	c.sessions = make([]*clientSession, numSessions)
+	c.connecting = make([]bool, numSessions)
+	c.connected = sync.NewCond(&c.lock)
 
 	listener, err := net.Listen("tcp", c.ListenAddr)
 	if err != nil {
@@ -263,20 +744,6 @@ func (c *Client) Run() error {
 		}
 
 		fmt.Println("new SOCKS conn", conn.RemoteAddr().String())
-
-		if !c.connected.IsSet() {
-			err = c.connect()
-			if err != nil {
-				fmt.Println("Failed to connect to tunnel host:", err)
-				conn.Close()
-				continue
-			}
-			// start watcher which closes when canceled
-			go c.watchCancel()
-
-			c.connected.Set(true)
-		}
-
 		go c.tunnelConn(conn)
 	}
 }
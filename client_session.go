@@ -0,0 +1,213 @@
+package quictun
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/julienschmidt/quictun/h2quic"
+	"github.com/julienschmidt/quictun/internal/sched"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// clientSession is a QUIC session of a client to the tunnel server.
+type clientSession struct {
+	session quic.Session
+	streams int32  // number of open tunnel streams, accessed atomically
+	version string // negotiated protocol version
+	mixed   bool   // whether the session was upgraded in mixed mode
+	sched   *sched.Scheduler
+
+	// header
+	headerStream  quic.Stream
+	writeLock     sync.Mutex // serializes the requests written to the header stream
+	requestWriter *requestWriter
+	hDecoder      *hpack.Decoder
+	h2framer      *http2.Framer
+
+	// responses read from the header stream
+	responsesLock sync.Mutex
+	responses     map[quic.StreamID]chan<- responseResult // by data stream
+	readErr       error                                   // error which stopped reading
+}
+
+type responseResult struct {
+	rsp *http.Response
+	err error
+}
+
+// newClientSession opens the header stream on the given session. Requests are
+// encoded according to the given header profile.
+func newClientSession(session quic.Session, profile *HeaderProfile) (*clientSession, error) {
+	headerStream, err := session.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	//fmt.Println("Header StreamID:", headerStream.StreamID())
+
+	cs := &clientSession{
+		session:       session,
+		sched:         sched.New(1),
+		headerStream:  headerStream,
+		requestWriter: newRequestWriter(headerStream, profile),
+		hDecoder:      hpack.NewDecoder(4096, func(hf hpack.HeaderField) {}),
+		h2framer:      http2.NewFramer(nil, headerStream),
+		responses:     make(map[quic.StreamID]chan<- responseResult),
+	}
+	go cs.readResponses()
+	return cs, nil
+}
+
+// openTunnelStream opens a new tunnel stream. In mixed mode, the stream is
+// announced on the header stream, so that the server does not take it for the
+// data stream of an HTTP request.
+func (cs *clientSession) openTunnelStream() (quic.Stream, error) {
+	stream, err := cs.session.OpenStreamSync()
+	if err != nil || !cs.mixed {
+		return stream, err
+	}
+	cs.writeLock.Lock()
+	err = http2.NewFramer(cs.headerStream, nil).WriteRawFrame(h2quic.StreamFrameType, 0, uint32(stream.StreamID()), nil)
+	cs.writeLock.Unlock()
+	if err != nil {
+		stream.Reset(err)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// roundTrip sends the given request without a body on a new data stream and
+// waits for the response headers, at most until the context of the request is
+// done.
+// The response body is not read, but can be read from the returned data
+// stream, which is closed once it is read until EOF. A deadline of the context
+// is set as read deadline of the stream.
+func (cs *clientSession) roundTrip(req *http.Request) (*http.Response, quic.Stream, error) {
+	dataStream, err := cs.session.OpenStreamSync()
+	if err != nil {
+		return nil, nil, fmt.Errorf("OpenStreamSync Err: %s", err)
+	}
+	//fmt.Println("Data StreamID:", dataStream.StreamID())
+
+	// register for the response before sending the request
+	result := make(chan responseResult, 1)
+	cs.responsesLock.Lock()
+	if cs.readErr != nil {
+		err = cs.readErr
+	} else {
+		cs.responses[dataStream.StreamID()] = result
+	}
+	cs.responsesLock.Unlock()
+	if err != nil {
+		dataStream.Reset(err)
+		return nil, nil, err
+	}
+
+	endStream := true //endStream := !hasBody
+	cs.writeLock.Lock()
+	err = cs.requestWriter.WriteRequest(req, dataStream.StreamID(), endStream)
+	cs.writeLock.Unlock()
+	if err == nil {
+		// no request body is sent on the data stream
+		err = dataStream.Close()
+	}
+	if err != nil {
+		cs.removeResponse(dataStream.StreamID())
+		dataStream.Reset(err)
+		return nil, nil, fmt.Errorf("WriteHeaders Err: %s", err)
+	}
+	if deadline, ok := req.Context().Deadline(); ok {
+		dataStream.SetReadDeadline(deadline)
+	}
+
+	fmt.Println("Waiting...")
+	var res responseResult
+	select {
+	case res = <-result:
+	case <-req.Context().Done():
+		cs.removeResponse(dataStream.StreamID())
+		res.err = req.Context().Err()
+	}
+	if res.err != nil {
+		dataStream.Reset(res.err)
+		return nil, nil, res.err
+	}
+	return res.rsp, dataStream, nil
+}
+
+// removeResponse stops waiting for the response on the given data stream.
+func (cs *clientSession) removeResponse(id quic.StreamID) {
+	cs.responsesLock.Lock()
+	delete(cs.responses, id)
+	cs.responsesLock.Unlock()
+}
+
+// discardBody reads the response body from the data stream until EOF, so
+// that the stream is closed, or resets the stream if reading fails.
+func discardBody(dataStream quic.Stream) error {
+	_, err := io.Copy(ioutil.Discard, dataStream)
+	if err != nil {
+		dataStream.Reset(err)
+	}
+	return err
+}
+
+// readResponses reads the response headers from the header stream and passes
+// them on to the waiting requests, until the header stream fails.
+func (cs *clientSession) readResponses() {
+	for {
+		rsp, streamID, err := cs.readResponse()
+		if err != nil {
+			cs.responsesLock.Lock()
+			cs.readErr = err
+			for id, result := range cs.responses {
+				result <- responseResult{err: err}
+				delete(cs.responses, id)
+			}
+			cs.responsesLock.Unlock()
+			return
+		}
+
+		cs.responsesLock.Lock()
+		result, ok := cs.responses[streamID]
+		delete(cs.responses, streamID)
+		cs.responsesLock.Unlock()
+		if ok {
+			result <- responseResult{rsp: rsp}
+		}
+	}
+}
+
+// readResponse reads the next response from the header stream.
+func (cs *clientSession) readResponse() (*http.Response, quic.StreamID, error) {
+	frame, err := cs.h2framer.ReadFrame()
+	if err != nil {
+		// c.headerErr = qerr.Error(qerr.HeadersStreamDataDecompressFailure, "cannot read frame")
+		return nil, 0, fmt.Errorf("cannot read frame: %s", err)
+	}
+	hframe, ok := frame.(*http2.HeadersFrame)
+	if !ok {
+		// c.headerErr = qerr.Error(qerr.InvalidHeadersStreamData, "not a headers frame")
+		return nil, 0, errors.New("not a headers frame")
+	}
+	mhframe := &http2.MetaHeadersFrame{HeadersFrame: hframe}
+	mhframe.Fields, err = cs.hDecoder.DecodeFull(hframe.HeaderBlockFragment())
+	if err != nil {
+		// c.headerErr = qerr.Error(qerr.InvalidHeadersStreamData, "cannot read header fields")
+		return nil, 0, fmt.Errorf("cannot read header fields: %s", err)
+	}
+
+	//fmt.Println("Frame for StreamID:", hframe.StreamID)
+
+	rsp, err := responseFromHeaders(mhframe)
+	if err != nil {
+		return nil, 0, fmt.Errorf("responseFromHeaders: %s", err)
+	}
+	return rsp, quic.StreamID(hframe.StreamID), nil
+}
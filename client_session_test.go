@@ -0,0 +1,155 @@
+package quictun
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+type mockStream struct {
+	id quic.StreamID
+	io.Reader
+	io.Writer
+	closed bool
+	reset  bool
+}
+
+func (s *mockStream) StreamID() quic.StreamID          { return s.id }
+func (s *mockStream) Close() error                     { s.closed = true; return nil }
+func (s *mockStream) Reset(error)                      { s.reset = true }
+func (s *mockStream) Context() context.Context         { return context.Background() }
+func (s *mockStream) SetReadDeadline(time.Time) error  { return nil }
+func (s *mockStream) SetWriteDeadline(time.Time) error { return nil }
+func (s *mockStream) SetDeadline(time.Time) error      { return nil }
+
+func TestClientSessionResponses(t *testing.T) {
+	// header stream
+	requestRd, requestWr := io.Pipe()
+	responseRd, responseWr := io.Pipe()
+	defer requestWr.Close()
+	defer responseWr.Close()
+
+	session := newMockSession()
+	session.streams = make(chan quic.Stream, 3)
+	session.streams <- &mockStream{id: 3, Reader: responseRd, Writer: requestWr}
+	session.streams <- &mockStream{id: 5, Reader: strings.NewReader("body"), Writer: ioutil.Discard}
+	session.streams <- &mockStream{id: 7, Reader: strings.NewReader("body"), Writer: ioutil.Discard}
+	cs, err := newClientSession(session, ProfileChrome)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type result struct {
+		path, status, body string
+	}
+	results := make(chan result, 2)
+	for _, path := range []string{"/first", "/second"} {
+		go func(path string) {
+			req, _ := http.NewRequest("GET", "https://example.com"+path, nil)
+			rsp, body, err := cs.roundTrip(req)
+			if err != nil {
+				t.Error(err)
+				results <- result{}
+				return
+			}
+			b, _ := ioutil.ReadAll(body)
+			results <- result{path, rsp.Header.Get("X-Path"), string(b)}
+		}(path)
+	}
+
+	// read both requests and respond in reverse order
+	framer := http2.NewFramer(responseWr, requestRd)
+	decoder := hpack.NewDecoder(4096, nil)
+	paths := make(map[uint32]string)
+	var streamIDs []uint32
+	for i := 0; i < 2; i++ {
+		frame, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatal(err)
+		}
+		hframe := frame.(*http2.HeadersFrame)
+		fields, err := decoder.DecodeFull(hframe.HeaderBlockFragment())
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, hf := range fields {
+			if hf.Name == ":path" {
+				paths[hframe.StreamID] = hf.Value
+			}
+		}
+		streamIDs = append(streamIDs, hframe.StreamID)
+	}
+	var buf bytes.Buffer
+	encoder := hpack.NewEncoder(&buf)
+	for i := len(streamIDs) - 1; i >= 0; i-- {
+		buf.Reset()
+		encoder.WriteField(hpack.HeaderField{Name: ":status", Value: "200"})
+		encoder.WriteField(hpack.HeaderField{Name: "x-path", Value: paths[streamIDs[i]]})
+		err := framer.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      streamIDs[i],
+			EndHeaders:    true,
+			BlockFragment: buf.Bytes(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		res := <-results
+		if res.status != res.path || res.body != "body" {
+			t.Errorf("request for %s got the response for %s with body %q", res.path, res.status, res.body)
+		}
+	}
+
+	// pending requests fail once the header stream fails
+	responseWr.CloseWithError(errNotImplemented)
+	session.streams <- &mockStream{id: 9, Reader: strings.NewReader(""), Writer: ioutil.Discard}
+	go framer.ReadFrame()
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	if _, _, err := cs.roundTrip(req); err == nil {
+		t.Fatal("request succeeded after the header stream failed")
+	}
+}
+
+func TestClientSessionTimeout(t *testing.T) {
+	// the header stream never delivers a response
+	responseRd, responseWr := io.Pipe()
+	defer responseWr.Close()
+
+	session := newMockSession()
+	session.streams = make(chan quic.Stream, 2)
+	session.streams <- &mockStream{id: 3, Reader: responseRd, Writer: ioutil.Discard}
+	dataStream := &mockStream{id: 5, Reader: strings.NewReader(""), Writer: ioutil.Discard}
+	session.streams <- dataStream
+	cs, err := newClientSession(session, ProfileChrome)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequest("GET", "https://example.com/", nil)
+	if _, _, err := cs.roundTrip(req.WithContext(ctx)); err != context.DeadlineExceeded {
+		t.Fatalf("roundTrip returned %v, expected %v", err, context.DeadlineExceeded)
+	}
+	if !dataStream.closed || !dataStream.reset {
+		t.Error("data stream was not closed and reset")
+	}
+	cs.responsesLock.Lock()
+	pending := len(cs.responses)
+	cs.responsesLock.Unlock()
+	if pending != 0 {
+		t.Errorf("%d responses still awaited", pending)
+	}
+}
@@ -0,0 +1,109 @@
+package quictun
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+func TestClientState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "quictun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	newClient := func() *Client {
+		c := &Client{
+			TunnelAddr: "https://example.com/secret",
+			StateFile:  filepath.Join(dir, "state.json"),
+		}
+		if err := c.loadState(); err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	c := newClient()
+	for i := 0; i < 3; i++ {
+		if err = c.nextSequenceNumber(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the state survives restarts
+	restarted := newClient()
+	if restarted.clientID != c.clientID || restarted.sequenceNumber != 3 {
+		t.Fatalf("restored state is %016X/%d, should be %016X/3",
+			restarted.clientID, restarted.sequenceNumber, c.clientID)
+	}
+
+	// the ID is rotated before the sequence number overflows
+	restarted.sequenceNumber = sequenceRotation
+	if err = restarted.nextSequenceNumber(); err != nil {
+		t.Fatal(err)
+	}
+	if restarted.clientID == c.clientID || restarted.sequenceNumber != 1 {
+		t.Fatalf("state after rotation is %016X/%d, expected a new ID and 1",
+			restarted.clientID, restarted.sequenceNumber)
+	}
+	if rotated := newClient(); rotated.clientID != restarted.clientID || rotated.sequenceNumber != 1 {
+		t.Fatal("rotated state was not persisted")
+	}
+}
+
+func TestClientSessionPlacement(t *testing.T) {
+	c := &Client{}
+	c.connected = sync.NewCond(&c.lock)
+	c.sessions = make([]*clientSession, 3)
+	c.connecting = make([]bool, 3)
+	for i, streams := range []int32{3, 1, 2} {
+		c.sessions[i] = &clientSession{
+			session: newMockSession(),
+			streams: streams,
+		}
+	}
+
+	// streams are placed on the least loaded session
+	for _, expected := range []int{1, 1, 2} {
+		_, cs, err := c.openStream()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cs != c.sessions[expected] {
+			for i := range c.sessions {
+				if cs == c.sessions[i] {
+					t.Fatalf("stream was placed on session %d, expected %d", i, expected)
+				}
+			}
+		}
+	}
+	for i, expected := range []int32{3, 3, 3} {
+		if streams := c.sessions[i].streams; streams != expected {
+			t.Fatalf("session %d has %d streams, expected %d", i, streams, expected)
+		}
+	}
+}
+
+func TestClientDialTimeout(t *testing.T) {
+	c := &Client{}
+	if cfg := c.quicConfig(); cfg != nil {
+		t.Fatal("QUIC config without a dial timeout is not the default")
+	}
+
+	c.QuicConfig = &quic.Config{IdleTimeout: time.Minute}
+	c.DialTimeout = 5 * time.Second
+	cfg := c.quicConfig()
+	if cfg.HandshakeTimeout != 5*time.Second || cfg.IdleTimeout != time.Minute {
+		t.Fatalf("QUIC config has the handshake timeout %s and idle timeout %s, expected 5s and 1m",
+			cfg.HandshakeTimeout, cfg.IdleTimeout)
+	}
+	if c.QuicConfig.HandshakeTimeout != 0 {
+		t.Fatal("QUIC config of the client was modified")
+	}
+}
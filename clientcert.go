@@ -0,0 +1,202 @@
+package quictun
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A certificate token authenticates a client by a certificate instead of
+// credentials. The QUIC crypto handshake can not carry client certificates,
+// thus the client instead proves the possession of the key of its certificate
+// in the upgrade request, like with a replay protection token:
+// The QTP header carries a token of the form
+// "c1.<timestamp>.<nonce>.<signature>", where timestamp and nonce are the
+// fields of a replay protection token and signature is the base64url encoded
+// signature over all other fields, the request authority and the binding nonce
+// of the session, using the key of the certificate.
+// The CertificateHeader carries the certificate chain of the client.
+const certificateTokenVersion = "c1"
+
+// CertificateHeader is the name of the header field carrying the certificate
+// chain of a client authenticating with a certificate token, as a
+// comma-separated list of base64 encoded DER certificates, the client
+// certificate first.
+const CertificateHeader = "QTP-Certificate"
+
+// maxClientCertificates is the max number of certificates in the chain sent by
+// a client.
+const maxClientCertificates = 4
+
+// ErrUnsupportedKey is returned for certificates with keys other than ECDSA,
+// RSA and Ed25519 keys.
+var ErrUnsupportedKey = errors.New("unsupported certificate key")
+
+// certificateTokenMessage returns the message signed by a certificate token.
+func certificateTokenMessage(timestamp, nonce, authority, binding string) []byte {
+	var msg bytes.Buffer
+	writeFields(&msg, "quictun certificate token", certificateTokenVersion, timestamp, nonce, authority, binding)
+	return msg.Bytes()
+}
+
+// newCertificateToken creates a new certificate token for the given request
+// authority and binding nonce, signed with the key of the given certificate,
+// and returns it together with the value of the CertificateHeader.
+func newCertificateToken(cert *tls.Certificate, authority, binding string, now time.Time) (token, chain string, err error) {
+	signer, ok := cert.PrivateKey.(crypto.Signer)
+	if !ok || len(cert.Certificate) == 0 {
+		return "", "", ErrUnsupportedKey
+	}
+	var nonce [8]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		return "", "", err
+	}
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonceField := strconv.FormatUint(binary.BigEndian.Uint64(nonce[:]), 16)
+	msg := certificateTokenMessage(timestamp, nonceField, authority, binding)
+
+	var sig []byte
+	switch signer.Public().(type) {
+	case ed25519.PublicKey:
+		sig, err = signer.Sign(rand.Reader, msg, crypto.Hash(0))
+	default:
+		// ECDSA and RSA (PKCS #1 v1.5) sign the SHA-256 hash
+		digest := sha256.Sum256(msg)
+		sig, err = signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	certs := make([]string, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		certs[i] = base64.StdEncoding.EncodeToString(der)
+	}
+	token = strings.Join([]string{
+		certificateTokenVersion,
+		timestamp,
+		nonceField,
+		base64.RawURLEncoding.EncodeToString(sig),
+	}, ".")
+	return token, strings.Join(certs, ","), nil
+}
+
+// IsCertificateToken reports whether the given QTP header carries a
+// certificate token, which must be checked with CheckCertificateToken.
+func IsCertificateToken(header string) bool {
+	return strings.HasPrefix(header, certificateTokenVersion+".")
+}
+
+// CheckCertificateToken checks the certificate token and the certificate chain
+// in the CertificateHeader sent by a client for the given request authority
+// and returns the authenticated user.
+// binding must be the binding nonce checked with CheckBinding or, for binding
+// requests, the value of their BindingHeader. Tokens without a binding are
+// rejected, as they could be replayed on another session.
+//
+// The chain must be issued by one of the ClientCAs for client authentication
+// and is mapped to the user by ClientIdentity. ErrWrongCredentials is returned
+// for invalid or unmapped certificates and invalid signatures.
+func (s *Server) CheckCertificateToken(header, chain, authority, binding string) (user string, err error) {
+	fields := strings.Split(header, ".")
+	if len(fields) != 4 || fields[0] != certificateTokenVersion || binding == "" {
+		return "", ErrInvalidToken
+	}
+	timestamp, nonceField := fields[1], fields[2]
+	created, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	nonce, err := strconv.ParseUint(nonceField, 16, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(fields[3])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	rawCerts := strings.Split(chain, ",")
+	if chain == "" || len(rawCerts) > maxClientCertificates {
+		return "", ErrInvalidToken
+	}
+	certs := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		der, err := base64.StdEncoding.DecodeString(raw)
+		if err != nil {
+			return "", ErrInvalidToken
+		}
+		if certs[i], err = x509.ParseCertificate(der); err != nil {
+			return "", ErrInvalidToken
+		}
+	}
+
+	// verify the signature, which is cheaper than verifying the chain
+	var algorithm x509.SignatureAlgorithm
+	switch certs[0].PublicKeyAlgorithm {
+	case x509.ECDSA:
+		algorithm = x509.ECDSAWithSHA256
+	case x509.RSA:
+		algorithm = x509.SHA256WithRSA
+	case x509.Ed25519:
+		algorithm = x509.PureEd25519
+	default:
+		return "", ErrWrongCredentials
+	}
+	msg := certificateTokenMessage(timestamp, nonceField, authority, binding)
+	if certs[0].CheckSignature(algorithm, msg, sig) != nil {
+		return "", ErrWrongCredentials
+	}
+
+	// verify the chain and map it to the user
+	if s.ClientCAs == nil || s.ClientIdentity == nil {
+		return "", ErrWrongCredentials
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         s.ClientCAs,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	if err != nil {
+		return "", ErrWrongCredentials
+	}
+	for _, verified := range chains {
+		if user = s.ClientIdentity(verified); user != "" {
+			break
+		}
+	}
+	if user == "" {
+		return "", ErrWrongCredentials
+	}
+
+	// the token must have been created within the window, which also allows
+	// for some clock skew
+	window := s.TokenWindow
+	if window == 0 {
+		window = DefaultTokenWindow
+	}
+	age := time.Since(time.Unix(created, 0))
+	if age > window || age < -window {
+		return "", ErrTokenExpired
+	}
+
+	// the nonce may only be used once
+	if !s.NonceCache.SetIfGreater(nonce, uint32(created)) {
+		return "", ErrTokenReplayed
+	}
+	return user, nil
+}
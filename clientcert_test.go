@@ -0,0 +1,169 @@
+package quictun
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/quictun/internal/lru"
+)
+
+// newClientCert creates a certificate for the given name and usage with the
+// given key, signed by the given CA.
+func newClientCert(t *testing.T, name string, usage x509.ExtKeyUsage, key crypto.Signer, ca *x509.Certificate, caKey *ecdsa.PrivateKey) *tls.Certificate {
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func newCertificateServer(ca *x509.Certificate) *Server {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	return &Server{
+		ClientCAs: roots,
+		ClientIdentity: func(chain []*x509.Certificate) string {
+			if name := chain[0].Subject.CommonName; name != "mallory" {
+				return name
+			}
+			return ""
+		},
+		NonceCache: lru.New(100),
+	}
+}
+
+func TestCertificateToken(t *testing.T) {
+	ca, caKey := newCert(t, "CA", true, nil, nil)
+	s := newCertificateServer(ca)
+
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, key := range map[string]crypto.Signer{"ecdsa": ecKey, "rsa": rsaKey, "ed25519": edKey} {
+		cert := newClientCert(t, name, x509.ExtKeyUsageClientAuth, key, ca, caKey)
+		token, chain, err := newCertificateToken(cert, "example.com:443", "nonce", time.Now())
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if !IsCertificateToken(token) {
+			t.Fatalf("%s: token %q not recognized", name, token)
+		}
+		user, err := s.CheckCertificateToken(token, chain, "example.com:443", "nonce")
+		if err != nil {
+			t.Fatalf("%s: valid token was rejected: %v", name, err)
+		}
+		if user != name {
+			t.Fatalf("%s: authenticated user is %q", name, user)
+		}
+
+		// replay
+		if _, err = s.CheckCertificateToken(token, chain, "example.com:443", "nonce"); err != ErrTokenReplayed {
+			t.Fatalf("%s: expected ErrTokenReplayed for replayed token, got %v", name, err)
+		}
+	}
+}
+
+func TestCertificateTokenInvalid(t *testing.T) {
+	ca, caKey := newCert(t, "CA", true, nil, nil)
+	otherCA, otherKey := newCert(t, "Other CA", true, nil, nil)
+	s := newCertificateServer(ca)
+	now := time.Now()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bobKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice := newClientCert(t, "alice", x509.ExtKeyUsageClientAuth, key, ca, caKey)
+	bob := newClientCert(t, "bob", x509.ExtKeyUsageClientAuth, bobKey, ca, caKey)
+	serverCert := newClientCert(t, "alice", x509.ExtKeyUsageServerAuth, key, ca, caKey)
+
+	newTestToken := func(cert *tls.Certificate, authority, binding string, now time.Time) (string, string) {
+		token, chain, err := newCertificateToken(cert, authority, binding, now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token, chain
+	}
+
+	valid, validChain := newTestToken(alice, "example.com:443", "nonce", now)
+	_, bobChain := newTestToken(bob, "example.com:443", "nonce", now)
+	fields := strings.Split(valid, ".")
+	tampered := strings.Join(append(fields[:2:2], "1", fields[3]), ".")
+	untrusted, untrustedChain := newTestToken(newClientCert(t, "alice", x509.ExtKeyUsageClientAuth, key, otherCA, otherKey), "example.com:443", "nonce", now)
+	noClientAuth, noClientAuthChain := newTestToken(serverCert, "example.com:443", "nonce", now)
+	unmapped, unmappedChain := newTestToken(newClientCert(t, "mallory", x509.ExtKeyUsageClientAuth, key, ca, caKey), "example.com:443", "nonce", now)
+	otherAuthority, otherAuthorityChain := newTestToken(alice, "example.org:443", "nonce", now)
+	bound, boundChain := newTestToken(alice, "example.com:443", "other nonce", now)
+	expired, expiredChain := newTestToken(alice, "example.com:443", "nonce", now.Add(-time.Hour))
+
+	tests := []struct {
+		name  string
+		token string
+		chain string
+		err   error
+	}{
+		{"empty", "", "", ErrInvalidToken},
+		{"password token", "1.YWxpY2U.1.1.AAAA", validChain, ErrInvalidToken},
+		{"no chain", valid, "", ErrInvalidToken},
+		{"invalid chain", valid, "!!!", ErrInvalidToken},
+		{"long chain", valid, strings.Repeat(validChain+",", maxClientCertificates) + validChain, ErrInvalidToken},
+		{"tampered nonce", tampered, validChain, ErrWrongCredentials},
+		{"other certificate", valid, bobChain, ErrWrongCredentials},
+		{"untrusted CA", untrusted, untrustedChain, ErrWrongCredentials},
+		{"server certificate", noClientAuth, noClientAuthChain, ErrWrongCredentials},
+		{"unmapped", unmapped, unmappedChain, ErrWrongCredentials},
+		{"other authority", otherAuthority, otherAuthorityChain, ErrWrongCredentials},
+		{"bound", bound, boundChain, ErrWrongCredentials},
+		{"expired", expired, expiredChain, ErrTokenExpired},
+	}
+	for _, test := range tests {
+		if _, err := s.CheckCertificateToken(test.token, test.chain, "example.com:443", "nonce"); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// tokens must be bound to a session
+	unbound, unboundChain := newTestToken(alice, "example.com:443", "", now)
+	if _, err := s.CheckCertificateToken(unbound, unboundChain, "example.com:443", ""); err != ErrInvalidToken {
+		t.Errorf("unbound: expected %v, got %v", ErrInvalidToken, err)
+	}
+
+	// forged tokens must not end up in the nonce cache
+	if n := s.NonceCache.(*lru.LRU).Len(); n != 0 {
+		t.Fatalf("nonce cache has %d entries, should be empty", n)
+	}
+}
@@ -1,47 +1,170 @@
 package main
 
 import (
-	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/internal/config"
 )
 
 const (
-	// the User-Agent string is not observable, but should have the same length as a regular browser UA, e.g. that of Chrome
-	userAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10_13_3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/63.0.3239.108 X-quictun/0.1"
-
 	// timeout for establishing connections to quictun server (in seconds)
 	dialTimeout = 30
 )
 
+// priorityFlag collects the priority classes given as port=class pairs
+type priorityFlag map[int]string
+
+func (f priorityFlag) String() string {
+	return ""
+}
+
+func (f priorityFlag) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i < 1 {
+		return errors.New("expected port=class")
+	}
+	port, err := strconv.Atoi(value[:i])
+	if err != nil {
+		return err
+	}
+	if _, err = quictun.ParsePriority(value[i+1:]); err != nil {
+		return err
+	}
+	f[port] = value[i+1:]
+	return nil
+}
+
+// pagesFlag collects the pages of the cover traffic given as comma-separated
+// lists of paths. Pages given on the command line replace those of the
+// configuration file.
+type pagesFlag struct {
+	pages *[][]string
+	set   bool
+}
+
+func (f *pagesFlag) String() string {
+	return ""
+}
+
+func (f *pagesFlag) Set(value string) error {
+	if !f.set {
+		*f.pages = nil
+		f.set = true
+	}
+	*f.pages = append(*f.pages, strings.Split(value, ","))
+	return nil
+}
+
 func main() {
-	// command-line flags and args
-	listenFlag := flag.String("l", "localhost:1080", "local SOCKS listen address")
-	insecureFlag := flag.Bool("invalidCerts", false, "accept all invalid certs (insecure)")
+	// command-line flags and args, which override the values of the config file
+	cfg := defaultConfig()
+	flag.String("config", "", "load the configuration from the given JSON file")
+	flag.StringVar(&cfg.Listen, "l", cfg.Listen, "local SOCKS listen address")
+	flag.BoolVar(&cfg.TLS.Insecure, "invalidCerts", cfg.TLS.Insecure, "accept all invalid certs (insecure)")
+	flag.StringVar(&cfg.TLS.CA, "ca", cfg.TLS.CA, "verify the server certificate against the CA certificates in the given PEM file")
+	flag.Var(config.NewList(&cfg.TLS.Pins), "pin", "accept the server certificate if its chain contains the key with the given pin sha256/BASE64 instead of verifying it against the CAs (repeatable)")
+	flag.BoolVar(&cfg.TLS.PinFallback, "pinFallback", cfg.TLS.PinFallback, "accept certificates without a pinned key if they are issued by a trusted CA")
+	flag.StringVar(&cfg.TLS.Certificate, "cert", cfg.TLS.Certificate, "authenticate with the client certificate in the given PEM file instead of credentials")
+	flag.StringVar(&cfg.TLS.Key, "key", cfg.TLS.Key, "key file of the client certificate given with -cert")
+	flag.StringVar(&cfg.BearerFile, "bearerFile", cfg.BearerFile, "authenticate with the bearer token, e.g. a JWT, in the given file, which is read again for every request and must hold a new token for every session")
+	flag.BoolVar(&cfg.Token, "token", cfg.Token, "authenticate with a replay protection token derived from the credentials in the URL")
+	flag.BoolVar(&cfg.Binding, "binding", cfg.Binding, "bind the upgrade request to the QUIC session")
+	flag.IntVar(&cfg.Sessions, "sessions", cfg.Sessions, "number of parallel QUIC sessions to the server")
+	flag.Var(priorityFlag(cfg.Priorities), "priority", "classify connections to the given port as port=class, with the class interactive, normal or bulk (repeatable)")
+	flag.StringVar(&cfg.StateFile, "stateFile", cfg.StateFile, "persist the client ID and sequence number in the given file")
+	flag.Var(&cfg.DialTimeout, "dialTimeout", "timeout for establishing sessions to the server")
+	flag.StringVar(&cfg.UserTag, "userTag", cfg.UserTag, "tag sent with every tunneled connection for logging on the server (QTP/0.2 only)")
+	flag.IntVar(&cfg.Padding.Max, "padding", cfg.Padding.Max, "append random padding of up to the given number of bytes to every frame (QTP/0.2 only)")
+	flag.IntVar(&cfg.Padding.CoverRate, "coverRate", cfg.Padding.CoverRate, "send cover traffic of the given number of bytes per second on idle connections (QTP/0.2 only)")
+	flag.Var(&pagesFlag{pages: &cfg.Cover.Pages}, "cover", "load the page given as comma-separated paths of the document and its resources as cover traffic (repeatable)")
+	flag.Var(&cfg.Cover.Interval, "coverInterval", "mean interval between two page loads of the cover traffic")
+	flag.StringVar(&cfg.Profile, "profile", cfg.Profile, "encode requests like the given browser (chrome or chrome-android)")
+	flag.Var(&cfg.IdleTimeout, "idleTimeout", "let the server close tunneled connections idle for the given duration (QTP/0.2 only)")
+	flag.StringVar(&cfg.Log, "log", cfg.Log, "write the log to the given file instead of stdout")
 	flag.Usage = func() {
-		fmt.Printf("Usage: %s [OPTIONS] QUICTUN_URL\n", os.Args[0])
+		fmt.Printf("Usage: %s [OPTIONS] [QUICTUN_URL]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
+	if path := config.Path(flag.CommandLine, os.Args[1:]); path != "" {
+		if err := config.Load(path, cfg); err != nil {
+			fmt.Println("Invalid config file:", err)
+			os.Exit(2)
+		}
+	}
 	flag.Parse()
 	args := flag.Args()
-	if len(args) != 1 {
+	if len(args) > 1 {
 		flag.Usage()
 		return
 	}
-	tunnelAddr := args[0]
+	if len(args) == 1 {
+		cfg.Server = args[0]
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Println("Invalid config:", err)
+		os.Exit(2)
+	}
+	tlsCfg, err := cfg.tlsConfig()
+	if err != nil {
+		fmt.Println("Invalid config: tls:", err)
+		os.Exit(2)
+	}
+	pins, _ := cfg.pins() // validated
+	if cfg.invite() != "" && cfg.StateFile == "" {
+		fmt.Println("Note: without -stateFile, the credentials of the invite are lost on exit and the invite is redeemed again on the next start")
+	}
+	clientCert, err := cfg.clientCertificate()
+	if err != nil {
+		fmt.Println("Invalid config: tls:", err)
+		os.Exit(2)
+	}
+	if cfg.Log != "" {
+		if err = config.LogTo(cfg.Log); err != nil {
+			fmt.Println("Failed to open log file:", err)
+			os.Exit(1)
+		}
+	}
+
+	var cover *quictun.CoverTraffic
+	if len(cfg.Cover.Pages) > 0 {
+		cover = &quictun.CoverTraffic{
+			Pages:    cfg.Cover.Pages,
+			Interval: time.Duration(cfg.Cover.Interval),
+		}
+	}
 
 	// configure and run quictun client
 	client := quictun.Client{
-		ListenAddr:  *listenFlag,
-		TunnelAddr:  tunnelAddr,
-		UserAgent:   userAgent,
-		DialTimeout: dialTimeout * time.Second,
-		TlsCfg:      &tls.Config{InsecureSkipVerify: *insecureFlag},
+		ListenAddr:     cfg.Listen,
+		TunnelAddr:     cfg.tunnelURL(),
+		DialTimeout:    time.Duration(cfg.DialTimeout),
+		TlsCfg:         tlsCfg,
+		Pins:           pins,
+		PinFallback:    cfg.TLS.PinFallback,
+		TokenAuth:      cfg.Token,
+		Certificate:    clientCert,
+		BearerToken:    cfg.bearerToken(),
+		Invite:         cfg.invite(),
+		ChannelBinding: cfg.Binding,
+		StateFile:      cfg.StateFile,
+		Sessions:       cfg.Sessions,
+		Classify:       cfg.classify(),
+		Profile:        quictun.Profiles[cfg.Profile],
+		Cover:          cover,
+		UserTag:        cfg.UserTag,
+		IdleTimeout:    time.Duration(cfg.IdleTimeout),
+		Padding: quictun.Padding{
+			Max:       cfg.Padding.Max,
+			CoverRate: cfg.Padding.CoverRate,
+		},
 	}
 	log.Fatal(client.Run())
 }
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/internal/config"
+)
+
+// clientConfig is the configuration of the client, as loaded from the file
+// given with -config. Flags set on the command line override its values.
+//
+// Example:
+//
+//	{
+//		"listen": "localhost:1080",
+//		"server": "https://example.com/secret#pin-sha256=YLh1dUR9y6Kja30RrAn7JKnbQG/uEtLMkBgFF2Fuihg=",
+//		"user": "alice",
+//		"password": "secret",
+//		"token": true,
+//		"binding": true,
+//		"sessions": 2,
+//		"tls": {"ca": "ca.pem"},
+//		"idleTimeout": "10m",
+//		"priorities": {"22": "interactive", "873": "bulk"},
+//		"padding": {"max": 256},
+//		"cover": {"pages": [["/", "/style.css", "/logo.png"]], "interval": "1m"},
+//		"log": "quictun.log"
+//	}
+type clientConfig struct {
+	// local SOCKS listen address
+	Listen string `json:"listen"`
+
+	// quictun URL of the server; overridden by the command-line argument
+	Server string `json:"server"`
+
+	// credentials, unless given in the URL
+	User     string `json:"user"`
+	Password string `json:"password"`
+
+	// file holding a bearer token like a JWT, which authenticates the client
+	// instead of credentials; read again for every request, as servers
+	// accept every token for one session only
+	BearerFile string `json:"bearerFile"`
+
+	Token     bool   `json:"token"`
+	Binding   bool   `json:"binding"`
+	Sessions  int    `json:"sessions"`
+	StateFile string `json:"stateFile"`
+
+	TLS struct {
+		// accept all invalid certificates (insecure)
+		Insecure bool `json:"insecure"`
+		// file of PEM encoded CA certificates to verify the server against,
+		// instead of the system roots
+		CA string `json:"ca"`
+		// server name to verify, if it differs from the host in the URL
+		ServerName string `json:"serverName"`
+
+		// pins of keys in the certificate chain of the server, which is
+		// accepted instead of being verified against the CAs; pins can also
+		// be given in the fragment of the server URL as pin-sha256=BASE64
+		// pairs separated by &
+		Pins []string `json:"pins"`
+
+		// accept chains without a pinned key if they are issued by a CA
+		PinFallback bool `json:"pinFallback"`
+
+		// client certificate and key files, which authenticate the client
+		// instead of credentials
+		Certificate string `json:"certificate"`
+		Key         string `json:"key"`
+	} `json:"tls"`
+
+	// timeouts
+	DialTimeout config.Duration `json:"dialTimeout"`
+	IdleTimeout config.Duration `json:"idleTimeout"`
+
+	// priority classes by destination port, in addition to the defaults
+	Priorities map[int]string `json:"priorities"`
+
+	UserTag string `json:"userTag"`
+
+	Padding struct {
+		Max       int `json:"max"`
+		CoverRate int `json:"coverRate"`
+	} `json:"padding"`
+
+	Profile string `json:"profile"`
+
+	Cover struct {
+		Pages    [][]string      `json:"pages"`
+		Interval config.Duration `json:"interval"`
+	} `json:"cover"`
+
+	// log file; logs to stdout if unset
+	Log string `json:"log"`
+}
+
+// defaultConfig returns the default configuration.
+func defaultConfig() *clientConfig {
+	cfg := &clientConfig{
+		Listen:      "localhost:1080",
+		Sessions:    1,
+		DialTimeout: config.Duration(dialTimeout * time.Second),
+		Priorities:  make(map[int]string),
+		Profile:     "chrome",
+	}
+	for port, prio := range quictun.DefaultPortPriorities {
+		cfg.Priorities[port] = prio.String()
+	}
+	cfg.Cover.Interval = config.Duration(quictun.DefaultCoverInterval)
+	return cfg
+}
+
+// validate checks the configuration for invalid and conflicting values.
+func (c *clientConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %q: %s", c.Listen, err)
+	}
+	if c.Server == "" {
+		return errors.New("no server URL given")
+	}
+	server, _, err := splitURL(c.Server)
+	if err != nil {
+		return err
+	}
+	uri, err := url.ParseRequestURI(server)
+	if err != nil {
+		return fmt.Errorf("invalid server URL %q: %s", server, err)
+	}
+	if uri.Scheme != "https" || uri.Host == "" {
+		return fmt.Errorf("server URL %q must be an https URL", server)
+	}
+	if (c.User == "") != (c.Password == "") {
+		return errors.New("user and password must be given together")
+	}
+	if c.User != "" && uri.User != nil {
+		return errors.New("credentials must be given either in the server URL or as user and password")
+	}
+	if c.Token && c.User == "" && uri.User == nil {
+		return errors.New("token (-token) requires credentials")
+	}
+	if c.BearerFile != "" && (c.User != "" || uri.User != nil || c.Token || c.TLS.Certificate != "") {
+		return errors.New("bearerFile (-bearerFile) is mutually exclusive with credentials, token (-token) and tls.certificate (-cert)")
+	}
+	if c.invite() != "" && (c.User != "" || uri.User != nil || c.Token || c.TLS.Certificate != "" || c.BearerFile != "") {
+		return errors.New("invites in the server URL are mutually exclusive with credentials, token (-token), tls.certificate (-cert) and bearerFile (-bearerFile)")
+	}
+	if c.Sessions < 1 {
+		return errors.New("sessions (-sessions) must be at least 1")
+	}
+	if (c.TLS.Certificate == "") != (c.TLS.Key == "") {
+		return errors.New("tls.certificate (-cert) and tls.key (-key) must be given together")
+	}
+	if c.TLS.Certificate != "" && c.Token {
+		return errors.New("tls.certificate (-cert) and token (-token) are mutually exclusive")
+	}
+	if c.TLS.Insecure && c.TLS.CA != "" {
+		return errors.New("tls.insecure (-invalidCerts) and tls.ca (-ca) are mutually exclusive")
+	}
+	pins, err := c.pins()
+	if err != nil {
+		return err
+	}
+	if len(pins) > 0 && c.TLS.Insecure {
+		return errors.New("tls.pins (-pin) and tls.insecure (-invalidCerts) are mutually exclusive")
+	}
+	if len(pins) == 0 && c.TLS.PinFallback {
+		return errors.New("tls.pinFallback (-pinFallback) requires pins")
+	}
+	if c.DialTimeout <= 0 {
+		return errors.New("dialTimeout (-dialTimeout) must be positive")
+	}
+	if c.IdleTimeout < 0 {
+		return errors.New("idleTimeout (-idleTimeout) must not be negative")
+	}
+	for port, class := range c.Priorities {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("priorities: invalid port %d", port)
+		}
+		if _, err := quictun.ParsePriority(class); err != nil {
+			return fmt.Errorf("priorities: port %d: %s", port, err)
+		}
+	}
+	if c.Padding.Max < 0 || c.Padding.CoverRate < 0 {
+		return errors.New("padding.max (-padding) and padding.coverRate (-coverRate) must not be negative")
+	}
+	if _, ok := quictun.Profiles[c.Profile]; !ok {
+		return fmt.Errorf("unknown header profile %q", c.Profile)
+	}
+	for _, page := range c.Cover.Pages {
+		if len(page) == 0 {
+			return errors.New("cover.pages: empty page")
+		}
+	}
+	if c.Cover.Interval <= 0 {
+		return errors.New("cover.interval (-coverInterval) must be positive")
+	}
+	return nil
+}
+
+// tunnelURL returns the server URL including the credentials, but without the
+// pins.
+func (c *clientConfig) tunnelURL() string {
+	server, _, _ := splitURL(c.Server)
+	if c.User == "" {
+		return server
+	}
+	uri, _ := url.ParseRequestURI(server)
+	uri.User = url.UserPassword(c.User, c.Password)
+	return uri.String()
+}
+
+// splitURL splits the parameters in the fragment of the given server URL off,
+// which are pins given as pin-sha256=BASE64 and an invite given as
+// invite=INVITE. The values are not unescaped, as base64 uses + and /.
+func splitURL(rawURL string) (string, map[string][]string, error) {
+	i := strings.IndexByte(rawURL, '#')
+	if i < 0 {
+		return rawURL, nil, nil
+	}
+	params := make(map[string][]string)
+	for _, param := range strings.Split(rawURL[i+1:], "&") {
+		j := strings.IndexByte(param, '=')
+		if j < 0 || (param[:j] != "pin-sha256" && param[:j] != "invite") {
+			return "", nil, fmt.Errorf("server URL: unknown fragment parameter %q, expected pin-sha256=BASE64 or invite=INVITE", param)
+		}
+		params[param[:j]] = append(params[param[:j]], param[j+1:])
+	}
+	if len(params["invite"]) > 1 {
+		return "", nil, errors.New("server URL: more than one invite")
+	}
+	return rawURL[:i], params, nil
+}
+
+// invite returns the invite in the server URL, if any.
+func (c *clientConfig) invite() string {
+	_, params, _ := splitURL(c.Server)
+	if len(params["invite"]) == 0 {
+		return ""
+	}
+	return params["invite"][0]
+}
+
+// pins returns the pins from the configuration and the server URL.
+func (c *clientConfig) pins() ([]quictun.Pin, error) {
+	_, params, err := splitURL(c.Server)
+	if err != nil {
+		return nil, err
+	}
+	var pins []quictun.Pin
+	for _, s := range append(params["pin-sha256"], c.TLS.Pins...) {
+		pin, err := quictun.ParsePin(s)
+		if err != nil {
+			return nil, err
+		}
+		pins = append(pins, pin)
+	}
+	return pins, nil
+}
+
+// tlsConfig returns the TLS configuration for the connections to the server.
+func (c *clientConfig) tlsConfig() (*tls.Config, error) {
+	tlsCfg := &tls.Config{
+		InsecureSkipVerify: c.TLS.Insecure,
+		ServerName:         c.TLS.ServerName,
+	}
+	if c.TLS.CA != "" {
+		pem, err := ioutil.ReadFile(c.TLS.CA)
+		if err != nil {
+			return nil, err
+		}
+		tlsCfg.RootCAs = x509.NewCertPool()
+		if !tlsCfg.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLS.CA)
+		}
+	}
+	return tlsCfg, nil
+}
+
+// clientCertificate loads the client certificate, if any.
+func (c *clientConfig) clientCertificate() (*tls.Certificate, error) {
+	if c.TLS.Certificate == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.TLS.Certificate, c.TLS.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// bearerToken returns a function reading the bearer token from the file, if
+// any.
+func (c *clientConfig) bearerToken() func() (string, error) {
+	if c.BearerFile == "" {
+		return nil
+	}
+	return func() (string, error) {
+		token, err := ioutil.ReadFile(c.BearerFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(token)), nil
+	}
+}
+
+// classify returns the priority classifier.
+func (c *clientConfig) classify() func(host string, port int) quictun.Priority {
+	priorities := make(map[int]quictun.Priority, len(c.Priorities))
+	for port, class := range c.Priorities {
+		priorities[port], _ = quictun.ParsePriority(class)
+	}
+	return quictun.ClassifyByPort(priorities)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// acmeManager returns the manager which obtains and renews the certificates
+// for the configured hosts from the ACME CA.
+//
+// The account is registered with the first certificate request. Account key
+// and certificates are stored in the cache directory, if any, and renewed in
+// the background well before they expire.
+func acmeManager(cfg *serverConfig) (*autocert.Manager, error) {
+	client := &acme.Client{DirectoryURL: cfg.ACME.Directory}
+	if cfg.ACME.CA != "" {
+		// trust the TLS certificate of a test CA like Pebble
+		pem, err := ioutil.ReadFile(cfg.ACME.CA)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.ACME.CA)
+		}
+		client.HTTPClient = &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		}
+	}
+
+	m := &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(cfg.ACME.Hosts...),
+		Email:      cfg.ACME.Email,
+		Client:     client,
+	}
+	if cfg.ACME.Cache != "" {
+		m.Cache = autocert.DirCache(cfg.ACME.Cache)
+	}
+	return m, nil
+}
+
+// serveACME serves the ACME challenges: HTTP-01 on the HTTP listen address and
+// TLS-ALPN-01 on the TCP TLS listen address, if set. Other requests to the
+// HTTP listener are redirected to HTTPS, while the TLS listener serves all
+// other requests with the given handler, like a web server which additionally
+// offers QUIC.
+func serveACME(m *autocert.Manager, httpAddr, tlsAddr string, handler http.Handler) {
+	if httpAddr != "" {
+		// enables the HTTP-01 challenge, thus must be called before the first
+		// certificate is requested
+		challenges := m.HTTPHandler(nil)
+		go func() {
+			err := http.ListenAndServe(httpAddr, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// the host policy rejects host names with a port, which test
+				// CAs send for their non-standard challenge ports
+				if host, _, err := net.SplitHostPort(r.Host); err == nil {
+					r.Host = host
+				}
+				challenges.ServeHTTP(w, r)
+			}))
+			fmt.Println("ACME HTTP listener:", err)
+		}()
+	}
+	if tlsAddr != "" {
+		go func() {
+			server := &http.Server{
+				Addr:      tlsAddr,
+				Handler:   handler,
+				TLSConfig: m.TLSConfig(),
+			}
+			err := server.ListenAndServeTLS("", "")
+			fmt.Println("ACME TLS listener:", err)
+		}()
+	}
+}
+
+// obtainCertificates requests the certificates of all hosts in the
+// background, so that the first clients need not wait for their issuance.
+func obtainCertificates(m *autocert.Manager, hosts []string) {
+	for _, host := range hosts {
+		go func(host string) {
+			start := time.Now()
+			_, err := m.GetCertificate(&tls.ClientHelloInfo{ServerName: host})
+			if err != nil {
+				fmt.Println("Failed to obtain certificate for", host+":", err)
+				return
+			}
+			fmt.Println("Obtained certificate for", host, "in", time.Since(start))
+		}(host)
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"crypto/tls"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestACMEPebble obtains a certificate from a local Pebble ACME test server
+// (https://github.com/letsencrypt/pebble) via the HTTP-01 challenge. It only
+// runs if QUICTUN_PEBBLE_DIRECTORY is set, e.g.:
+//
+//	PEBBLE_VA_ALWAYS_VALID=1 pebble -config test/config/pebble-config.json &
+//	QUICTUN_PEBBLE_DIRECTORY=https://localhost:14000/dir \
+//	QUICTUN_PEBBLE_CA=test/certs/pebble.minica.pem \
+//	go test -run ACME ./cmd/quictun_server
+//
+// Without PEBBLE_VA_ALWAYS_VALID, Pebble must be able to reach the HTTP-01
+// listener, which listens on QUICTUN_PEBBLE_HTTP (default :5002, Pebble's
+// default httpPort), under the host name QUICTUN_PEBBLE_HOST (default
+// quictun.test), e.g. by resolving it with pebble-challtestsrv:
+//
+//	pebble-challtestsrv -defaultIPv4 127.0.0.1 -http01 "" -https01 "" -tlsalpn01 "" &
+//	pebble -config test/config/pebble-config.json -dnsserver 127.0.0.1:8053 &
+//
+// x/crypto/acme takes the order URL from the Location header of the finalize
+// response. Pebble versions which finalize orders asynchronously without
+// sending it make the test fail with `Post "": unsupported protocol scheme`.
+func TestACMEPebble(t *testing.T) {
+	directory := os.Getenv("QUICTUN_PEBBLE_DIRECTORY")
+	if directory == "" {
+		t.Skip("QUICTUN_PEBBLE_DIRECTORY not set")
+	}
+	host := os.Getenv("QUICTUN_PEBBLE_HOST")
+	if host == "" {
+		host = "quictun.test"
+	}
+	httpAddr := os.Getenv("QUICTUN_PEBBLE_HTTP")
+	if httpAddr == "" {
+		httpAddr = ":5002"
+	}
+	cache, err := ioutil.TempDir("", "acme")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	cfg := defaultConfig()
+	cfg.ACME.Hosts = []string{host}
+	cfg.ACME.Email = "test@example.com"
+	cfg.ACME.Cache = cache
+	cfg.ACME.Directory = directory
+	cfg.ACME.CA = os.Getenv("QUICTUN_PEBBLE_CA")
+	cfg.ACME.HTTP = httpAddr
+	if err = cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := acmeManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveACME(m, cfg.ACME.HTTP, "", http.NotFoundHandler())
+
+	hello := &tls.ClientHelloInfo{ServerName: host}
+	cert, err := m.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Leaf == nil {
+		t.Fatal("certificate without leaf")
+	}
+	if err = cert.Leaf.VerifyHostname(host); err != nil {
+		t.Fatal(err)
+	}
+
+	// the certificate is stored and reused
+	files, err := ioutil.ReadDir(cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Fatalf("expected account key and certificate in the cache, found %d files", len(files))
+	}
+	again, err := m.GetCertificate(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.Leaf.SerialNumber.Cmp(cert.Leaf.SerialNumber) != 0 {
+		t.Fatal("certificate issued again instead of reused")
+	}
+}
+
+func TestACMEConfig(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.ACME.Hosts = []string{"example.com"}
+	if err := cfg.validate(); err == nil {
+		t.Error("no error without cache directory")
+	}
+	cfg.ACME.Cache = "acme"
+	if err := cfg.validate(); err != nil {
+		t.Error(err)
+	}
+	cfg.ACME.HTTP = ""
+	if err := cfg.validate(); err == nil {
+		t.Error("no error without challenge listener")
+	}
+	cfg.ACME.TLS = ":443"
+	cfg.TLS.SelfSigned = []string{"example.com"}
+	if err := cfg.validate(); err == nil {
+		t.Error("no error for ACME and self-signed certificate")
+	}
+}
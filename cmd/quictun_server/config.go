@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/internal/certs"
+	"github.com/julienschmidt/quictun/internal/config"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// serverConfig is the configuration of the server, as loaded from the file
+// given with -config. Flags set on the command line override its values.
+//
+// Example:
+//
+//	{
+//		"listen": "0.0.0.0:443",
+//		"path": "/secret",
+//		"tls": {
+//			"certificates": [
+//				{"cert": "example.com/fullchain.pem", "key": "example.com/privkey.pem"},
+//				{"cert": "example.org/fullchain.pem", "key": "example.org/privkey.pem"}
+//			],
+//			"reloadInterval": "1m"
+//		},
+//		"dialTimeout": "30s",
+//		"users": {"alice": "secret"},
+//		"clientAuth": {"ca": "clients.pem", "identities": {"email:bob@example.com": "bob"}},
+//		"jwt": {
+//			"keys": "jwks.json", "audience": "quictun", "require": {"scope": "tunnel"},
+//			"policies": [{"name": "guest", "claim": "groups", "value": "guests", "allow": ["*:80", "*:443"]}]
+//		},
+//		"acl": {"deny": ["localhost", "127.0.0.0/8", "10.0.0.0/8", "*:25"]},
+//		"cache": {"file": "/var/lib/quictun/cache"},
+//		"binding": true,
+//		"padding": {"max": 256, "coverRate": 1024},
+//		"decoy": {"dir": "/var/www", "probeResistant": true, "minDelay": "300ms"},
+//		"log": "/var/log/quictun.log"
+//	}
+type serverConfig struct {
+	// QUIC listen address
+	Listen string `json:"listen"`
+
+	// path of the tunnel endpoint
+	Path string `json:"path"`
+
+	TLS struct {
+		// certificate and key files, selected by the server name indicated
+		// by the client; the first one is the default
+		Certificates []certs.KeyPair `json:"certificates"`
+
+		// host names and IP addresses to generate a self-signed certificate
+		// for, instead of loading certificates
+		SelfSigned []string `json:"selfSigned"`
+
+		// interval in which the files are checked for changes; zero disables
+		// the checks, but the files are still reloaded on SIGHUP
+		ReloadInterval config.Duration `json:"reloadInterval"`
+	} `json:"tls"`
+
+	// certificates obtained from an ACME CA like Let's Encrypt, instead of
+	// the TLS certificates
+	ACME struct {
+		// host names to obtain certificates for
+		Hosts []string `json:"hosts"`
+
+		// contact address of the account
+		Email string `json:"email"`
+
+		// directory to store the account key and certificates in
+		Cache string `json:"cache"`
+
+		// directory URL of the CA; defaults to Let's Encrypt
+		Directory string `json:"directory"`
+
+		// file of PEM encoded CA certificates to verify the TLS certificate
+		// of the directory against, e.g. of a test CA
+		CA string `json:"ca"`
+
+		// TCP listen addresses for the HTTP-01 and TLS-ALPN-01 challenges;
+		// either may be empty to disable the challenge type
+		HTTP string `json:"http"`
+		TLS  string `json:"tls"`
+	} `json:"acme"`
+
+	// timeouts
+	DialTimeout config.Duration `json:"dialTimeout"`
+	TokenWindow config.Duration `json:"tokenWindow"`
+
+	// passwords of the users by name; requires token authentication if set
+	Users map[string]string `json:"users"`
+
+	// client certificates, which authenticate clients as an alternative to
+	// the passwords of the users
+	ClientAuth struct {
+		// file of PEM encoded CA certificates issuing the client certificates
+		CA string `json:"ca"`
+
+		// file of CRLs of the CAs, reloaded like the TLS certificates
+		CRL string `json:"crl"`
+
+		// users by selector cn:NAME, dns:NAME, email:ADDRESS or uri:URI
+		// matching the client certificates; the common name is the user if
+		// unset
+		Identities map[string]string `json:"identities"`
+	} `json:"clientAuth"`
+
+	// JWTs sent as bearer tokens, which authenticate clients as an
+	// alternative to the passwords of the users
+	JWT struct {
+		// JWKS file of the keys the tokens must be signed with, reloaded like
+		// the TLS certificates
+		Keys string `json:"keys"`
+
+		// audience the tokens must be intended for, and their issuer, if set
+		Audience string `json:"audience"`
+		Issuer   string `json:"issuer"`
+
+		// claim holding the user; defaults to sub
+		UserClaim string `json:"userClaim"`
+
+		// values of claims the tokens must have; space-separated lists like
+		// scope and arrays must contain the value
+		Require map[string]string `json:"require"`
+
+		// tolerated clock skew for the expiry
+		Leeway config.Duration `json:"leeway"`
+
+		// policies in order of precedence; the first one matching a token
+		// restricts the destinations of its client in addition to the acl
+		Policies []jwtPolicy `json:"policies"`
+	} `json:"jwt"`
+
+	// directory of the invites created with the invite command, which are
+	// redeemed for users
+	Invites string `json:"invites"`
+
+	// destinations of tunneled connections
+	ACL struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	} `json:"acl"`
+
+	// replay protection cache
+	Cache struct {
+		File          string `json:"file"`
+		Redis         string `json:"redis"`
+		RedisPassword string `json:"redisPassword"`
+		Window        int    `json:"window"`
+	} `json:"cache"`
+
+	Binding bool `json:"binding"`
+
+	Padding struct {
+		Max       int `json:"max"`
+		CoverRate int `json:"coverRate"`
+	} `json:"padding"`
+
+	Decoy struct {
+		Dir            string `json:"dir"`
+		Origin         string `json:"origin"`
+		ProbeResistant bool   `json:"probeResistant"`
+
+		// min response time of requests to the tunnel path answered by the
+		// decoy in the probe resistant mode, which should exceed the time
+		// of the slowest check of a tunnel request
+		MinDelay config.Duration `json:"minDelay"`
+	} `json:"decoy"`
+
+	// log file; logs to stdout if unset
+	Log string `json:"log"`
+}
+
+// jwtPolicy maps JWTs to destinations their clients may connect to.
+type jwtPolicy struct {
+	// name of the policy, which is logged
+	Name string `json:"name"`
+
+	// claim and value matching the tokens like jwt.require; without claim,
+	// the policy matches all tokens
+	Claim string `json:"claim"`
+	Value string `json:"value"`
+
+	// destinations like acl
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// defaultConfig returns the default configuration.
+func defaultConfig() *serverConfig {
+	cfg := &serverConfig{
+		Listen:      "localhost:6121",
+		Path:        "/secret",
+		DialTimeout: config.Duration(dialTimeout * time.Second),
+		TokenWindow: config.Duration(quictun.DefaultTokenWindow),
+		Users:       make(map[string]string),
+	}
+	cfg.TLS.ReloadInterval = config.Duration(certReloadInterval)
+	cfg.ClientAuth.Identities = make(map[string]string)
+	cfg.JWT.UserClaim = "sub"
+	cfg.JWT.Require = make(map[string]string)
+	cfg.JWT.Leeway = config.Duration(jwtLeeway)
+	cfg.ACME.Directory = autocert.DefaultACMEDirectory
+	cfg.ACME.HTTP = ":80"
+	cfg.Cache.Window = 1
+	cfg.Decoy.MinDelay = config.Duration(decoyMinDelay)
+	return cfg
+}
+
+// validate checks the configuration for invalid and conflicting values.
+func (c *serverConfig) validate() error {
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("invalid listen address %q: %s", c.Listen, err)
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path %q must start with /", c.Path)
+	}
+	for _, pair := range c.TLS.Certificates {
+		if pair.Cert == "" || pair.Key == "" {
+			return errors.New("tls.certificates (-cert, -key) need both a cert and a key file")
+		}
+	}
+	if len(c.TLS.Certificates) > 0 && len(c.TLS.SelfSigned) > 0 {
+		return errors.New("tls.certificates (-cert, -key) and tls.selfSigned (-selfSigned) are mutually exclusive")
+	}
+	if len(c.ACME.Hosts) > 0 {
+		if len(c.TLS.Certificates) > 0 || len(c.TLS.SelfSigned) > 0 {
+			return errors.New("acme.hosts (-acme) and tls certificates (-cert, -selfSigned) are mutually exclusive")
+		}
+		if c.ACME.Cache == "" {
+			return errors.New("acme.cache (-acmeCache) is required to keep the account and certificates across restarts")
+		}
+		if c.ACME.HTTP == "" && c.ACME.TLS == "" {
+			return errors.New("acme.http (-acmeHTTP) or acme.tls (-acmeTLS) is required to answer the challenges")
+		}
+		if u, err := url.Parse(c.ACME.Directory); err != nil || u.Scheme != "https" {
+			return fmt.Errorf("acme.directory (-acmeDirectory) %q must be an https URL", c.ACME.Directory)
+		}
+	}
+	if c.TLS.ReloadInterval < 0 {
+		return errors.New("tls.reloadInterval (-reloadInterval) must not be negative")
+	}
+	if c.DialTimeout <= 0 {
+		return errors.New("dialTimeout (-dialTimeout) must be positive")
+	}
+	if c.TokenWindow <= 0 {
+		return errors.New("tokenWindow (-tokenWindow) must be positive")
+	}
+	for name, password := range c.Users {
+		if name == "" || password == "" {
+			return fmt.Errorf("users: user %q needs a name and a password", name)
+		}
+	}
+	if c.ClientAuth.CA == "" && (c.ClientAuth.CRL != "" || len(c.ClientAuth.Identities) > 0) {
+		return errors.New("clientAuth.crl (-clientCRL) and clientAuth.identities (-identity) require clientAuth.ca (-clientCA)")
+	}
+	if c.JWT.Keys == "" && (c.JWT.Audience != "" || c.JWT.Issuer != "" || len(c.JWT.Require) > 0) {
+		return errors.New("jwt.audience (-jwtAudience), jwt.issuer (-jwtIssuer) and jwt.require (-jwtRequire) require jwt.keys (-jwks)")
+	}
+	if c.JWT.Keys != "" && c.JWT.Audience == "" {
+		return errors.New("jwt.audience (-jwtAudience) is required, so that tokens for other services are rejected")
+	}
+	if c.JWT.UserClaim == "" {
+		return errors.New("jwt.userClaim (-jwtUserClaim) must not be empty")
+	}
+	if c.JWT.Leeway < 0 {
+		return errors.New("jwt.leeway (-jwtLeeway) must not be negative")
+	}
+	if c.JWT.Keys == "" && len(c.JWT.Policies) > 0 {
+		return errors.New("jwt.policies require jwt.keys (-jwks)")
+	}
+	policies := make(map[string]bool, len(c.JWT.Policies))
+	for _, p := range c.JWT.Policies {
+		if p.Name == "" || policies[p.Name] {
+			return fmt.Errorf("jwt.policies: policy %q needs a unique name", p.Name)
+		}
+		if p.Claim == "" && p.Value != "" {
+			return fmt.Errorf("jwt.policies: policy %q needs a claim for the value", p.Name)
+		}
+		policies[p.Name] = true
+	}
+	if c.Cache.File != "" && c.Cache.Redis != "" {
+		return errors.New("cache.file (-cacheFile) and cache.redis (-redis) are mutually exclusive")
+	}
+	if c.Cache.Window < 1 || c.Cache.Window > 64 {
+		return errors.New("cache.window (-window) must be between 1 and 64")
+	}
+	if c.Cache.Window > 1 && (c.Cache.File != "" || c.Cache.Redis != "") {
+		return errors.New("cache.window (-window) is only supported by the in-memory cache")
+	}
+	if c.Padding.Max < 0 || c.Padding.CoverRate < 0 {
+		return errors.New("padding.max (-padding) and padding.coverRate (-coverRate) must not be negative")
+	}
+	if c.Decoy.Dir != "" && c.Decoy.Origin != "" {
+		return errors.New("decoy.dir (-decoyDir) and decoy.origin (-decoyOrigin) are mutually exclusive")
+	}
+	if c.Decoy.MinDelay < 0 {
+		return errors.New("decoy.minDelay (-decoyDelay) must not be negative")
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/h2quic"
+)
+
+// newDecoyHandler returns the handler for all requests which are not tunnel
+// requests. It serves the static files in the directory dir or proxies requests
+// to the origin server at the URL origin, so that the server looks like an
+// ordinary website. Without either, all requests are answered with 404.
+func newDecoyHandler(dir, origin string) (http.Handler, error) {
+	switch {
+	case dir != "" && origin != "":
+		return nil, errors.New("the flags -decoyDir and -decoyOrigin are mutually exclusive")
+	case dir != "":
+		return http.FileServer(http.Dir(dir)), nil
+	case origin != "":
+		originURL, err := url.Parse(origin)
+		if err != nil {
+			return nil, err
+		}
+		if originURL.Scheme == "" || originURL.Host == "" {
+			return nil, errors.New("decoy origin must be an absolute URL")
+		}
+		return httputil.NewSingleHostReverseProxy(originURL), nil
+	default:
+		return http.NotFoundHandler(), nil
+	}
+}
+
+// isTunnelRequest returns whether the request is a request of a quictun client,
+// i.e. an upgrade request or, if channel binding or invites are used, a binding
+// or an invite redemption request.
+// All other requests to the tunnel path are handled by the decoy, so that the
+// path is indistinguishable from any other path of the website.
+func isTunnelRequest(r *http.Request, binding, invites bool) bool {
+	if quictun.IsBindingRequest(r.Header) {
+		return binding
+	}
+	if quictun.IsInviteRequest(r.Header) {
+		return invites
+	}
+	return r.Header.Get("Upgrade") != ""
+}
+
+// tunnelHeaders are the header fields only sent by quictun clients.
+var tunnelHeaders = []string{"Connection", "Upgrade", "QTP", "Authorization", h2quic.MixedModeHeader, quictun.BindingHeader, quictun.CertificateHeader, quictun.InviteHeader, quictun.InvitePasswordHeader}
+
+// decoyRequest returns a copy of the tunnel request r without the header fields
+// of the tunnel protocol, which the decoy handles like any other request.
+func decoyRequest(r *http.Request) *http.Request {
+	header := make(http.Header, len(r.Header))
+	for k, vv := range r.Header {
+		header[k] = vv
+	}
+	for _, k := range tunnelHeaders {
+		header.Del(k)
+	}
+	r2 := r.WithContext(r.Context())
+	r2.Header = header
+	return r2
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/h2quic"
+	"github.com/julienschmidt/quictun/internal/invites"
+	"github.com/julienschmidt/quictun/internal/jwt"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// tunnelHandler handles the requests to the tunnel path. It redeems invites,
+// issues binding nonces and authenticates upgrade requests, which are then
+// upgraded to the quictun protocol. All other requests are answered by the
+// decoy, which hides the tunnel endpoint among the routes of an ordinary
+// website.
+type tunnelHandler struct {
+	server *quictun.Server
+	decoy  http.Handler
+
+	// probeResistant answers failed tunnel requests like the decoy, after at
+	// least minDelay like all other requests to the tunnel path
+	probeResistant bool
+	minDelay       time.Duration
+
+	// tokens enables replay protection tokens of configured users and of users
+	// created from invites
+	tokens  bool
+	invites *invites.Store
+
+	// bearerTokens validates JWT bearer tokens, if enabled. The ACLs of the
+	// policies of the validator are mapped by their name.
+	bearerTokens *jwt.Validator
+	policyACLs   map[string]quictun.ACL
+}
+
+// requestStartKey is the context key of the time a request was received.
+type requestStartKey struct{}
+
+func (h *tunnelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), requestStartKey{}, time.Now()))
+	if !isTunnelRequest(r, h.server.RequireBinding, h.invites != nil) {
+		h.serveDecoy(w, r)
+		return
+	}
+
+	// invite redemption
+	if h.invites != nil && quictun.IsInviteRequest(r.Header) {
+		h.redeemInvite(w, r)
+		return
+	}
+
+	// channel binding
+	var binding string
+	session, _ := r.Context().Value(h2quic.SessionContextKey).(quic.Session)
+	if h.server.RequireBinding {
+		if session == nil {
+			h.fail(w, r, http.StatusInternalServerError)
+			return
+		}
+		if quictun.IsBindingRequest(r.Header) {
+			// binding requests are authenticated like upgrade requests, so
+			// that probers can not obtain binding nonces
+			if _, status := h.authenticate(r, r.Header.Get(quictun.BindingHeader)); status != http.StatusOK {
+				h.fail(w, r, status)
+				return
+			}
+			h.issueBinding(w, r, session)
+			return
+		}
+		binding = r.Header.Get(quictun.BindingHeader)
+		if !h.server.CheckBinding(session, binding) {
+			h.fail(w, r, http.StatusBadRequest)
+			return
+		}
+	}
+
+	// select the protocol version
+	version, ok := h.server.SelectVersion(r.Header["Upgrade"])
+	if !ok {
+		if h.probeResistant {
+			h.fail(w, r, http.StatusUpgradeRequired)
+			return
+		}
+		w.Header().Set("Connection", "Upgrade, close")
+		w.Header().Set("Upgrade", strings.Join(quictun.SupportedVersions, ", "))
+		w.WriteHeader(http.StatusUpgradeRequired)
+		r.Close = true
+		return
+	}
+
+	// replay protection and authentication
+	acl, status := h.authenticate(r, binding)
+	if status != http.StatusOK {
+		h.fail(w, r, status)
+		return
+	}
+	if h.server.RequireBinding {
+		if err := h.server.BindSession(session, acl); err != nil {
+			fmt.Println("Failed to bind session:", err)
+			h.fail(w, r, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// keep serving HTTP requests on the session, if the client supports it
+	if r.Header.Get(h2quic.MixedModeHeader) == "1" {
+		w.Header().Set(h2quic.MixedModeHeader, "1")
+	}
+
+	// switch to quictun protocol in the selected version
+	w.Header().Set("Connection", "Upgrade")
+	w.Header().Set("Upgrade", version)
+	w.WriteHeader(http.StatusSwitchingProtocols)
+}
+
+// fail answers a failed tunnel request with the given status or, in the probe
+// resistant mode, exactly like the decoy answers the request without the tunnel
+// header fields. Thus a prober can not tell requests with invalid tunnel header
+// fields apart from ordinary requests.
+func (h *tunnelHandler) fail(w http.ResponseWriter, r *http.Request, status int) {
+	if h.probeResistant {
+		h.serveDecoy(w, decoyRequest(r))
+		return
+	}
+	w.Header().Set("Connection", "close")
+	w.WriteHeader(status)
+	r.Close = true
+}
+
+// serveDecoy answers the request by the decoy. In the probe resistant mode,
+// the answer is delayed until minDelay passed since the request was received,
+// so that the checks of failed tunnel requests, e.g. cache lookups or deriving
+// the token key of an invite, do not make them slower than other requests to
+// the tunnel path.
+func (h *tunnelHandler) serveDecoy(w http.ResponseWriter, r *http.Request) {
+	if start, ok := r.Context().Value(requestStartKey{}).(time.Time); ok && h.probeResistant {
+		time.Sleep(time.Until(start.Add(h.minDelay)))
+	}
+	h.decoy.ServeHTTP(w, r)
+}
+
+// redeemInvite answers an invite redemption request with the name of the
+// created user.
+func (h *tunnelHandler) redeemInvite(w http.ResponseWriter, r *http.Request) {
+	user, err := h.server.RedeemInvite(r.Header.Get(quictun.InviteHeader), r.Header.Get(quictun.InvitePasswordHeader))
+	if err != nil {
+		fmt.Println("Rejected invite:", err)
+		h.fail(w, r, http.StatusForbidden)
+		return
+	}
+	fmt.Println("Redeemed invite as user", user)
+	w.Header().Set(quictun.InviteUserHeader, user)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// issueBinding answers a binding request with a new binding nonce for the
+// session.
+func (h *tunnelHandler) issueBinding(w http.ResponseWriter, r *http.Request, session quic.Session) {
+	nonce, err := h.server.IssueBinding(session)
+	if err != nil {
+		fmt.Println("Failed to issue binding:", err)
+		h.fail(w, r, http.StatusServiceUnavailable)
+		return
+	}
+	w.Header().Set(quictun.BindingHeader, nonce)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// authenticate checks the replay protection and the credentials of the upgrade
+// request, which was bound with the given binding nonce, if any, or of the
+// binding request, whose tokens are bound to its BindingHeader. It returns the
+// ACL restricting the destinations of the authenticated user, if any, and the
+// status of a failed upgrade request, or http.StatusOK.
+func (h *tunnelHandler) authenticate(r *http.Request, binding string) (quictun.ACL, int) {
+	header := r.Header.Get("QTP")
+	clientAuth := h.server.ClientCAs != nil
+	bearer := bearerToken(r)
+	switch {
+	case h.bearerTokens != nil && bearer != "":
+		// Every bearer token is only accepted in one upgrade request, which
+		// is only accepted on the session it is bound to. Binding requests
+		// are authenticated with the same token before.
+		id, err := h.bearerTokens.Validate(bearer)
+		if err != nil {
+			fmt.Println("Rejected bearer token:", err)
+			return nil, http.StatusUnauthorized
+		}
+		if !h.server.CheckSequenceNumber(header) {
+			return nil, http.StatusBadRequest
+		}
+		if !quictun.IsBindingRequest(r.Header) {
+			tokenID := id.ID
+			if tokenID == "" {
+				tokenID = bearer
+			}
+			if err = h.server.CheckTokenID(tokenID, id.Expires); err != nil {
+				fmt.Println("Rejected bearer token:", err)
+				return nil, http.StatusUnauthorized
+			}
+		}
+		if id.Policy == "" {
+			fmt.Println("Authenticated user", id.User)
+			return nil, http.StatusOK
+		}
+		fmt.Println("Authenticated user", id.User, "with policy", id.Policy)
+		return h.policyACLs[id.Policy], http.StatusOK
+
+	case h.tokens || clientAuth || h.bearerTokens != nil:
+		var user string
+		var err error
+		switch {
+		case clientAuth && quictun.IsCertificateToken(header):
+			user, err = h.server.CheckCertificateToken(header, r.Header.Get(quictun.CertificateHeader), r.Host, binding)
+		case h.tokens:
+			user, err = h.server.CheckToken(header, r.Host, binding)
+		default:
+			err = quictun.ErrWrongCredentials
+		}
+		switch err {
+		case nil:
+			fmt.Println("Authenticated user", user)
+			return nil, http.StatusOK
+		case quictun.ErrWrongCredentials:
+			return nil, http.StatusUnauthorized
+		default:
+			return nil, http.StatusBadRequest
+		}
+
+	case !h.server.CheckSequenceNumber(header):
+		return nil, http.StatusBadRequest
+	}
+	return nil, http.StatusOK
+}
+
+// bearerToken returns the token of a bearer Authorization header, if any.
+func bearerToken(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if len(auth) < len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return ""
+	}
+	return strings.TrimSpace(auth[len("Bearer "):])
+}
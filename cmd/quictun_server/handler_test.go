@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/h2quic"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+type mockSession struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newMockSession() *mockSession {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &mockSession{ctx: ctx, cancel: cancel}
+}
+
+var errNotImplemented = errors.New("not implemented")
+
+func (s *mockSession) AcceptStream() (quic.Stream, error)   { return nil, errNotImplemented }
+func (s *mockSession) OpenStream() (quic.Stream, error)     { return nil, errNotImplemented }
+func (s *mockSession) OpenStreamSync() (quic.Stream, error) { return nil, errNotImplemented }
+func (s *mockSession) LocalAddr() net.Addr                  { return nil }
+func (s *mockSession) RemoteAddr() net.Addr                 { return nil }
+func (s *mockSession) Close(error) error                    { s.cancel(); return nil }
+func (s *mockSession) Context() context.Context             { return s.ctx }
+
+func (s *mockSession) ConnectionState() quic.ConnectionState { return quic.ConnectionState{} }
+
+// newTestHandler returns a probe resistant tunnel handler requiring channel
+// binding, with a decoy which answers every request with 404.
+func newTestHandler() *tunnelHandler {
+	cfg := defaultConfig()
+	cfg.Binding = true
+	return &tunnelHandler{
+		server:         newQuictunServer(cfg, map[string][]byte{}, nil, nil),
+		decoy:          http.NotFoundHandler(),
+		probeResistant: true,
+	}
+}
+
+// serve sends a request with the given header fields on the session to the
+// handler.
+func serve(h http.Handler, session quic.Session, header map[string]string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "https://example.com/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), h2quic.SessionContextKey, session))
+	for k, v := range header {
+		r.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+// Binding requests must be authenticated like upgrade requests, so that a
+// prober can not tell the tunnel endpoint apart by requesting a binding nonce.
+func TestBindingRequestAuthentication(t *testing.T) {
+	h := newTestHandler()
+	session := newMockSession()
+	defer session.Close(nil)
+
+	w := serve(h, session, map[string]string{quictun.BindingHeader: "new"})
+	if w.Code != http.StatusNotFound || w.Header().Get(quictun.BindingHeader) != "" {
+		t.Fatalf("unauthenticated binding request was answered with %d and nonce %q, expected the decoy",
+			w.Code, w.Header().Get(quictun.BindingHeader))
+	}
+
+	seq := 1
+	sequence := func() string {
+		seq++
+		return fmt.Sprintf("%016X%08X", 42, seq)
+	}
+	w = serve(h, session, map[string]string{quictun.BindingHeader: "new", "QTP": sequence()})
+	nonce := w.Header().Get(quictun.BindingHeader)
+	if w.Code != http.StatusNoContent || nonce == "" {
+		t.Fatalf("authenticated binding request was answered with %d and nonce %q", w.Code, nonce)
+	}
+
+	// the session is only bound by an authenticated upgrade request
+	upgrade := map[string]string{
+		"Connection":          "Upgrade",
+		"Upgrade":             quictun.VersionQTP02,
+		quictun.BindingHeader: nonce,
+	}
+	w = serve(h, session, upgrade)
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unauthenticated upgrade request was answered with %d, expected the decoy", w.Code)
+	}
+
+	w = serve(h, session, map[string]string{quictun.BindingHeader: "new", "QTP": sequence()})
+	upgrade[quictun.BindingHeader] = w.Header().Get(quictun.BindingHeader)
+	upgrade["QTP"] = sequence()
+	w = serve(h, session, upgrade)
+	if w.Code != http.StatusSwitchingProtocols {
+		t.Fatalf("upgrade request was answered with %d", w.Code)
+	}
+}
+
+// In the probe resistant mode, rejected tunnel requests and other requests to
+// the tunnel path take at least the min delay, so that the checks of tunnel
+// requests can not be told apart by their response time.
+func TestDecoyMinDelay(t *testing.T) {
+	h := newTestHandler()
+	h.minDelay = 50 * time.Millisecond
+	session := newMockSession()
+	defer session.Close(nil)
+
+	requests := []map[string]string{
+		nil,
+		{quictun.BindingHeader: "new"},
+		{"Connection": "Upgrade", "Upgrade": quictun.VersionQTP02, quictun.BindingHeader: "invalid"},
+	}
+	for _, header := range requests {
+		start := time.Now()
+		w := serve(h, session, header)
+		if elapsed := time.Since(start); elapsed < h.minDelay {
+			t.Errorf("request with %v was answered after %s, expected at least %s", header, elapsed, h.minDelay)
+		}
+		if w.Code != http.StatusNotFound {
+			t.Errorf("request with %v was answered with %d, expected the decoy", header, w.Code)
+		}
+	}
+}
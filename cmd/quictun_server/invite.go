@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/internal/config"
+	"github.com/julienschmidt/quictun/internal/invites"
+)
+
+// default duration for which invites can be redeemed
+const inviteValidity = 7 * 24 * time.Hour
+
+// inviteCommand creates and revokes invites, which are links for the client
+// embedding a signed, expiring credential:
+//
+//	quictun_server invite -invites DIR -url https://example.com/secret -name alice [-valid 24h] [-uses 1]
+//	quictun_server invite -invites DIR -revoke ID|LINK
+//
+// The key of the invites is generated in the directory on first use.
+func inviteCommand(args []string) {
+	fs := flag.NewFlagSet("invite", flag.ExitOnError)
+	dir := fs.String("invites", "", "directory of the invites, as given to the server with -invites")
+	tunnelURL := fs.String("url", "", "tunnel URL of the server, e.g. https://example.com/secret, which may contain pins in the fragment")
+	name := fs.String("name", "", "name of the user created from the invite, with a unique suffix if -uses is greater than 1")
+	valid := config.Duration(inviteValidity)
+	fs.Var(&valid, "valid", "duration for which the invite can be redeemed; created users do not expire")
+	uses := fs.Int("uses", 1, "max number of clients which can redeem the invite")
+	revoke := fs.String("revoke", "", "revoke the invite with the given ID or link, including the users created from it")
+	fs.Parse(args)
+	if *dir == "" || fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	key, err := invites.LoadKey(*dir, *revoke == "")
+	if err != nil {
+		fmt.Println("Failed to load the invite key:", err)
+		os.Exit(1)
+	}
+
+	if *revoke != "" {
+		id := *revoke
+		if i := strings.Index(id, "invite="); i >= 0 {
+			id = id[i+len("invite="):]
+			if j := strings.IndexByte(id, '&'); j >= 0 {
+				id = id[:j]
+			}
+		}
+		if strings.HasPrefix(id, "i1.") {
+			inv, err := quictun.ParseInvite(key, id)
+			if err != nil {
+				fmt.Println("Invalid invite:", err)
+				os.Exit(2)
+			}
+			id = inv.ID
+		}
+		if err = invites.Revoke(*dir, id, "revoked "+time.Now().UTC().Format(time.RFC3339)); err != nil {
+			fmt.Println("Failed to revoke invite:", err)
+			os.Exit(1)
+		}
+		fmt.Println("Revoked invite", id+", effective once the server reloaded the invites (SIGHUP or -reloadInterval)")
+		return
+	}
+
+	uri, err := url.ParseRequestURI(strings.SplitN(*tunnelURL, "#", 2)[0])
+	if err != nil || uri.Scheme != "https" || uri.Host == "" || uri.User != nil {
+		fmt.Println("Invalid config: -url must be an https URL without credentials")
+		os.Exit(2)
+	}
+	if *name == "" || valid <= 0 || *uses < 1 {
+		fmt.Println("Invalid config: -name is required and -valid and -uses must be positive")
+		os.Exit(2)
+	}
+	inv := &quictun.Invite{
+		Name:    *name,
+		Expires: time.Now().Add(time.Duration(valid)),
+		MaxUses: *uses,
+	}
+	token, err := inv.Sign(key)
+	if err != nil {
+		fmt.Println("Failed to create invite:", err)
+		os.Exit(1)
+	}
+
+	link := *tunnelURL
+	if strings.Contains(link, "#") {
+		link += "&invite=" + token
+	} else {
+		link += "#invite=" + token
+	}
+	fmt.Println("Created invite", inv.ID, "for", inv.Name+" and up to", inv.MaxUses, "clients, valid until", inv.Expires.Format(time.RFC3339))
+	fmt.Println(link)
+}
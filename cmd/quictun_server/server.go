@@ -1,63 +1,385 @@
 package main
 
 import (
+	"crypto/tls"
+	"errors"
 	"flag"
 	"fmt"
 	"net/http"
+	"os"
+	"strings"
 	"time"
 
 	"github.com/julienschmidt/quictun"
 	"github.com/julienschmidt/quictun/h2quic"
+	"github.com/julienschmidt/quictun/internal/acl"
+	"github.com/julienschmidt/quictun/internal/certs"
+	"github.com/julienschmidt/quictun/internal/clientauth"
+	"github.com/julienschmidt/quictun/internal/config"
+	"github.com/julienschmidt/quictun/internal/filecache"
+	"github.com/julienschmidt/quictun/internal/invites"
+	"github.com/julienschmidt/quictun/internal/jwt"
 	"github.com/julienschmidt/quictun/internal/lru"
-	"github.com/julienschmidt/quictun/internal/testdata"
+	"github.com/julienschmidt/quictun/internal/redis"
 )
 
 const (
 	dialTimeout = 30
+
+	// interval in which certificate files are checked for changes
+	certReloadInterval = time.Minute
+
+	// max number of cached client sequence numbers
+	sequenceCacheSize = 1 << 16
+
+	// number of shards of the in-memory sequence cache
+	sequenceCacheShards = 16
+
+	// time after which cached client sequence numbers expire
+	sequenceExpiry = 7 * 24 * time.Hour
+
+	// max number of cached token nonces, i.e. of tokens accepted within twice
+	// the token window. Further tokens are refused until nonces expire.
+	nonceCacheSize = 1 << 18
+
+	// tolerated clock skew for the expiry of JWTs
+	jwtLeeway = time.Minute
+
+	// min response time of requests to the tunnel path answered by the decoy
+	// in the probe resistant mode, which exceeds the time of deriving a token
+	// key for an invite and of cache lookups
+	decoyMinDelay = 300 * time.Millisecond
 )
 
-func main() {
-	// command-line args
-	listenFlag := flag.String("l", "localhost:6121", "QUIC listen address")
+// userFlag collects the users given as name:password pairs
+type userFlag map[string]string
+
+func (f userFlag) String() string {
+	return ""
+}
+
+func (f userFlag) Set(value string) error {
+	i := strings.IndexByte(value, ':')
+	if i < 1 {
+		return errors.New("expected name:password")
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
+
+// identityFlag collects the identities of client certificates given as
+// selector=user pairs
+type identityFlag map[string]string
+
+func (f identityFlag) String() string {
+	return ""
+}
+
+func (f identityFlag) Set(value string) error {
+	i := strings.LastIndexByte(value, '=')
+	if i < 1 {
+		return errors.New("expected selector=user")
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
+
+// claimFlag collects the required claims of JWTs given as claim=value pairs
+type claimFlag map[string]string
+
+func (f claimFlag) String() string {
+	return ""
+}
+
+func (f claimFlag) Set(value string) error {
+	i := strings.IndexByte(value, '=')
+	if i < 1 {
+		return errors.New("expected claim=value")
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
+
+// newQuictunServer returns the quictun server for the config, which accepts
+// tokens of the given users, by their token keys, and redeems invites, if an
+// invite store is given.
+func newQuictunServer(cfg *serverConfig, users map[string][]byte, inviteStore *invites.Store, destACL quictun.ACL) *quictun.Server {
+	tokenWindow := time.Duration(cfg.TokenWindow)
+	sequenceCache := lru.NewWithOptions(sequenceCacheSize, lru.Options{
+		Shards: sequenceCacheShards,
+		TTL:    sequenceExpiry,
+		Window: cfg.Cache.Window,
+	})
+	nonceCache := lru.NewWithOptions(nonceCacheSize, lru.Options{
+		Shards:  sequenceCacheShards,
+		TTL:     2 * tokenWindow,
+		NoEvict: true,
+	})
+	s := &quictun.Server{
+		DialTimeout:   time.Duration(cfg.DialTimeout),
+		SequenceCache: sequenceCache,
+		ACL:           destACL,
+		TokenKey: func(user string) []byte {
+			if key, ok := users[user]; ok || inviteStore == nil {
+				return key
+			}
+			return inviteStore.TokenKey(user)
+		},
+		TokenWindow: tokenWindow,
+		NonceCache:  nonceCache,
+		// tokens are only valid for the session they are bound to, and bearer
+		// tokens are only accepted in requests bound to the session
+		RequireBinding: cfg.Binding || len(users) > 0 || inviteStore != nil || cfg.ClientAuth.CA != "" || cfg.JWT.Keys != "",
+		Padding: quictun.Padding{
+			Max:       cfg.Padding.Max,
+			CoverRate: cfg.Padding.CoverRate,
+		},
+	}
+	if inviteStore != nil {
+		// TokenKey prefers configured users, which thus must not be
+		// created from invites
+		inviteStore.Reserved = func(name string) bool {
+			_, ok := users[name]
+			return ok
+		}
+		s.InviteKey = inviteStore.Key()
+		s.Invites = inviteStore
+	}
+	return s
+}
+
+// parseFlags loads the config file given with -config and applies the
+// command-line flags, which override the values of the file. It exits on
+// invalid configs.
+func parseFlags() *serverConfig {
+	// command-line args, which override the values of the config file
+	cfg := defaultConfig()
+	flag.String("config", "", "load the configuration from the given JSON file")
+	flag.StringVar(&cfg.Listen, "l", cfg.Listen, "QUIC listen address")
+	var certFiles, keyFiles []string
+	flag.Var(config.NewList(&certFiles), "cert", "TLS certificate chain file, selected by SNI if given multiple times, the first one being the default (repeatable, default test certificate)")
+	flag.Var(config.NewList(&keyFiles), "key", "TLS key file for the certificate given with -cert at the same position (repeatable)")
+	flag.Var(config.NewList(&cfg.TLS.SelfSigned), "selfSigned", "generate a self-signed certificate for the given host name or IP address, for lab setups (repeatable)")
+	flag.Var(config.NewList(&cfg.ACME.Hosts), "acme", "obtain a certificate for the given host name from the ACME CA (repeatable)")
+	flag.StringVar(&cfg.ACME.Email, "acmeEmail", cfg.ACME.Email, "contact address of the ACME account")
+	flag.StringVar(&cfg.ACME.Cache, "acmeCache", cfg.ACME.Cache, "directory to store the ACME account key and certificates in")
+	flag.StringVar(&cfg.ACME.Directory, "acmeDirectory", cfg.ACME.Directory, "directory URL of the ACME CA")
+	flag.StringVar(&cfg.ACME.CA, "acmeCA", cfg.ACME.CA, "verify the ACME CA against the CA certificates in the given PEM file, e.g. for a test CA")
+	flag.StringVar(&cfg.ACME.HTTP, "acmeHTTP", cfg.ACME.HTTP, "TCP listen address for the ACME HTTP-01 challenge, empty to disable")
+	flag.StringVar(&cfg.ACME.TLS, "acmeTLS", cfg.ACME.TLS, "TCP listen address for the ACME TLS-ALPN-01 challenge, which also serves the decoy via HTTPS, empty to disable")
+	flag.Var(&cfg.TLS.ReloadInterval, "reloadInterval", "check the certificate files for changes in the given interval, 0 to only reload them on SIGHUP")
+	flag.Var(&cfg.DialTimeout, "dialTimeout", "timeout for connecting to destinations")
+	flag.Var(&cfg.TokenWindow, "tokenWindow", "max age of accepted replay protection tokens")
+	flag.StringVar(&cfg.Cache.File, "cacheFile", cfg.Cache.File, "persist the replay protection cache in the given file")
+	flag.StringVar(&cfg.Cache.Redis, "redis", cfg.Cache.Redis, "share the replay protection cache via the Redis server at the given address")
+	flag.StringVar(&cfg.Cache.RedisPassword, "redisPassword", cfg.Cache.RedisPassword, "password for the Redis server")
+	flag.Var(userFlag(cfg.Users), "user", "allow the user given as name:password and require token authentication (repeatable)")
+	flag.StringVar(&cfg.ClientAuth.CA, "clientCA", cfg.ClientAuth.CA, "allow clients with a certificate issued by the CAs in the given PEM file")
+	flag.StringVar(&cfg.ClientAuth.CRL, "clientCRL", cfg.ClientAuth.CRL, "reject client certificates revoked by the CRLs in the given file")
+	flag.Var(identityFlag(cfg.ClientAuth.Identities), "identity", "map client certificates matching the selector cn:NAME, dns:NAME, email:ADDRESS or uri:URI to the user, given as selector=user, instead of using the common name (repeatable)")
+	flag.StringVar(&cfg.JWT.Keys, "jwks", cfg.JWT.Keys, "allow clients with a JWT bearer token signed with a key of the given JWKS file")
+	flag.StringVar(&cfg.JWT.Audience, "jwtAudience", cfg.JWT.Audience, "audience JWTs must be intended for")
+	flag.StringVar(&cfg.JWT.Issuer, "jwtIssuer", cfg.JWT.Issuer, "issuer JWTs must be issued by")
+	flag.StringVar(&cfg.JWT.UserClaim, "jwtUserClaim", cfg.JWT.UserClaim, "claim of JWTs holding the user")
+	flag.Var(claimFlag(cfg.JWT.Require), "jwtRequire", "require JWTs to have the claim given as claim=value, or to contain the value if the claim is a list (repeatable)")
+	flag.Var(&cfg.JWT.Leeway, "jwtLeeway", "tolerated clock skew for the expiry of JWTs")
+	flag.StringVar(&cfg.Invites, "invites", cfg.Invites, "redeem invites created with the invite command, which stores them in the given directory")
+	flag.Var(config.NewList(&cfg.ACL.Allow), "allow", "allow only connections to destinations matching the given rule (repeatable)")
+	flag.Var(config.NewList(&cfg.ACL.Deny), "deny", "deny connections to destinations matching the given rule (repeatable)")
+	flag.IntVar(&cfg.Cache.Window, "window", cfg.Cache.Window, "accept unseen sequence numbers up to the given number (max 64) below the highest one, for clients using parallel sessions")
+	flag.BoolVar(&cfg.Binding, "binding", cfg.Binding, "require upgrade requests to be bound to the QUIC session, which is implied by token, certificate and bearer token authentication")
+	flag.IntVar(&cfg.Padding.Max, "padding", cfg.Padding.Max, "append random padding of up to the given number of bytes to every frame (QTP/0.2 only)")
+	flag.IntVar(&cfg.Padding.CoverRate, "coverRate", cfg.Padding.CoverRate, "send cover traffic of the given number of bytes per second on idle connections (QTP/0.2 only)")
+	flag.StringVar(&cfg.Path, "path", cfg.Path, "path of the tunnel endpoint")
+	flag.StringVar(&cfg.Decoy.Dir, "decoyDir", cfg.Decoy.Dir, "serve the static files in the given directory to all other requests")
+	flag.StringVar(&cfg.Decoy.Origin, "decoyOrigin", cfg.Decoy.Origin, "proxy all other requests to the origin server at the given URL")
+	flag.BoolVar(&cfg.Decoy.ProbeResistant, "probeResistant", cfg.Decoy.ProbeResistant, "answer failed upgrade requests like the decoy instead of with an error status")
+	flag.Var(&cfg.Decoy.MinDelay, "decoyDelay", "min response time of requests to the tunnel path answered like the decoy in the probe resistant mode, which should exceed the time of the checks of tunnel requests")
+	flag.StringVar(&cfg.Log, "log", cfg.Log, "write the log to the given file instead of stdout")
+	if path := config.Path(flag.CommandLine, os.Args[1:]); path != "" {
+		if err := config.Load(path, cfg); err != nil {
+			fmt.Println("Invalid config file:", err)
+			os.Exit(2)
+		}
+	}
 	flag.Parse()
 	args := flag.Args()
 	if len(args) > 0 {
 		flag.Usage()
+		os.Exit(2)
+	}
+	if len(certFiles) != len(keyFiles) {
+		fmt.Println("Invalid config: -cert and -key must be given the same number of times")
+		os.Exit(2)
+	}
+	if len(certFiles) > 0 {
+		cfg.TLS.Certificates = make([]certs.KeyPair, len(certFiles))
+		for i := range certFiles {
+			cfg.TLS.Certificates[i] = certs.KeyPair{Cert: certFiles[i], Key: keyFiles[i]}
+		}
+	}
+	if err := cfg.validate(); err != nil {
+		fmt.Println("Invalid config:", err)
+		os.Exit(2)
+	}
+	return cfg
+}
+
+// newBearerValidator returns the validator of JWT bearer tokens and the ACLs of
+// its policies by name, or nil if bearer tokens are disabled.
+func newBearerValidator(cfg *serverConfig) (*jwt.Validator, map[string]quictun.ACL, error) {
+	if cfg.JWT.Keys == "" {
+		return nil, nil, nil
+	}
+	keys, err := jwt.LoadKeySet(cfg.JWT.Keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	v := &jwt.Validator{
+		Keys:      keys,
+		Audience:  cfg.JWT.Audience,
+		Issuer:    cfg.JWT.Issuer,
+		UserClaim: cfg.JWT.UserClaim,
+		Require:   cfg.JWT.Require,
+		Leeway:    time.Duration(cfg.JWT.Leeway),
+	}
+	policyACLs := make(map[string]quictun.ACL, len(cfg.JWT.Policies))
+	for _, p := range cfg.JWT.Policies {
+		policyACL, err := acl.New(p.Allow, p.Deny)
+		if err != nil {
+			return nil, nil, fmt.Errorf("policy %s: %s", p.Name, err)
+		}
+		policyACLs[p.Name] = policyACL
+		v.Policies = append(v.Policies, jwt.Policy{Name: p.Name, Claim: p.Claim, Value: p.Value})
+	}
+	return v, policyACLs, nil
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "invite" {
+		inviteCommand(os.Args[2:])
 		return
 	}
-	listenAddr := *listenFlag
 
-	quictunServer := quictun.Server{
-		DialTimeout:   dialTimeout * time.Second,
-		SequenceCache: lru.New(10),
+	cfg := parseFlags()
+	destACL, err := acl.New(cfg.ACL.Allow, cfg.ACL.Deny)
+	if err != nil {
+		fmt.Println("Invalid config: acl:", err)
+		os.Exit(2)
+	}
+	decoy, err := newDecoyHandler(cfg.Decoy.Dir, cfg.Decoy.Origin)
+	if err != nil {
+		fmt.Println("Invalid config: decoy:", err)
+		os.Exit(2)
+	}
+	if cfg.Log != "" {
+		if err = config.LogTo(cfg.Log); err != nil {
+			fmt.Println("Failed to open log file:", err)
+			os.Exit(1)
+		}
+	}
+	tlsConfig := &tls.Config{}
+	if len(cfg.ACME.Hosts) > 0 {
+		m, err := acmeManager(cfg)
+		if err != nil {
+			fmt.Println("Invalid config: acme:", err)
+			os.Exit(2)
+		}
+		tlsConfig.GetCertificate = m.GetCertificate
+		serveACME(m, cfg.ACME.HTTP, cfg.ACME.TLS, decoy)
+		obtainCertificates(m, cfg.ACME.Hosts)
+	} else {
+		certStore, err := certificateStore(cfg)
+		if err != nil {
+			fmt.Println("Failed to load certificates:", err)
+			os.Exit(1)
+		}
+		tlsConfig.GetCertificate = certStore.GetCertificate
+		go watchFiles("certificates", certStore, time.Duration(cfg.TLS.ReloadInterval))
 	}
 
-	// Register the upgrade handler for the quictun protocol
-	h2quic.RegisterUpgradeHandler("QTP/0.1", quictunServer.Upgrade)
+	users := make(map[string][]byte, len(cfg.Users))
+	for name, password := range cfg.Users {
+		users[name] = quictun.DeriveTokenKey(name, password)
+	}
+	tokenWindow := time.Duration(cfg.TokenWindow)
+	var inviteStore *invites.Store
+	if cfg.Invites != "" {
+		if inviteStore, err = invites.Open(cfg.Invites); err != nil {
+			fmt.Println("Invalid config: invites:", err)
+			os.Exit(2)
+		}
+		go watchFiles("revoked invites", inviteStore, time.Duration(cfg.TLS.ReloadInterval))
+	}
 
-	http.HandleFunc("/secret", func(w http.ResponseWriter, r *http.Request) {
-		// replay protection
-		if !quictunServer.CheckSequenceNumber(r.Header.Get("QTP")) {
-			w.Header().Set("Connection", "close")
-			w.WriteHeader(http.StatusBadRequest)
-			r.Close = true
-			return
+	quictunServer := newQuictunServer(cfg, users, inviteStore, destACL)
+	if cfg.ClientAuth.CA != "" {
+		auth, err := clientauth.New(cfg.ClientAuth.CA, cfg.ClientAuth.CRL, cfg.ClientAuth.Identities)
+		if err != nil {
+			fmt.Println("Invalid config: clientAuth:", err)
+			os.Exit(2)
 		}
+		quictunServer.ClientCAs = auth.Roots()
+		quictunServer.ClientIdentity = auth.Identity
+		go watchFiles("CRL", auth, time.Duration(cfg.TLS.ReloadInterval))
+	}
+	bearerTokens, policyACLs, err := newBearerValidator(cfg)
+	if err != nil {
+		fmt.Println("Invalid config: jwt:", err)
+		os.Exit(2)
+	}
+	if bearerTokens != nil {
+		go watchFiles("JWKS", bearerTokens.Keys, time.Duration(cfg.TLS.ReloadInterval))
+	}
+	switch {
+	case cfg.Cache.File != "":
+		cache, err := filecache.Open(cfg.Cache.File, sequenceCacheSize)
+		if err != nil {
+			fmt.Println("Failed to open cache file:", err)
+			os.Exit(1)
+		}
+		defer cache.Close()
+		quictunServer.SequenceCache = cache
+	case cfg.Cache.Redis != "":
+		cache := redis.New(cfg.Cache.Redis, "quictun:seq:", sequenceExpiry)
+		cache.Password = cfg.Cache.RedisPassword
+		defer cache.Close()
+		quictunServer.SequenceCache = cache
+		nonces := redis.New(cfg.Cache.Redis, "quictun:nonce:", 2*tokenWindow)
+		nonces.Password = cfg.Cache.RedisPassword
+		defer nonces.Close()
+		quictunServer.NonceCache = nonces
+	}
+
+	// Register the upgrade handlers for all versions of the quictun protocol
+	for _, version := range quictun.SupportedVersions {
+		h2quic.RegisterUpgradeHandler(version, quictunServer.UpgradeHandler(version))
+	}
 
-		// switch to quictun protocol (version 0.1)
-		w.Header().Set("Connection", "Upgrade")
-		w.Header().Set("Upgrade", "QTP/0.1")
-		w.WriteHeader(http.StatusSwitchingProtocols)
+	// Requests which are not tunnel requests are answered by the decoy, which
+	// hides the tunnel endpoint among the routes of an ordinary website.
+	http.Handle("/", decoy)
+	http.Handle(cfg.Path, &tunnelHandler{
+		server:         quictunServer,
+		decoy:          decoy,
+		probeResistant: cfg.Decoy.ProbeResistant,
+		minDelay:       time.Duration(cfg.Decoy.MinDelay),
+		tokens:         len(users) > 0 || inviteStore != nil,
+		invites:        inviteStore,
+		bearerTokens:   bearerTokens,
+		policyACLs:     policyACLs,
 	})
 
 	// HTTP server
 	// Implementations for production usage should be embedded in an existing web server instead.
 	server := h2quic.Server{
-		Server: &http.Server{Addr: listenAddr},
+		Server: &http.Server{
+			Addr:      cfg.Listen,
+			TLSConfig: tlsConfig,
+		},
 	}
-	certFile, keyFile := testdata.GetCertificatePaths()
-	fmt.Printf("Start listening on %s...\n", listenAddr)
-	err := server.ListenAndServeTLS(certFile, keyFile)
+	fmt.Printf("Start listening on %s...\n", cfg.Listen)
+	err = server.ListenAndServe()
 	if err != nil {
 		fmt.Println(err)
 	}
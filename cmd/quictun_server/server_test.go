@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/internal/invites"
+)
+
+// TestInviteRedemption redeems an invite with the server as configured by the
+// command.
+func TestInviteRedemption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key, err := invites.LoadKey(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := invites.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.Invites = dir
+	s := newQuictunServer(cfg, map[string][]byte{"bob": quictun.DeriveTokenKey("bob", "secret")}, store, nil)
+	if !s.RequireBinding {
+		t.Error("tokens of invited users are accepted without binding")
+	}
+
+	invite, err := (&quictun.Invite{ID: "1", Name: "alice", Expires: time.Now().Add(time.Hour), MaxUses: 1}).Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	password := "0123456789abcdefghij"
+	user, err := s.RedeemInvite(invite, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "alice" {
+		t.Fatalf("invite redeemed as %q, expected alice", user)
+	}
+	if !bytes.Equal(s.TokenKey(user), quictun.DeriveTokenKey(user, password)) {
+		t.Fatal("token key of the invited user is unknown")
+	}
+
+	// configured users are not created from invites, as their key would be
+	// used instead of the one of the invited user
+	invite, err = (&quictun.Invite{ID: "2", Name: "bob", Expires: time.Now().Add(time.Hour), MaxUses: 1}).Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.RedeemInvite(invite, password); err == nil {
+		t.Fatal("invite redeemed for a configured user")
+	}
+
+	// without invite store, invites are not redeemed
+	s = newQuictunServer(defaultConfig(), map[string][]byte{}, nil, nil)
+	if _, err = s.RedeemInvite(invite, password); err == nil {
+		t.Fatal("invite redeemed without invite store")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/internal/certs"
+	"github.com/julienschmidt/quictun/internal/testdata"
+)
+
+// validity of generated self-signed certificates
+const selfSignedValidity = 90 * 24 * time.Hour
+
+// certificateStore returns the store of the configured certificates: the
+// certificates loaded from files, a generated self-signed certificate or the
+// test certificate.
+func certificateStore(cfg *serverConfig) (*certs.Store, error) {
+	switch {
+	case len(cfg.TLS.SelfSigned) > 0:
+		cert, err := certs.SelfSigned(cfg.TLS.SelfSigned, selfSignedValidity)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Println("Generated self-signed certificate for", cfg.TLS.SelfSigned, "with SHA-256 fingerprint", certs.Fingerprint(&cert))
+		fmt.Println("Clients can pin it with -pin", quictun.SPKIPin(cert.Leaf))
+		return certs.New(cert)
+	case len(cfg.TLS.Certificates) > 0:
+		return certs.Load(cfg.TLS.Certificates)
+	default:
+		fmt.Println("Using the test certificate for quic.clemente.io, see -cert and -selfSigned")
+		return certs.New(testdata.GetCertificate())
+	}
+}
+
+// reloadable are files which can be reloaded, like certificates.
+type reloadable interface {
+	Reload() error
+	Watch(interval time.Duration, stop <-chan struct{}, errFn func(error))
+}
+
+// watchFiles reloads the files on SIGHUP and, if the interval is positive,
+// when they changed. For certificates, new sessions use the reloaded
+// certificates, while established sessions are not affected.
+func watchFiles(name string, files reloadable, interval time.Duration) {
+	if interval > 0 {
+		go files.Watch(interval, nil, func(err error) {
+			fmt.Println("Failed to reload", name+":", err)
+		})
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	for range hup {
+		if err := files.Reload(); err != nil {
+			fmt.Println("Failed to reload", name+":", err)
+			continue
+		}
+		fmt.Println("Reloaded", name)
+	}
+}
@@ -0,0 +1,161 @@
+package quictun
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"sync"
+	"time"
+)
+
+// DefaultCoverInterval is the default mean interval between two page loads of
+// the cover traffic.
+const DefaultCoverInterval = 30 * time.Second
+
+// coverFetchTimeout is the timeout for a single request of the cover traffic,
+// including reading the response body.
+const coverFetchTimeout = 30 * time.Second
+
+// CoverTraffic configures the cover traffic of the client: requests for pages
+// of the website of the server, which the client sends on its sessions before
+// the upgrade request and alongside the tunnel afterwards, like a browser which
+// keeps loading pages of the website.
+type CoverTraffic struct {
+	// Pages are the pages of the website. Every page is a list of paths, the
+	// first one of the document and the others of its resources, e.g. style
+	// sheets, scripts and images, which are requested in parallel once the
+	// document was loaded.
+	Pages [][]string
+
+	// Interval is the mean interval between two page loads. The actual
+	// intervals are random. Defaults to DefaultCoverInterval.
+	Interval time.Duration
+}
+
+var (
+	coverRandLock sync.Mutex
+	coverRand     = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// nextInterval returns the random interval until the next page load.
+func (ct *CoverTraffic) nextInterval() time.Duration {
+	interval := ct.Interval
+	if interval <= 0 {
+		interval = DefaultCoverInterval
+	}
+	coverRandLock.Lock()
+	defer coverRandLock.Unlock()
+	return time.Duration(coverRand.ExpFloat64() * float64(interval))
+}
+
+// randomPage returns a random page.
+func (ct *CoverTraffic) randomPage() []string {
+	coverRandLock.Lock()
+	defer coverRandLock.Unlock()
+	return ct.Pages[coverRand.Intn(len(ct.Pages))]
+}
+
+// coverTraffic loads random pages on the session until it is closed.
+func (c *Client) coverTraffic(cs *clientSession, site *url.URL) {
+	done := cs.session.Context().Done()
+	for {
+		timer := time.NewTimer(c.Cover.nextInterval())
+		select {
+		case <-done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		if err := c.loadPage(cs, site); err != nil {
+			fmt.Println("cover traffic:", err)
+		}
+	}
+}
+
+// loadPage loads a random page of the website at the given URL on the session,
+// i.e. the document and afterwards all its resources.
+func (c *Client) loadPage(cs *clientSession, site *url.URL) error {
+	page := c.Cover.randomPage()
+	if len(page) == 0 {
+		return nil
+	}
+	document, err := site.Parse(page[0])
+	if err != nil {
+		return err
+	}
+	if err = c.fetch(cs, document, nil); err != nil {
+		return err
+	}
+
+	errs := make(chan error, len(page)-1)
+	for _, ref := range page[1:] {
+		go func(ref string) {
+			resource, err := site.Parse(ref)
+			if err == nil {
+				err = c.fetch(cs, resource, document)
+			}
+			errs <- err
+		}(ref)
+	}
+	for range page[1:] {
+		if rerr := <-errs; rerr != nil && err == nil {
+			err = rerr
+		}
+	}
+	return err
+}
+
+// fetch requests the given URL and reads the response body. Resources of a
+// document are requested with the header fields Chrome sends for them.
+func (c *Client) fetch(cs *clientSession, u *url.URL, document *url.URL) error {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), coverFetchTimeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+	if c.UserAgent != "" {
+		req.Header.Set("User-Agent", c.UserAgent)
+	}
+	if document != nil {
+		r := chromeResource(u.Path)
+		req.Header.Set("Accept", r.accept)
+		req.Header.Set("Sec-Fetch-Site", "same-origin")
+		req.Header.Set("Sec-Fetch-Mode", "no-cors")
+		req.Header.Set("Sec-Fetch-Dest", r.dest)
+		req.Header.Set("Referer", document.String())
+		req.Header.Set("Priority", r.priority)
+		// only sent for navigation requests
+		req = withoutHeaders(req, "Upgrade-Insecure-Requests", "Sec-Fetch-User")
+	}
+
+	_, body, err := cs.roundTrip(req)
+	if err != nil {
+		return err
+	}
+	return discardBody(body)
+}
+
+// resource are the header field values Chrome sends for a resource.
+type resource struct {
+	accept   string
+	dest     string
+	priority string
+}
+
+// chromeResource returns the header field values Chrome sends for a resource
+// with the given path.
+func chromeResource(p string) resource {
+	switch path.Ext(p) {
+	case ".css":
+		return resource{"text/css,*/*;q=0.1", "style", "u=0"}
+	case ".png", ".jpg", ".jpeg", ".gif", ".webp", ".avif", ".svg", ".ico":
+		return resource{"image/avif,image/webp,image/apng,image/svg+xml,image/*,*/*;q=0.8", "image", "u=2, i"}
+	default:
+		return resource{"*/*", "script", "u=1"}
+	}
+}
@@ -23,6 +23,8 @@ type responseWriter struct {
 	header        http.Header
 	status        int // status code passed to WriteHeader
 	headerWritten bool
+
+	session *mixedSession // switched to mixed mode by the upgrade response, if set
 }
 
 func newResponseWriter(headerStream quic.Stream, headerStreamMutex *sync.Mutex, dataStream quic.Stream, dataStreamID quic.StreamID) *responseWriter {
@@ -46,6 +48,13 @@ func (w *responseWriter) WriteHeader(status int) {
 	w.headerWritten = true
 	w.status = status
 
+	// The session must be in mixed mode before the client can announce
+	// streams, i.e. before it receives the upgrade response.
+	if status == http.StatusSwitchingProtocols && w.session != nil &&
+		w.header.Get(MixedModeHeader) == "1" && upgradeHandler(w.header["Upgrade"]) != nil {
+		w.session.setMixed()
+	}
+
 	var headers bytes.Buffer
 	enc := hpack.NewEncoder(&headers)
 	enc.WriteField(hpack.HeaderField{Name: ":status", Value: strconv.Itoa(status)})
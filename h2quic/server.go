@@ -1,6 +1,7 @@
 package h2quic
 
 import (
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -27,6 +28,19 @@ type remoteCloser interface {
 	CloseRemote(uint64)
 }
 
+// contextKey is a value for use with context.WithValue. It's used as
+// a pointer so it fits in an interface{} without allocation.
+type contextKey struct {
+	name string
+}
+
+func (k *contextKey) String() string { return "h2quic context value " + k.name }
+
+// SessionContextKey is a context key. It can be used in HTTP handlers with
+// context.WithValue to access the QUIC session on which a request arrived.
+// The associated value will be of type quic.Session.
+var SessionContextKey = &contextKey{"quic-session"}
+
 // allows mocking of quic.Listen and quic.ListenAddr
 var (
 	quicListen     = quic.Listen
@@ -124,6 +138,9 @@ func (s *Server) handleHeaderStream(session streamCreator) {
 	hpackDecoder := hpack.NewDecoder(4096, nil)
 	h2framer := http2.NewFramer(nil, stream)
 
+	// all requests of the session see the same wrapped session
+	session = newMixedSession(session)
+
 	var headerStreamMutex sync.Mutex // Protects concurrent calls to Write()
 	for {
 		if err := s.handleRequest(session, stream, &headerStreamMutex, hpackDecoder, h2framer); err != nil {
@@ -144,6 +161,16 @@ func (s *Server) handleRequest(session streamCreator, headerStream quic.Stream,
 	if err != nil {
 		return qerr.Error(qerr.HeadersStreamDataDecompressFailure, "cannot read frame")
 	}
+	if f, ok := h2frame.(*http2.UnknownFrame); ok && f.Type == StreamFrameType {
+		// Streams are only announced on sessions upgraded in mixed mode,
+		// otherwise the frame is unexpected like any other one. The session
+		// is switched to mixed mode before the upgrade response is sent, as
+		// the client may announce streams right after receiving it, possibly
+		// before the upgrade handler was called.
+		if ms, ok := session.(*mixedSession); ok && ms.isMixed() {
+			return ms.announce(quic.StreamID(f.StreamID))
+		}
+	}
 	h2headersFrame, ok := h2frame.(*http2.HeadersFrame)
 	if !ok {
 		return qerr.Error(qerr.InvalidHeadersStreamData, "expected a header frame")
@@ -184,13 +211,15 @@ func (s *Server) handleRequest(session streamCreator, headerStream quic.Stream,
 			_, _ = dataStream.Read([]byte{0}) // read the eof
 		}
 
-		req = req.WithContext(dataStream.Context())
+		ctx := context.WithValue(dataStream.Context(), SessionContextKey, quic.Session(session))
+		req = req.WithContext(ctx)
 		reqBody := newRequestBody(dataStream)
 		req.Body = reqBody
 
 		req.RemoteAddr = session.RemoteAddr().String()
 
 		responseWriter := newResponseWriter(headerStream, headerStreamMutex, dataStream, quic.StreamID(h2headersFrame.StreamID))
+		responseWriter.session, _ = session.(*mixedSession)
 
 		handler := s.Handler
 		if handler == nil {
@@ -218,12 +247,9 @@ func (s *Server) handleRequest(session streamCreator, headerStream quic.Stream,
 			case http.StatusSwitchingProtocols:
 				if protocols, ok := responseWriter.Header()["Upgrade"]; ok {
 					fmt.Println("Upgrade to:", protocols)
-					for _, protocol := range protocols {
-						fmt.Println(protocol)
-						if handler, ok := upgradeHandlers[protocol]; ok {
-							handler(session)
-							break
-						}
+					// the first registered protocol in order of preference
+					if handler := upgradeHandler(protocols); handler != nil {
+						handler(session)
 					}
 				}
 			case 0:
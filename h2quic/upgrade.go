@@ -2,8 +2,11 @@ package h2quic
 
 import (
 	"errors"
+	"strings"
+	"sync/atomic"
 
 	quic "github.com/lucas-clemente/quic-go"
+	"golang.org/x/net/http2"
 )
 
 var noKnownUpgradeProtocol = errors.New("no known upgrade protocol")
@@ -20,8 +23,97 @@ func (c *connectionUpgrade) Error() string {
 
 // UpgradeHandler is a function which can perform an upgrade to another protocol
 // by modifying a given QUIC session.
+//
+// By default, the handler takes over all streams opened by the client
+// afterwards. If the upgrade response sets the MixedModeHeader, the session is
+// upgraded in mixed mode instead: The server keeps handling HTTP requests,
+// i.e. streams announced by HEADERS frames on the header stream, and
+// AcceptStream of the session passed to the handler only returns the streams
+// announced by StreamFrameType frames.
 type UpgradeHandler func(quic.Session)
 
+const (
+	// MixedModeHeader is the header field with which clients offer and servers
+	// select the mixed mode for an upgrade, see UpgradeHandler. Its value is
+	// "1".
+	MixedModeHeader = "Mixed-Mode"
+
+	// StreamFrameType is the type of the frames with which a client announces
+	// streams for the upgrade handler on the header stream in mixed mode.
+	// The frames carry the ID of the announced stream and no payload. A stream
+	// must be announced before any data is sent on it.
+	StreamFrameType http2.FrameType = 0xb0
+)
+
+// errTooManyAnnouncedStreams resets announced streams while the upgrade
+// handler does not keep up with accepting them.
+var errTooManyAnnouncedStreams = errors.New("too many announced streams")
+
+// maxAnnouncedStreams is the max number of announced streams which were not
+// yet accepted by the upgrade handler.
+const maxAnnouncedStreams = 100
+
+// mixedSession wraps the sessions of the server, so that AcceptStream returns
+// the announced streams once the session was upgraded in mixed mode.
+type mixedSession struct {
+	streamCreator
+	mixed     int32 // whether the session was upgraded in mixed mode, accessed atomically
+	announced chan quic.Stream
+}
+
+func newMixedSession(session streamCreator) *mixedSession {
+	return &mixedSession{
+		streamCreator: session,
+		announced:     make(chan quic.Stream, maxAnnouncedStreams),
+	}
+}
+
+// setMixed switches the session to mixed mode.
+func (s *mixedSession) setMixed() {
+	atomic.StoreInt32(&s.mixed, 1)
+}
+
+// isMixed returns whether the session was upgraded in mixed mode.
+func (s *mixedSession) isMixed() bool {
+	return atomic.LoadInt32(&s.mixed) == 1
+}
+
+// IsMixedMode returns whether the session passed to an UpgradeHandler was
+// upgraded in mixed mode, i.e. AcceptStream only returns announced streams.
+func IsMixedMode(session quic.Session) bool {
+	ms, ok := session.(*mixedSession)
+	return ok && ms.isMixed()
+}
+
+func (s *mixedSession) AcceptStream() (quic.Stream, error) {
+	if !s.isMixed() {
+		return s.streamCreator.AcceptStream()
+	}
+	select {
+	case stream := <-s.announced:
+		return stream, nil
+	case <-s.Context().Done():
+		return nil, s.Context().Err()
+	}
+}
+
+// announce passes an announced stream to the upgrade handler. While too many
+// announced streams are pending, further streams are reset instead, so that
+// the header stream is not blocked.
+func (s *mixedSession) announce(id quic.StreamID) error {
+	stream, err := s.GetOrOpenStream(id)
+	if err != nil || stream == nil {
+		// the stream was already closed
+		return err
+	}
+	select {
+	case s.announced <- stream:
+	default:
+		stream.Reset(errTooManyAnnouncedStreams)
+	}
+	return nil
+}
+
 // map of registered UpgradeHandlers
 var upgradeHandlers = map[string]UpgradeHandler{}
 
@@ -30,3 +122,17 @@ var upgradeHandlers = map[string]UpgradeHandler{}
 func RegisterUpgradeHandler(protocol string, handler UpgradeHandler) {
 	upgradeHandlers[protocol] = handler
 }
+
+// upgradeHandler returns the handler of the first registered protocol in the
+// given Upgrade header values, which may each contain a comma-separated list of
+// protocols in order of preference.
+func upgradeHandler(values []string) UpgradeHandler {
+	for _, value := range values {
+		for _, protocol := range strings.Split(value, ",") {
+			if handler, ok := upgradeHandlers[strings.TrimSpace(protocol)]; ok {
+				return handler
+			}
+		}
+	}
+	return nil
+}
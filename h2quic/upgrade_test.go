@@ -0,0 +1,159 @@
+package h2quic
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	quic "github.com/lucas-clemente/quic-go"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Upgrade handlers", func() {
+	var called string
+
+	BeforeEach(func() {
+		called = ""
+		RegisterUpgradeHandler("TEST/1", func(quic.Session) { called = "TEST/1" })
+		RegisterUpgradeHandler("TEST/2", func(quic.Session) { called = "TEST/2" })
+	})
+
+	AfterEach(func() {
+		delete(upgradeHandlers, "TEST/1")
+		delete(upgradeHandlers, "TEST/2")
+	})
+
+	It("selects the first registered protocol", func() {
+		upgradeHandler([]string{"TEST/3, TEST/2", "TEST/1"})(nil)
+		Expect(called).To(Equal("TEST/2"))
+	})
+
+	It("returns nil for unknown protocols", func() {
+		Expect(upgradeHandler([]string{"TEST/3"})).To(BeNil())
+		Expect(upgradeHandler(nil)).To(BeNil())
+	})
+})
+
+var _ = Describe("Mixed mode", func() {
+	var (
+		s            *Server
+		session      *mockSession
+		ms           *mixedSession
+		dataStream   *mockStream
+		headerStream *mockStream
+		h2framer     *http2.Framer
+	)
+
+	// announcement of stream 7
+	streamFrame := []byte{0x0, 0x0, 0x0, byte(StreamFrameType), 0x0, 0x0, 0x0, 0x0, 0x7}
+
+	BeforeEach(func() {
+		s = &Server{Server: &http.Server{}}
+		dataStream = newMockStream(7)
+		close(dataStream.unblockRead)
+		session = &mockSession{dataStream: dataStream, streamToAccept: newMockStream(9)}
+		session.ctx, session.ctxCancel = context.WithCancel(context.Background())
+		ms = newMixedSession(session)
+		headerStream = &mockStream{}
+		h2framer = http2.NewFramer(nil, headerStream)
+	})
+
+	AfterEach(func() {
+		delete(upgradeHandlers, "TEST/1")
+	})
+
+	handleRequest := func(session streamCreator) error {
+		return s.handleRequest(session, headerStream, &sync.Mutex{}, hpack.NewDecoder(4096, nil), h2framer)
+	}
+
+	It("accepts all streams without mixed mode", func() {
+		str, err := ms.AcceptStream()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(str).To(Equal(session.streamToAccept))
+	})
+
+	It("accepts only announced streams in mixed mode", func() {
+		ms.setMixed()
+		headerStream.dataToRead.Write(streamFrame)
+		Expect(handleRequest(ms)).To(Succeed())
+		str, err := ms.AcceptStream()
+		Expect(err).NotTo(HaveOccurred())
+		Expect(str).To(Equal(dataStream))
+
+		// no further streams were announced
+		done := make(chan struct{})
+		go func() {
+			defer GinkgoRecover()
+			_, err := ms.AcceptStream()
+			Expect(err).To(HaveOccurred())
+			close(done)
+		}()
+		Consistently(done).ShouldNot(BeClosed())
+		session.Close(nil)
+		Eventually(done).Should(BeClosed())
+	})
+
+	It("rejects announcements on sessions without mixed mode support", func() {
+		headerStream.dataToRead.Write(streamFrame)
+		Expect(handleRequest(session)).To(MatchError("InvalidHeadersStreamData: expected a header frame"))
+	})
+
+	It("rejects announcements before the upgrade in mixed mode", func() {
+		headerStream.dataToRead.Write(streamFrame)
+		Expect(handleRequest(ms)).To(MatchError("InvalidHeadersStreamData: expected a header frame"))
+		Expect(ms.announced).To(BeEmpty())
+	})
+
+	It("resets announced streams while too many are pending", func() {
+		ms.setMixed()
+		for i := 0; i < maxAnnouncedStreams; i++ {
+			Expect(ms.announce(7)).To(Succeed())
+		}
+		Expect(dataStream.reset).To(BeFalse())
+		// does not block
+		Expect(ms.announce(7)).To(Succeed())
+		Expect(dataStream.reset).To(BeTrue())
+		Expect(ms.announced).To(HaveLen(maxAnnouncedStreams))
+	})
+
+	It("upgrades in mixed mode if the response selects it", func() {
+		var mixed int32 = -1
+		RegisterUpgradeHandler("TEST/1", func(session quic.Session) {
+			atomic.StoreInt32(&mixed, atomic.LoadInt32(&session.(*mixedSession).mixed))
+		})
+		s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Upgrade", "TEST/1")
+			w.Header().Set(MixedModeHeader, "1")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+		})
+		headerStream.dataToRead.Write([]byte{
+			0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+			// Taken from https://http2.github.io/http2-spec/compression.html#request.examples.with.huffman.coding
+			0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+		})
+		Expect(handleRequest(ms)).To(Succeed())
+		Eventually(func() int32 { return atomic.LoadInt32(&mixed) }).Should(Equal(int32(1)))
+		Expect(IsMixedMode(ms)).To(BeTrue())
+	})
+
+	It("does not upgrade in mixed mode unless the response selects it", func() {
+		called := make(chan struct{})
+		RegisterUpgradeHandler("TEST/1", func(quic.Session) { close(called) })
+		s.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Upgrade", "TEST/1")
+			w.WriteHeader(http.StatusSwitchingProtocols)
+		})
+		headerStream.dataToRead.Write([]byte{
+			0x0, 0x0, 0x11, 0x1, 0x5, 0x0, 0x0, 0x0, 0x5,
+			0x82, 0x86, 0x84, 0x41, 0x8c, 0xf1, 0xe3, 0xc2, 0xe5, 0xf2, 0x3a, 0x6b, 0xa0, 0xab, 0x90, 0xf4, 0xff,
+		})
+		Expect(handleRequest(ms)).To(Succeed())
+		Eventually(called).Should(BeClosed())
+		Expect(IsMixedMode(ms)).To(BeFalse())
+	})
+})
@@ -0,0 +1,190 @@
+// Package acl implements access control lists for the destinations of
+// tunneled connections.
+package acl
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// A rule matches destinations by host and port.
+type rule struct {
+	host string     // exact host name, "*.suffix" or "*"; empty for nets
+	net  *net.IPNet // IP address or network
+	port int        // 0 matches all ports
+}
+
+// parseRule parses a rule in the form HOST or HOST:PORT, where HOST is a host
+// name, a wildcard name like *.example.com, an IP address, a CIDR network or *,
+// and PORT is a port number or *. IPv6 addresses and networks must be enclosed
+// in square brackets if a port is given.
+func parseRule(s string) (*rule, error) {
+	r := &rule{}
+	host, port := s, ""
+	if strings.HasPrefix(s, "[") || strings.Count(s, ":") == 1 {
+		var err error
+		if host, port, err = net.SplitHostPort(s); err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", s, err)
+		}
+	}
+	if host == "" {
+		return nil, fmt.Errorf("invalid rule %q: missing host", s)
+	}
+
+	if port != "" && port != "*" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("invalid rule %q: invalid port %q", s, port)
+		}
+		r.port = p
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, 8*net.IPv4len
+		}
+		r.net = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return r, nil
+	}
+	if strings.Contains(host, "/") {
+		_, ipNet, err := net.ParseCIDR(host)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %s", s, err)
+		}
+		r.net = ipNet
+		return r, nil
+	}
+	if host != "*" && strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return nil, fmt.Errorf("invalid rule %q: wildcards are only allowed as *.domain", s)
+	}
+	r.host = strings.ToLower(strings.TrimSuffix(host, "."))
+	return r, nil
+}
+
+// matchHost reports whether the rule matches the given host name by name. IP
+// addresses are passed as an empty host name and only match *.
+func (r *rule) matchHost(host string) bool {
+	switch {
+	case r.host == "":
+		return false
+	case r.host == "*":
+		return true
+	case strings.HasPrefix(r.host, "*."):
+		return strings.HasSuffix(host, r.host[1:])
+	default:
+		return host == r.host
+	}
+}
+
+// List is an access control list with allow and deny rules.
+//
+// A destination is denied if it matches any deny rule, either by its host
+// name or by any of its IP addresses. Otherwise it is allowed if there are no
+// allow rules or it matches an allow rule, either by its host name or by all
+// of its IP addresses.
+//
+// Host names are only resolved if the list has IP rules. Host names which can
+// not be resolved are denied then. As the destination is resolved again when
+// connecting, IP rules do not reliably restrict host names whose DNS records
+// change in the meantime.
+type List struct {
+	allow []*rule
+	deny  []*rule
+
+	hasNets bool
+
+	// lookup resolves host names, defaults to net.LookupIP
+	lookup func(host string) ([]net.IP, error)
+}
+
+// New returns a List with the given allow and deny rules.
+func New(allow, deny []string) (*List, error) {
+	l := &List{lookup: net.LookupIP}
+	var err error
+	if l.allow, err = l.parseRules(allow); err != nil {
+		return nil, err
+	}
+	if l.deny, err = l.parseRules(deny); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *List) parseRules(rules []string) ([]*rule, error) {
+	parsed := make([]*rule, 0, len(rules))
+	for _, s := range rules {
+		r, err := parseRule(s)
+		if err != nil {
+			return nil, err
+		}
+		if r.net != nil {
+			l.hasNets = true
+		}
+		parsed = append(parsed, r)
+	}
+	return parsed, nil
+}
+
+// Allow reports whether connections to the given address in the form host:port
+// are allowed.
+func (l *List) Allow(addr string) bool {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+		host = ""
+	} else if l.hasNets {
+		if ips, err = l.lookup(host); err != nil || len(ips) == 0 {
+			// fail closed, the address can not be checked against IP rules
+			return false
+		}
+	}
+
+	for _, r := range l.deny {
+		if r.match(host, port, ips, false) {
+			return false
+		}
+	}
+	if len(l.allow) == 0 {
+		return true
+	}
+	for _, r := range l.allow {
+		if r.match(host, port, ips, true) {
+			return true
+		}
+	}
+	return false
+}
+
+// match reports whether the rule matches the destination with the given host
+// name, port and IP addresses. IP rules match if they contain all or any of the
+// addresses.
+func (r *rule) match(host string, port int, ips []net.IP, all bool) bool {
+	if r.port != 0 && r.port != port {
+		return false
+	}
+	if r.net == nil {
+		return r.matchHost(host)
+	}
+	if len(ips) == 0 {
+		return false
+	}
+	for _, ip := range ips {
+		if r.net.Contains(ip) != all {
+			return !all
+		}
+	}
+	return all
+}
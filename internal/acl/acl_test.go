@@ -0,0 +1,121 @@
+package acl
+
+import (
+	"errors"
+	"net"
+	"testing"
+)
+
+func TestParseRule(t *testing.T) {
+	valid := []string{
+		"example.com",
+		"example.com:443",
+		"*.example.com:*",
+		"*",
+		"*:25",
+		"10.0.0.1",
+		"10.0.0.0/8:22",
+		"2001:db8::1",
+		"2001:db8::/32",
+		"[2001:db8::/32]:443",
+	}
+	for _, s := range valid {
+		if _, err := parseRule(s); err != nil {
+			t.Errorf("rule %q is valid, got error: %s", s, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		":443",
+		"example.com:0",
+		"example.com:http",
+		"example.*",
+		"10.0.0.0/33",
+		"[2001:db8::1]",
+	}
+	for _, s := range invalid {
+		if _, err := parseRule(s); err == nil {
+			t.Errorf("rule %q is invalid, but got no error", s)
+		}
+	}
+}
+
+func TestList(t *testing.T) {
+	l, err := New(
+		[]string{"*.example.com:443", "example.org", "192.0.2.0/24"},
+		[]string{"private.example.com", "192.0.2.1", "*:25"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.lookup = func(host string) ([]net.IP, error) {
+		switch host {
+		case "inside.test":
+			return []net.IP{net.ParseIP("192.0.2.10")}, nil
+		case "partly.test":
+			return []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("198.51.100.1")}, nil
+		case "denied.test":
+			return []net.IP{net.ParseIP("198.51.100.1"), net.ParseIP("192.0.2.1")}, nil
+		case "unknown.test":
+			return nil, errors.New("no such host")
+		default:
+			return []net.IP{net.ParseIP("203.0.113.1")}, nil
+		}
+	}
+
+	tests := []struct {
+		addr  string
+		allow bool
+	}{
+		{"www.example.com:443", true},
+		{"WWW.Example.COM.:443", true},
+		{"www.example.com:80", false},
+		{"example.com:443", false},
+		{"private.example.com:443", false},
+		{"example.org:80", true},
+		{"example.org:25", false},
+		{"192.0.2.10:80", true},
+		{"192.0.2.1:80", false},
+		{"198.51.100.1:80", false},
+		{"inside.test:80", true},
+		{"partly.test:80", false},
+		{"denied.test:80", false},
+		{"unknown.test:80", false},
+		{"invalid", false},
+	}
+	for _, test := range tests {
+		if allow := l.Allow(test.addr); allow != test.allow {
+			t.Errorf("Allow(%q) = %t, expected %t", test.addr, allow, test.allow)
+		}
+	}
+}
+
+func TestListDenyOnly(t *testing.T) {
+	l, err := New(nil, []string{"localhost", "127.0.0.0/8", "[::1]:*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.lookup = func(host string) ([]net.IP, error) {
+		if host == "localhost" {
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+		return []net.IP{net.ParseIP("203.0.113.1")}, nil
+	}
+
+	tests := []struct {
+		addr  string
+		allow bool
+	}{
+		{"localhost:22", false},
+		{"127.0.0.2:22", false},
+		{"[::1]:22", false},
+		{"example.com:22", true},
+		{"203.0.113.5:22", true},
+	}
+	for _, test := range tests {
+		if allow := l.Allow(test.addr); allow != test.allow {
+			t.Errorf("Allow(%q) = %t, expected %t", test.addr, allow, test.allow)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+// Package atomicfile replaces files atomically, so that readers and restarts
+// after a crash see either the old or the new content, but never a partially
+// written file.
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// File is a temporary file, which replaces the file at its path once it is
+// committed.
+type File struct {
+	*os.File
+	path string
+}
+
+// Create creates the temporary file for replacing the file at the given path,
+// next to it, so that it can be renamed within the same file system.
+func Create(path string) (*File, error) {
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &File{File: tmp, path: path}, nil
+}
+
+// Commit syncs the temporary file to disk and renames it to the path of the
+// replaced file. The file stays open, so that further writes are appended to
+// the new file. If Commit fails, the file must be discarded with Abort.
+func (f *File) Commit() error {
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := os.Rename(f.Name(), f.path); err != nil {
+		return err
+	}
+	syncDir(filepath.Dir(f.path))
+	return nil
+}
+
+// Abort closes and removes the temporary file, leaving the file at the path
+// unchanged.
+func (f *File) Abort() {
+	f.Close()
+	os.Remove(f.Name())
+}
+
+// WriteFile atomically replaces the file at the given path with the data.
+func WriteFile(path string, data []byte) error {
+	f, err := Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err == nil {
+		err = f.Commit()
+	}
+	if err != nil {
+		f.Abort()
+		return err
+	}
+	return f.Close()
+}
+
+// syncDir makes a rename within the given directory durable.
+// Errors are ignored, as not all platforms support syncing directories.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,89 @@
+package atomicfile
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	for _, content := range []string{"old", "new"} {
+		if err = WriteFile(path, []byte(content)); err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != content {
+			t.Fatalf("file contains %q, should contain %q", data, content)
+		}
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file exists: %v", err)
+	}
+}
+
+func TestAbort(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+	if err = WriteFile(path, []byte("old")); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write([]byte("new")); err != nil {
+		t.Fatal(err)
+	}
+	f.Abort()
+
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "old" {
+		t.Fatalf("aborted replacement changed the file to %q (%v)", data, err)
+	}
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file exists: %v", err)
+	}
+}
+
+func TestCommitKeepsFileOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "atomicfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file")
+
+	f, err := Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err = f.Write([]byte("snapshot")); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	// writes after the commit are appended to the new file
+	if _, err = f.Write([]byte("+record")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := ioutil.ReadFile(path); err != nil || string(data) != "snapshot+record" {
+		t.Fatalf("file contains %q (%v)", data, err)
+	}
+}
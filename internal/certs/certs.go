@@ -0,0 +1,200 @@
+// Package certs manages the TLS certificates of a server. Certificates are
+// selected by the server name indicated by the client (SNI) and can be
+// reloaded without a restart.
+package certs
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyPair are the paths of a PEM encoded certificate chain and its key.
+type KeyPair struct {
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// Store holds the certificates of a server. Its GetCertificate method can be
+// used in a tls.Config.
+type Store struct {
+	pairs []KeyPair
+
+	lock     sync.RWMutex // guards the fields below
+	certs    []*tls.Certificate
+	byName   map[string]*tls.Certificate
+	modTimes []time.Time
+}
+
+// Load returns a Store holding the certificates of the given key pairs.
+// The first certificate is the default for clients which indicate no server
+// name or a name none of the certificates is valid for.
+func Load(pairs []KeyPair) (*Store, error) {
+	if len(pairs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	s := &Store{pairs: pairs}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// New returns a Store holding the given certificates, which can not be
+// reloaded.
+func New(certs ...tls.Certificate) (*Store, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	s := &Store{}
+	loaded := make([]*tls.Certificate, len(certs))
+	for i := range certs {
+		cert := certs[i]
+		if err := parseLeaf(&cert); err != nil {
+			return nil, err
+		}
+		loaded[i] = &cert
+	}
+	s.set(loaded, nil)
+	return s, nil
+}
+
+// Reload loads all certificates from their files again. If any of them fails
+// to load, the previous certificates are kept and an error is returned.
+// Sessions established with the previous certificates are not affected.
+// Stores created by New are left unchanged.
+func (s *Store) Reload() error {
+	if len(s.pairs) == 0 {
+		return nil
+	}
+	certs := make([]*tls.Certificate, len(s.pairs))
+	modTimes := make([]time.Time, len(s.pairs))
+	for i, pair := range s.pairs {
+		modTimes[i] = s.modTime(pair)
+		cert, err := tls.LoadX509KeyPair(pair.Cert, pair.Key)
+		if err != nil {
+			return fmt.Errorf("loading %s: %s", pair.Cert, err)
+		}
+		if err = parseLeaf(&cert); err != nil {
+			return fmt.Errorf("loading %s: %s", pair.Cert, err)
+		}
+		certs[i] = &cert
+	}
+	s.set(certs, modTimes)
+	return nil
+}
+
+func (s *Store) set(certs []*tls.Certificate, modTimes []time.Time) {
+	byName := make(map[string]*tls.Certificate)
+	// earlier certificates take precedence for names of several certificates
+	for i := len(certs) - 1; i >= 0; i-- {
+		for _, name := range names(certs[i].Leaf) {
+			byName[name] = certs[i]
+		}
+	}
+
+	s.lock.Lock()
+	s.certs = certs
+	s.byName = byName
+	s.modTimes = modTimes
+	s.lock.Unlock()
+}
+
+// modTime returns the latest modification time of the files of the key pair.
+func (s *Store) modTime(pair KeyPair) time.Time {
+	var t time.Time
+	for _, path := range []string{pair.Cert, pair.Key} {
+		if fi, err := os.Stat(path); err == nil && fi.ModTime().After(t) {
+			t = fi.ModTime()
+		}
+	}
+	return t
+}
+
+// Changed reports whether any of the certificate files changed since they
+// were loaded.
+func (s *Store) Changed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	for i, pair := range s.pairs {
+		if !s.modTime(pair).Equal(s.modTimes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Watch checks the certificate files for changes in the given interval and
+// reloads them if they changed, until stop is closed. Reload errors are passed
+// to the given function.
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}, errFn func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !s.Changed() {
+			continue
+		}
+		if err := s.Reload(); err != nil && errFn != nil {
+			errFn(err)
+		}
+	}
+}
+
+// GetCertificate returns the certificate for the server name indicated by the
+// client. Wildcard certificates match names with one additional label.
+func (s *Store) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	if cert, ok := s.byName[name]; ok {
+		return cert, nil
+	}
+	if i := strings.IndexByte(name, '.'); i > 0 {
+		if cert, ok := s.byName["*"+name[i:]]; ok {
+			return cert, nil
+		}
+	}
+	return s.certs[0], nil
+}
+
+// parseLeaf parses the leaf certificate of the chain.
+func parseLeaf(cert *tls.Certificate) error {
+	if cert.Leaf != nil {
+		return nil
+	}
+	if len(cert.Certificate) == 0 {
+		return errors.New("empty certificate chain")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+	return nil
+}
+
+// names returns the names a certificate is valid for.
+func names(leaf *x509.Certificate) []string {
+	names := make([]string, 0, len(leaf.DNSNames)+len(leaf.IPAddresses)+1)
+	for _, name := range leaf.DNSNames {
+		names = append(names, strings.ToLower(name))
+	}
+	for _, ip := range leaf.IPAddresses {
+		names = append(names, ip.String())
+	}
+	if len(names) == 0 && leaf.Subject.CommonName != "" {
+		names = append(names, strings.ToLower(leaf.Subject.CommonName))
+	}
+	return names
+}
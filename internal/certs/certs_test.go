@@ -0,0 +1,205 @@
+package certs
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writePair generates a self-signed certificate for the given hosts and writes
+// it and its key to PEM files in dir.
+func writePair(t *testing.T, dir, name string, hosts ...string) (KeyPair, tls.Certificate) {
+	cert, err := SelfSigned(hosts, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pair := KeyPair{
+		Cert: filepath.Join(dir, name+".crt"),
+		Key:  filepath.Join(dir, name+".key"),
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err = ioutil.WriteFile(pair.Cert, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(pair.Key, keyPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return pair, cert
+}
+
+func getCert(t *testing.T, s *Store, serverName string) *tls.Certificate {
+	cert, err := s.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+func TestSelfSigned(t *testing.T) {
+	cert, err := SelfSigned([]string{"lab.example", "192.0.2.1"}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cert.Leaf.VerifyHostname("lab.example"); err != nil {
+		t.Error(err)
+	}
+	if err = cert.Leaf.VerifyHostname("192.0.2.1"); err != nil {
+		t.Error(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	if _, err = cert.Leaf.Verify(x509.VerifyOptions{DNSName: "lab.example", Roots: pool}); err != nil {
+		t.Errorf("certificate does not verify against itself: %s", err)
+	}
+	if len(Fingerprint(&cert)) != 64 {
+		t.Errorf("invalid fingerprint %q", Fingerprint(&cert))
+	}
+
+	if _, err = SelfSigned(nil, time.Hour); err == nil {
+		t.Error("no error without hosts")
+	}
+}
+
+func TestSNI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pairA, certA := writePair(t, dir, "a", "a.example", "shared.example")
+	pairB, certB := writePair(t, dir, "b", "*.b.example", "shared.example")
+	s, err := Load([]KeyPair{pairA, pairB})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		cert       tls.Certificate
+	}{
+		{"a.example", certA},
+		{"A.Example.", certA},
+		{"www.b.example", certB},
+		{"b.example", certA},       // wildcard does not match the parent
+		{"x.www.b.example", certA}, // nor more than one label
+		{"shared.example", certA},  // first certificate wins
+		{"", certA},                // default
+		{"unknown.example", certA}, // default
+	}
+	for _, test := range tests {
+		cert := getCert(t, s, test.serverName)
+		if Fingerprint(cert) != Fingerprint(&test.cert) {
+			t.Errorf("wrong certificate for %q: %v", test.serverName, cert.Leaf.DNSNames)
+		}
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pair, oldCert := writePair(t, dir, "a", "a.example")
+	s, err := Load([]KeyPair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Changed() {
+		t.Fatal("unchanged files reported as changed")
+	}
+
+	// replace the certificate, with a modification time the file system can
+	// tell apart from the previous one
+	_, newCert := writePair(t, dir, "a", "a.example")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(pair.Cert, future, future)
+	if !s.Changed() {
+		t.Fatal("changed files not detected")
+	}
+	if Fingerprint(getCert(t, s, "a.example")) != Fingerprint(&oldCert) {
+		t.Fatal("certificate replaced before reload")
+	}
+	if err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if Fingerprint(getCert(t, s, "a.example")) != Fingerprint(&newCert) {
+		t.Fatal("certificate not replaced by reload")
+	}
+
+	// a broken key pair keeps the previous certificate
+	if err = ioutil.WriteFile(pair.Key, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Reload(); err == nil {
+		t.Fatal("no error for broken key")
+	}
+	if Fingerprint(getCert(t, s, "a.example")) != Fingerprint(&newCert) {
+		t.Fatal("certificate replaced by failed reload")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	pair, _ := writePair(t, dir, "a", "a.example")
+	s, err := Load([]KeyPair{pair})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.Watch(10*time.Millisecond, stop, func(err error) {
+		t.Error(err)
+	})
+
+	_, newCert := writePair(t, dir, "a", "a.example")
+	future := time.Now().Add(time.Minute)
+	os.Chtimes(pair.Cert, future, future)
+	os.Chtimes(pair.Key, future, future)
+	for i := 0; i < 100; i++ {
+		if Fingerprint(getCert(t, s, "a.example")) == Fingerprint(&newCert) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal("changed certificate not reloaded")
+}
+
+func TestNew(t *testing.T) {
+	cert, err := SelfSigned([]string{"a.example"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert.Leaf = nil
+	s, err := New(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := getCert(t, s, "a.example"); got.Leaf == nil || Fingerprint(got) != Fingerprint(&cert) {
+		t.Fatal("wrong certificate")
+	}
+	if s.Changed() {
+		t.Fatal("store without files reported as changed")
+	}
+	if _, err = New(); err == nil {
+		t.Fatal("no error without certificates")
+	}
+}
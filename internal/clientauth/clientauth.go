@@ -0,0 +1,290 @@
+// Package clientauth maps the certificates of clients to users and checks them
+// against a certificate revocation list (CRL).
+package clientauth
+
+import (
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// An identity rule maps certificates with a subject common name or subject
+// alternative name to a user.
+type rule struct {
+	kind  string // cn, dns, email or uri
+	value string
+	user  string
+}
+
+// parseRule parses a rule in the form KIND:VALUE, where KIND is cn, dns, email
+// or uri.
+func parseRule(selector, user string) (rule, error) {
+	i := strings.IndexByte(selector, ':')
+	if i < 0 {
+		return rule{}, fmt.Errorf("invalid identity %q: expected cn:, dns:, email: or uri: prefix", selector)
+	}
+	r := rule{kind: strings.ToLower(selector[:i]), value: selector[i+1:], user: user}
+	switch r.kind {
+	case "cn", "uri":
+	case "dns", "email":
+		// case-insensitive
+		r.value = strings.ToLower(r.value)
+	default:
+		return rule{}, fmt.Errorf("invalid identity %q: unknown kind %q", selector, r.kind)
+	}
+	if r.value == "" || user == "" {
+		return rule{}, fmt.Errorf("invalid identity %q: empty value or user", selector)
+	}
+	return r, nil
+}
+
+// matches reports whether the rule matches the given certificate.
+func (r rule) matches(cert *x509.Certificate) bool {
+	switch r.kind {
+	case "cn":
+		return cert.Subject.CommonName == r.value
+	case "dns":
+		for _, name := range cert.DNSNames {
+			if strings.ToLower(name) == r.value {
+				return true
+			}
+		}
+	case "email":
+		for _, addr := range cert.EmailAddresses {
+			if strings.ToLower(addr) == r.value {
+				return true
+			}
+		}
+	case "uri":
+		for _, uri := range cert.URIs {
+			if uri.String() == r.value {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Authenticator verifies client certificates against a CA bundle and a CRL and
+// maps them to users.
+type Authenticator struct {
+	roots   *x509.CertPool
+	cas     []*x509.Certificate
+	rules   []rule
+	crlPath string
+
+	lock    sync.RWMutex
+	revoked map[string]map[string]bool // serial numbers by raw issuer
+	modTime time.Time                  // of the CRL file
+}
+
+// New returns an Authenticator for client certificates issued by the CAs in
+// the PEM file caPath.
+//
+// identities maps selectors of the form cn:NAME, dns:NAME, email:ADDRESS or
+// uri:URI, which match the subject common name or a subject alternative name of
+// the client certificate, to users. If it is empty, the common name is the
+// user.
+//
+// If crlPath is not empty, certificates revoked by the CRLs in the file, PEM or
+// DER encoded, are rejected. The CRLs must be issued by the CAs in the bundle.
+// The CRL is used regardless of its next update time, thus it must be kept up
+// to date and reloaded.
+func New(caPath, crlPath string, identities map[string]string) (*Authenticator, error) {
+	data, err := ioutil.ReadFile(caPath)
+	if err != nil {
+		return nil, err
+	}
+	a := &Authenticator{
+		roots:   x509.NewCertPool(),
+		crlPath: crlPath,
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		ca, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("loading %s: %s", caPath, err)
+		}
+		a.roots.AddCert(ca)
+		a.cas = append(a.cas, ca)
+	}
+	if len(a.cas) == 0 {
+		return nil, fmt.Errorf("no certificates found in %s", caPath)
+	}
+
+	for selector, user := range identities {
+		r, err := parseRule(selector, user)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, r)
+	}
+
+	if err = a.Reload(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Roots returns the pool of the CAs issuing client certificates.
+func (a *Authenticator) Roots() *x509.CertPool {
+	return a.roots
+}
+
+// Identity returns the user of the client certificate with the given verified
+// chain, or an empty string if any certificate of the chain was revoked, no
+// identity matches the certificate or several identities of different users
+// match it.
+func (a *Authenticator) Identity(chain []*x509.Certificate) string {
+	if len(chain) == 0 || a.Revoked(chain) {
+		return ""
+	}
+	cert := chain[0]
+	if len(a.rules) == 0 {
+		return cert.Subject.CommonName
+	}
+	var user string
+	for _, r := range a.rules {
+		if !r.matches(cert) {
+			continue
+		}
+		if user != "" && user != r.user {
+			// ambiguous
+			return ""
+		}
+		user = r.user
+	}
+	return user
+}
+
+// Revoked reports whether any certificate of the given verified chain was
+// revoked according to the CRL.
+func (a *Authenticator) Revoked(chain []*x509.Certificate) bool {
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	for _, cert := range chain {
+		if a.revoked[string(cert.RawIssuer)][hex.EncodeToString(cert.SerialNumber.Bytes())] {
+			return true
+		}
+	}
+	return false
+}
+
+// Reload loads the CRL from its file again. If it fails to load, the previous
+// CRL is kept and an error is returned.
+func (a *Authenticator) Reload() error {
+	if a.crlPath == "" {
+		return nil
+	}
+	modTime := a.crlModTime()
+	data, err := ioutil.ReadFile(a.crlPath)
+	if err != nil {
+		return err
+	}
+	var ders [][]byte
+	if strings.HasPrefix(strings.TrimSpace(string(data)), "-----BEGIN") {
+		for {
+			var block *pem.Block
+			block, data = pem.Decode(data)
+			if block == nil {
+				break
+			}
+			if block.Type == "X509 CRL" {
+				ders = append(ders, block.Bytes)
+			}
+		}
+	} else {
+		ders = append(ders, data)
+	}
+	if len(ders) == 0 {
+		return fmt.Errorf("no CRL found in %s", a.crlPath)
+	}
+
+	revoked := make(map[string]map[string]bool)
+	for _, der := range ders {
+		crl, err := x509.ParseRevocationList(der)
+		if err != nil {
+			return fmt.Errorf("loading %s: %s", a.crlPath, err)
+		}
+		if err = a.checkIssuer(crl); err != nil {
+			return fmt.Errorf("loading %s: %s", a.crlPath, err)
+		}
+		serials := revoked[string(crl.RawIssuer)]
+		if serials == nil {
+			serials = make(map[string]bool)
+			revoked[string(crl.RawIssuer)] = serials
+		}
+		for _, entry := range crl.RevokedCertificateEntries {
+			serials[hex.EncodeToString(entry.SerialNumber.Bytes())] = true
+		}
+	}
+
+	a.lock.Lock()
+	a.revoked = revoked
+	a.modTime = modTime
+	a.lock.Unlock()
+	return nil
+}
+
+// checkIssuer checks that the CRL was signed by one of the CAs.
+func (a *Authenticator) checkIssuer(crl *x509.RevocationList) error {
+	for _, ca := range a.cas {
+		if string(ca.RawSubject) == string(crl.RawIssuer) && crl.CheckSignatureFrom(ca) == nil {
+			return nil
+		}
+	}
+	return errors.New("CRL not signed by any of the CAs")
+}
+
+// crlModTime returns the modification time of the CRL file.
+func (a *Authenticator) crlModTime() time.Time {
+	if fi, err := os.Stat(a.crlPath); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// Changed reports whether the CRL file changed since it was loaded.
+func (a *Authenticator) Changed() bool {
+	if a.crlPath == "" {
+		return false
+	}
+	a.lock.RLock()
+	defer a.lock.RUnlock()
+	return !a.crlModTime().Equal(a.modTime)
+}
+
+// Watch checks the CRL file for changes in the given interval and reloads it
+// if it changed, until stop is closed. Reload errors are passed to the given
+// function.
+func (a *Authenticator) Watch(interval time.Duration, stop <-chan struct{}, errFn func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !a.Changed() {
+			continue
+		}
+		if err := a.Reload(); err != nil && errFn != nil {
+			errFn(err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package clientauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var serial int64
+
+// newCert creates a certificate from the template, signed by the given parent
+// or self-signed if parent is nil.
+func newCert(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial++
+	template.SerialNumber = big.NewInt(serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	template.BasicConstraintsValid = true
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func newCA(t *testing.T, name string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	return newCert(t, &x509.Certificate{
+		Subject:  pkix.Name{CommonName: name},
+		IsCA:     true,
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+	}, nil, nil)
+}
+
+func newCRL(t *testing.T, ca *x509.Certificate, key *ecdsa.PrivateKey, number int64, revoked ...*x509.Certificate) []byte {
+	template := &x509.RevocationList{
+		Number:     big.NewInt(number),
+		ThisUpdate: time.Now().Add(-time.Hour),
+		NextUpdate: time.Now().Add(time.Hour),
+	}
+	for _, cert := range revoked {
+		template.RevokedCertificateEntries = append(template.RevokedCertificateEntries, x509.RevocationListEntry{
+			SerialNumber:   cert.SerialNumber,
+			RevocationTime: time.Now(),
+		})
+	}
+	der, err := x509.CreateRevocationList(rand.Reader, template, ca, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+func writePEM(t *testing.T, path, blockType string, ders ...[]byte) {
+	var data []byte
+	for _, der := range ders {
+		data = append(data, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})...)
+	}
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCA(t, "CA")
+	caPath := filepath.Join(dir, "ca.pem")
+	writePEM(t, caPath, "CERTIFICATE", ca.Raw)
+
+	uri, _ := url.Parse("spiffe://example.com/carol")
+	alice, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}, ca, caKey)
+	bob, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "device"}, DNSNames: []string{"Bob.Devices.example.com"}}, ca, caKey)
+	carol, _ := newCert(t, &x509.Certificate{URIs: []*url.URL{uri}, EmailAddresses: []string{"carol@example.com"}}, ca, caKey)
+	ambiguous, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}, EmailAddresses: []string{"carol@example.com"}}, ca, caKey)
+	unknown, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "mallory"}}, ca, caKey)
+
+	a, err := New(caPath, "", map[string]string{
+		"cn:alice":                       "alice",
+		"dns:bob.devices.example.com":    "bob",
+		"uri:spiffe://example.com/carol": "carol",
+		"EMAIL:Carol@example.com":        "carol",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		cert *x509.Certificate
+		user string
+	}{
+		{alice, "alice"},
+		{bob, "bob"},
+		{carol, "carol"},
+		{ambiguous, ""},
+		{unknown, ""},
+	}
+	for _, test := range tests {
+		if user := a.Identity([]*x509.Certificate{test.cert, ca}); user != test.user {
+			t.Errorf("%v: expected user %q, got %q", test.cert.Subject, test.user, user)
+		}
+	}
+
+	// without identities, the common name is the user
+	a, err = New(caPath, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user := a.Identity([]*x509.Certificate{unknown, ca}); user != "mallory" {
+		t.Errorf("expected common name mallory as user, got %q", user)
+	}
+
+	for _, selector := range []string{"alice", "cn:", "ip:127.0.0.1"} {
+		if _, err = New(caPath, "", map[string]string{selector: "alice"}); err == nil {
+			t.Errorf("no error for invalid identity %q", selector)
+		}
+	}
+	if _, err = New(filepath.Join(dir, "missing.pem"), "", nil); err == nil {
+		t.Error("no error for missing CA file")
+	}
+}
+
+func TestCRL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clientauth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey := newCA(t, "CA")
+	otherCA, otherKey := newCA(t, "Other CA")
+	caPath := filepath.Join(dir, "ca.pem")
+	writePEM(t, caPath, "CERTIFICATE", ca.Raw, otherCA.Raw)
+
+	alice, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "alice"}}, ca, caKey)
+	bob, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "bob"}}, ca, caKey)
+	carol, _ := newCert(t, &x509.Certificate{Subject: pkix.Name{CommonName: "carol"}}, otherCA, otherKey)
+
+	// PEM encoded CRLs of both CAs, revoking bob and carol
+	crlPath := filepath.Join(dir, "crl.pem")
+	writePEM(t, crlPath, "X509 CRL", newCRL(t, ca, caKey, 1, bob), newCRL(t, otherCA, otherKey, 1, carol))
+	a, err := New(caPath, crlPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cert, user := range map[*x509.Certificate]string{alice: "alice", bob: "", carol: ""} {
+		if got := a.Identity([]*x509.Certificate{cert, ca}); got != user {
+			t.Errorf("%s: expected user %q, got %q", cert.Subject.CommonName, user, got)
+		}
+	}
+	if a.Changed() {
+		t.Fatal("CRL reported as changed")
+	}
+
+	// DER encoded CRL revoking alice instead
+	if err = ioutil.WriteFile(crlPath, newCRL(t, ca, caKey, 2, alice), 0600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(crlPath, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !a.Changed() {
+		t.Fatal("changed CRL not detected")
+	}
+	if err = a.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if a.Identity([]*x509.Certificate{alice, ca}) != "" || a.Identity([]*x509.Certificate{bob, ca}) != "bob" {
+		t.Fatal("reloaded CRL not applied")
+	}
+
+	// CRLs of unknown CAs are rejected and the previous CRL is kept
+	unknownCA, unknownKey := newCA(t, "CA")
+	if err = ioutil.WriteFile(crlPath, newCRL(t, unknownCA, unknownKey, 3), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Reload(); err == nil {
+		t.Fatal("no error for CRL of unknown CA")
+	}
+	if a.Identity([]*x509.Certificate{alice, ca}) != "" {
+		t.Fatal("previous CRL not kept")
+	}
+	if _, err = New(caPath, crlPath, nil); err == nil {
+		t.Fatal("no error for CRL of unknown CA")
+	}
+}
@@ -0,0 +1,94 @@
+// Package clientstate persists the replay protection state of a quictun client,
+// so that it can continue its sequence across restarts.
+package clientstate
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/julienschmidt/quictun/internal/atomicfile"
+)
+
+// State is the replay protection state of a client for one server, including
+// the credentials of a redeemed invite.
+type State struct {
+	ClientID       uint64 `json:"clientID,string"`
+	SequenceNumber uint32 `json:"sequenceNumber"`
+
+	// credentials of the user created from an invite, if any
+	User     string `json:"user,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+// File is a state file holding the states of a client for multiple servers.
+// Concurrent access is synchronized.
+//
+// The file is JSON encoded. Every update atomically replaces the whole file by
+// writing a temporary file, which is synced to disk and then renamed. Thus the
+// file always contains either the old or the new state, even after a crash.
+type File struct {
+	path string
+
+	lock   sync.Mutex // guards states
+	states map[string]State
+}
+
+// Open opens the state file at the given path. If it does not exist yet, it is
+// created on the first update.
+func Open(path string) (*File, error) {
+	f := &File{
+		path:   path,
+		states: make(map[string]State),
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &f.states); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Get returns the state for the given server and whether one exists.
+func (f *File) Get(server string) (state State, ok bool) {
+	f.lock.Lock()
+	state, ok = f.states[server]
+	f.lock.Unlock()
+	return
+}
+
+// Put sets the state for the given server and persists it.
+// It only returns after the update was synced to disk.
+func (f *File) Put(server string, state State) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	old, existed := f.states[server]
+	f.states[server] = state
+	if err := f.write(); err != nil {
+		// keep the in-memory state consistent with the file
+		if existed {
+			f.states[server] = old
+		} else {
+			delete(f.states, server)
+		}
+		return err
+	}
+	return nil
+}
+
+// write atomically replaces the file with the current states.
+// f.lock must be held.
+func (f *File) write() error {
+	data, err := json.MarshalIndent(f.states, "", "\t")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(f.path, data)
+}
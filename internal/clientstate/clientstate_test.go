@@ -0,0 +1,95 @@
+package clientstate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempPath(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "clientstate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "state.json"), func() { os.RemoveAll(dir) }
+}
+
+func TestPersistence(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.Get("example.com:443"); ok {
+		t.Fatal("new file has a state")
+	}
+
+	a := State{ClientID: 1<<64 - 1, SequenceNumber: 42}
+	b := State{ClientID: 1337, SequenceNumber: 1}
+	if err = f.Put("example.com:443", a); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Put("example.org:443", b); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen
+	f, err = Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, ok := f.Get("example.com:443"); !ok || state != a {
+		t.Fatalf("state is %+v, should be %+v", state, a)
+	}
+	if state, ok := f.Get("example.org:443"); !ok || state != b {
+		t.Fatalf("state is %+v, should be %+v", state, b)
+	}
+
+	// no temporary files are left behind
+	if _, err = os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file exists: %v", err)
+	}
+}
+
+func TestFailedUpdate(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	f, err := Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := State{ClientID: 1337, SequenceNumber: 1}
+	if err = f.Put("example.com:443", a); err != nil {
+		t.Fatal(err)
+	}
+
+	// make the rename fail
+	if err = os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = f.Put("example.com:443", State{ClientID: 1337, SequenceNumber: 2}); err == nil {
+		t.Fatal("update did not fail")
+	}
+	if state, _ := f.Get("example.com:443"); state != a {
+		t.Fatalf("state is %+v after failed update, should be %+v", state, a)
+	}
+	if _, ok := f.Get("example.org:443"); ok {
+		t.Fatal("state exists for another server")
+	}
+}
+
+func TestInvalidFile(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(path, []byte("not a state file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path); err == nil {
+		t.Fatal("invalid file was opened")
+	}
+}
@@ -0,0 +1,183 @@
+// Package config loads the configuration files of the quictun commands.
+//
+// Configuration files are JSON encoded. Unknown fields are rejected, so that
+// typos do not silently fall back to defaults. The commands bind their flags
+// directly to the fields of their configuration and load the file before
+// parsing the flags, so that flags set on the command line take precedence
+// over values of the file:
+//
+//	cfg := defaultConfig()
+//	flag.StringVar(&cfg.Listen, "l", cfg.Listen, "listen address")
+//	if path := config.Path(flag.CommandLine, os.Args[1:]); path != "" {
+//		err := config.Load(path, cfg)
+//	}
+//	flag.Parse()
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration which is encoded as a string like "1m30s".
+// It can also be used as a flag value.
+type Duration time.Duration
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// Set parses the duration from a string, as a flag.Value.
+func (d *Duration) Set(s string) error {
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\", got %s", b)
+	}
+	if err := d.Set(s); err != nil {
+		return fmt.Errorf("invalid duration %q", s)
+	}
+	return nil
+}
+
+// List is a flag value, which collects the values of a repeatable flag in a
+// list. Values given on the command line replace those of the configuration
+// file, instead of being appended to them.
+type List struct {
+	list *[]string
+	set  bool
+}
+
+// NewList returns a flag value collecting the values in the given list.
+func NewList(list *[]string) *List {
+	return &List{list: list}
+}
+
+func (l *List) String() string {
+	return ""
+}
+
+// Set appends a value to the list, as a flag.Value.
+func (l *List) Set(value string) error {
+	if !l.set {
+		*l.list = nil
+		l.set = true
+	}
+	*l.list = append(*l.list, value)
+	return nil
+}
+
+// Path returns the value of the flag -config in the given command-line
+// arguments, which are scanned like the flag set parses them, but without
+// setting any flags. It returns an empty string if the flag is not set.
+func Path(fs *flag.FlagSet, args []string) string {
+	var path string
+	for len(args) > 0 {
+		arg := args[0]
+		args = args[1:]
+		if len(arg) < 2 || arg[0] != '-' || arg == "--" {
+			break
+		}
+		name := strings.TrimPrefix(arg[1:], "-")
+		value, hasValue := "", false
+		if i := strings.IndexByte(name, '='); i >= 0 {
+			name, value, hasValue = name[:i], name[i+1:], true
+		}
+		if !hasValue && !isBoolFlag(fs.Lookup(name)) && len(args) > 0 {
+			value = args[0]
+			args = args[1:]
+		}
+		if name == "config" {
+			path = value
+		}
+	}
+	return path
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	if f == nil {
+		return false
+	}
+	bf, ok := f.Value.(interface {
+		IsBoolFlag() bool
+	})
+	return ok && bf.IsBoolFlag()
+}
+
+// Load decodes the JSON configuration file at the given path into v.
+// Fields missing in the file keep their values. Errors point to the offending
+// line of the file.
+func Load(path string, v interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(v); err != nil {
+		return fmt.Errorf("%s: %s", path, describe(data, err))
+	}
+	if dec.More() {
+		return fmt.Errorf("%s: unexpected data after the configuration object", path)
+	}
+	return nil
+}
+
+// describe returns a description of a decoding error including the line number,
+// if it is known.
+func describe(data []byte, err error) string {
+	switch err := err.(type) {
+	case *json.SyntaxError:
+		return fmt.Sprintf("line %d: %s", line(data, err.Offset), err)
+	case *json.UnmarshalTypeError:
+		return fmt.Sprintf("line %d: %s must be of type %s, got %s", line(data, err.Offset), err.Field, err.Type, err.Value)
+	}
+	if err == io.EOF {
+		return "file is empty"
+	}
+	// errors of unknown fields and of UnmarshalJSON methods carry no offset
+	return err.Error()
+}
+
+// line returns the line number of the given offset in data.
+func line(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return 1 + bytes.Count(data[:offset], []byte{'\n'})
+}
+
+// LogTo redirects the output of the command and of the standard logger to the
+// file at the given path. The file is created if necessary and appended to.
+func LogTo(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	os.Stdout = f
+	os.Stderr = f
+	log.SetOutput(f)
+	return nil
+}
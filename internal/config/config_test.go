@@ -0,0 +1,178 @@
+package config
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testConfig struct {
+	Listen  string   `json:"listen"`
+	Timeout Duration `json:"timeout"`
+	Verbose bool     `json:"verbose"`
+	Nested  struct {
+		Size int `json:"size"`
+	} `json:"nested"`
+}
+
+func TestDuration(t *testing.T) {
+	var d Duration
+	if err := json.Unmarshal([]byte(`"1m30s"`), &d); err != nil {
+		t.Fatal(err)
+	}
+	if time.Duration(d) != 90*time.Second {
+		t.Fatalf("wrong duration: %s", d)
+	}
+	b, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `"1m30s"` {
+		t.Fatalf("wrong encoding: %s", b)
+	}
+
+	for _, invalid := range []string{`90`, `"90"`, `"1x"`} {
+		if err := json.Unmarshal([]byte(invalid), &d); err == nil {
+			t.Errorf("no error for invalid duration %s", invalid)
+		}
+	}
+}
+
+func TestPath(t *testing.T) {
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Bool("v", false, "")
+	fs.String("l", "", "")
+	fs.String("config", "", "")
+
+	tests := []struct {
+		args []string
+		path string
+	}{
+		{nil, ""},
+		{[]string{"-l", "localhost:1080"}, ""},
+		{[]string{"-config", "a.json"}, "a.json"},
+		{[]string{"--config=a.json"}, "a.json"},
+		{[]string{"-v", "-config", "a.json", "url"}, "a.json"},
+		{[]string{"-l", "-config", "-config", "a.json"}, "a.json"},
+		{[]string{"-config", "a.json", "-config", "b.json"}, "b.json"},
+		{[]string{"url", "-config", "a.json"}, ""},
+		{[]string{"--", "-config", "a.json"}, ""},
+	}
+	for _, test := range tests {
+		if path := Path(fs, test.args); path != test.path {
+			t.Errorf("Path(%q) = %q, expected %q", test.args, path, test.path)
+		}
+	}
+}
+
+func writeFile(t *testing.T, dir, content string) string {
+	path := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testConfig{Listen: "default", Verbose: true}
+	path := writeFile(t, dir, `{
+		"timeout": "5s",
+		"nested": {"size": 3}
+	}`)
+	if err = Load(path, &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "default" || !cfg.Verbose {
+		t.Errorf("missing fields were overwritten: %+v", cfg)
+	}
+	if time.Duration(cfg.Timeout) != 5*time.Second || cfg.Nested.Size != 3 {
+		t.Errorf("fields were not loaded: %+v", cfg)
+	}
+
+	errTests := []struct {
+		content string
+		err     string
+	}{
+		{``, "file is empty"},
+		{"{\n\"listen\": \"a\",\n\"lisen\": \"b\"\n}", `unknown field "lisen"`},
+		{"{\n\"listen\": \"a\"\n\"verbose\": true\n}", "line 3: invalid character"},
+		{"{\n\"nested\": {\n\"size\": \"3\"\n}\n}", "line 3: nested.size must be of type int, got string"},
+		{`{"timeout": 5}`, "duration must be a string"},
+		{`{} {}`, "unexpected data"},
+	}
+	for _, test := range errTests {
+		path := writeFile(t, dir, test.content)
+		err := Load(path, &testConfig{})
+		if err == nil {
+			t.Errorf("no error for %q", test.content)
+			continue
+		}
+		if !strings.HasPrefix(err.Error(), path+": ") || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("wrong error for %q: %s", test.content, err)
+		}
+	}
+
+	if err = Load(filepath.Join(dir, "missing.json"), &cfg); !os.IsNotExist(err) {
+		t.Errorf("expected not exist error for missing file, got %v", err)
+	}
+}
+
+func TestFlagPrecedence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := writeFile(t, dir, `{"listen": "file", "timeout": "5s"}`)
+
+	cfg := testConfig{Listen: "default", Timeout: Duration(time.Second)}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.StringVar(&cfg.Listen, "l", cfg.Listen, "")
+	fs.Var(&cfg.Timeout, "timeout", "")
+	fs.String("config", "", "")
+
+	args := []string{"-config", path, "-l", "flag"}
+	if err = Load(Path(fs, args), &cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err = fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Listen != "flag" {
+		t.Errorf("flag did not override file value: %q", cfg.Listen)
+	}
+	if time.Duration(cfg.Timeout) != 5*time.Second {
+		t.Errorf("file value not used: %s", cfg.Timeout)
+	}
+}
+
+func TestList(t *testing.T) {
+	list := []string{"file"}
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	fs.Var(NewList(&list), "allow", "")
+	if err := fs.Parse(nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0] != "file" {
+		t.Fatalf("list without flags is %q, should be the value of the file", list)
+	}
+
+	// values of the command line replace those of the file
+	if err := fs.Parse([]string{"-allow", "a", "-allow", "b"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 || list[0] != "a" || list[1] != "b" {
+		t.Fatalf("list is %q, expected [a b]", list)
+	}
+}
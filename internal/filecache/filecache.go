@@ -0,0 +1,239 @@
+// Package filecache implements a sequence cache which is persisted to a file,
+// so that the cached sequence numbers survive restarts of the server.
+package filecache
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/julienschmidt/quictun/internal/atomicfile"
+	"github.com/julienschmidt/quictun/internal/lru"
+)
+
+// The file starts with a header consisting of a 4 byte magic and a 4 byte
+// version number, followed by any number of records. Each record consists of
+// the 8 byte key, the 4 byte value and a CRC-32 checksum of both.
+// All integers are encoded in big endian byte order.
+const (
+	magic     = "QTSC"
+	version   = 1
+	headerLen = 8
+	recordLen = 16
+)
+
+// ErrInvalidFile is returned by Open if the given file exists but is not a
+// sequence cache file.
+var ErrInvalidFile = errors.New("not a sequence cache file")
+
+// Cache is a file-backed cache for client sequence numbers.
+// Concurrent access is synchronized.
+//
+// The entries are held in an in-memory LRU cache. Every modification is
+// appended to the file as a checksummed record, which is synced to disk before
+// Set returns. Once the file holds twice as many records as the capacity, it is
+// compacted by atomically replacing it with a snapshot of the current entries.
+// Thus the file size is bounded as well.
+// A partially written record at the end of the file, e.g. caused by a crash,
+// is discarded when the file is opened.
+type Cache struct {
+	path     string
+	capacity int
+	lru      *lru.LRU
+
+	lock    sync.Mutex // guards the file
+	file    *os.File
+	records int // number of records in the file
+}
+
+// Open opens the cache file at the given path, or creates it if it does not
+// exist yet. At most capacity entries are kept.
+func Open(path string, capacity int) (*Cache, error) {
+	c := &Cache{
+		path:     path,
+		capacity: capacity,
+		lru:      lru.New(capacity),
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	// start with a fresh snapshot, which also gets rid of any corrupt records
+	if err := c.compact(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Set sets the value for the given key. If an entry for the given key already
+// exists, it is overwritten.
+func (c *Cache) Set(key uint64, value uint32) (old uint32) {
+	c.lock.Lock()
+	old = c.lru.Set(key, value)
+	c.persist(key, value)
+	c.lock.Unlock()
+	return
+}
+
+// SetIfGreater sets the value for the given key only if it is greater than the
+// current value and reports whether it did so.
+func (c *Cache) SetIfGreater(key uint64, value uint32) bool {
+	c.lock.Lock()
+	ok := c.lru.SetIfGreater(key, value)
+	if ok {
+		c.persist(key, value)
+	}
+	c.lock.Unlock()
+	return ok
+}
+
+// Get returns the current value for the given key.
+// If no value for the given key exists, 0 is returned.
+func (c *Cache) Get(key uint64) (value uint32) {
+	return c.lru.Get(key)
+}
+
+// Close closes the underlying file.
+func (c *Cache) Close() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.file == nil {
+		return nil
+	}
+	err := c.file.Close()
+	c.file = nil
+	return err
+}
+
+// persist appends a record for the given key-value pair to the file.
+// c.lock must be held.
+func (c *Cache) persist(key uint64, value uint32) {
+	if c.file == nil {
+		return
+	}
+
+	if c.records >= 2*c.capacity {
+		err := c.compact()
+		if err == nil {
+			// the snapshot already contains the new value
+			return
+		}
+		// keep appending to the current file, so that the new value is not
+		// lost
+		fmt.Println("sequence cache: compaction failed:", err)
+	}
+
+	var rec [recordLen]byte
+	encodeRecord(rec[:], key, value)
+	if _, err := c.file.Write(rec[:]); err != nil {
+		fmt.Println("sequence cache:", err)
+		return
+	}
+	if err := c.file.Sync(); err != nil {
+		fmt.Println("sequence cache:", err)
+		return
+	}
+	c.records++
+}
+
+// load reads all valid records from the file into the LRU cache.
+func (c *Cache) load() error {
+	f, err := os.Open(c.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+
+	rd := bufio.NewReader(f)
+	var header [headerLen]byte
+	if _, err := io.ReadFull(rd, header[:]); err != nil {
+		if err == io.EOF {
+			// empty file
+			return nil
+		}
+		return ErrInvalidFile
+	}
+	if string(header[:4]) != magic || binary.BigEndian.Uint32(header[4:]) != version {
+		return ErrInvalidFile
+	}
+
+	var rec [recordLen]byte
+	for {
+		if _, err := io.ReadFull(rd, rec[:]); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// a truncated record is the result of an interrupted write
+				return nil
+			}
+			return err
+		}
+		key, value, ok := decodeRecord(rec[:])
+		if !ok {
+			// everything after a corrupt record can not be trusted
+			return nil
+		}
+		c.lru.Set(key, value)
+	}
+}
+
+// compact atomically replaces the file with a snapshot of the current entries.
+// The snapshot is written to a temporary file first, which then is renamed.
+func (c *Cache) compact() error {
+	tmp, err := atomicfile.Create(c.path)
+	if err != nil {
+		return err
+	}
+
+	wr := bufio.NewWriter(tmp)
+	var header [headerLen]byte
+	copy(header[:4], magic)
+	binary.BigEndian.PutUint32(header[4:], version)
+	wr.Write(header[:])
+
+	records := 0
+	var rec [recordLen]byte
+	// least recently used entries first, so that the LRU order is restored
+	// when the file is loaded again
+	c.lru.Range(func(key uint64, value uint32) {
+		encodeRecord(rec[:], key, value)
+		wr.Write(rec[:])
+		records++
+	})
+
+	if err = wr.Flush(); err == nil {
+		err = tmp.Commit()
+	}
+	if err != nil {
+		tmp.Abort()
+		return err
+	}
+
+	// further records are appended to the snapshot through the still open
+	// temporary file, which can not fail anymore once it was renamed
+	if c.file != nil {
+		c.file.Close()
+	}
+	c.file = tmp.File
+	c.records = records
+	return nil
+}
+
+func encodeRecord(rec []byte, key uint64, value uint32) {
+	binary.BigEndian.PutUint64(rec[0:8], key)
+	binary.BigEndian.PutUint32(rec[8:12], value)
+	binary.BigEndian.PutUint32(rec[12:16], crc32.ChecksumIEEE(rec[:12]))
+}
+
+func decodeRecord(rec []byte) (key uint64, value uint32, ok bool) {
+	if binary.BigEndian.Uint32(rec[12:16]) != crc32.ChecksumIEEE(rec[:12]) {
+		return 0, 0, false
+	}
+	return binary.BigEndian.Uint64(rec[0:8]), binary.BigEndian.Uint32(rec[8:12]), true
+}
@@ -0,0 +1,234 @@
+package filecache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func tempPath(t *testing.T) (path string, cleanup func()) {
+	dir, err := ioutil.TempDir("", "filecache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(dir, "sequences"), func() { os.RemoveAll(dir) }
+}
+
+func TestPersistence(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	c, err := Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set(1337, 42)
+	c.Set(1338, 7)
+	if old := c.Set(1337, 43); old != 42 {
+		t.Fatalf("old value for existing key is %d, should be 42", old)
+	}
+	if err = c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen, e.g. after a server restart
+	c, err = Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get(1337); v != 43 {
+		t.Fatalf("value for key 1337 is %d after reopening, should be 43", v)
+	}
+	if v := c.Get(1338); v != 7 {
+		t.Fatalf("value for key 1338 is %d after reopening, should be 7", v)
+	}
+}
+
+func TestSetIfGreater(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	c, err := Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.SetIfGreater(1337, 42) {
+		t.Fatal("value for new key was not set")
+	}
+	if c.SetIfGreater(1337, 41) {
+		t.Fatal("smaller value was set")
+	}
+	c.Close()
+
+	// the rejected value must not have been persisted either
+	c, err = Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get(1337); v != 42 {
+		t.Fatalf("value is %d after reopening, should be 42", v)
+	}
+}
+
+func TestTruncatedRecord(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	c, err := Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set(1337, 42)
+	c.Set(1338, 7)
+	c.Close()
+
+	// simulate a crash in the middle of writing the last record
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = os.Truncate(path, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get(1337); v != 42 {
+		t.Fatalf("value for key 1337 is %d, should be 42", v)
+	}
+	if v := c.Get(1338); v != 0 {
+		t.Fatalf("value of the truncated record is %d, should be 0", v)
+	}
+
+	// the corrupt tail must not prevent new records from being read
+	c.Set(1339, 1)
+	c.Close()
+	c, err = Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get(1339); v != 1 {
+		t.Fatalf("value for key 1339 is %d, should be 1", v)
+	}
+}
+
+func TestCorruptRecord(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	c, err := Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Set(1337, 42)
+	c.Set(1338, 7)
+	c.Close()
+
+	// flip a bit in the value of the last record
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-5] ^= 1
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err = Open(path, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get(1338); v != 0 {
+		t.Fatalf("value of the corrupt record is %d, should be 0", v)
+	}
+}
+
+func TestBoundedSize(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	const capacity = 4
+	c, err := Open(path, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	for i := uint32(1); i <= 100; i++ {
+		c.Set(uint64(i%7), i)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if max := int64(headerLen + 2*capacity*recordLen); fi.Size() > max {
+		t.Fatalf("file has %d bytes, should have at most %d", fi.Size(), max)
+	}
+
+	// the most recently used entries must survive
+	c.Close()
+	c, err = Open(path, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get(100 % 7); v != 100 {
+		t.Fatalf("value for key %d is %d, should be 100", 100%7, v)
+	}
+}
+
+func TestFailedCompaction(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	const capacity = 2
+	c, err := Open(path, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a directory in place of the temporary file makes compactions fail
+	if err = os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	for i := uint32(1); i <= 3*capacity; i++ {
+		c.Set(uint64(i%2), i)
+	}
+	c.Close()
+
+	// values set after failed compactions must survive as well
+	if err = os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Open(path, capacity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if v := c.Get(0); v != 3*capacity {
+		t.Fatalf("value for key 0 is %d, should be %d", v, 3*capacity)
+	}
+	if v := c.Get(1); v != 3*capacity-1 {
+		t.Fatalf("value for key 1 is %d, should be %d", v, 3*capacity-1)
+	}
+}
+
+func TestInvalidFile(t *testing.T) {
+	path, cleanup := tempPath(t)
+	defer cleanup()
+
+	if err := ioutil.WriteFile(path, []byte("not a cache file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Open(path, 10); err != ErrInvalidFile {
+		t.Fatalf("expected ErrInvalidFile, got %v", err)
+	}
+}
@@ -0,0 +1,290 @@
+// Package invites stores the key invites are signed with, the users created
+// from invites and the revoked invites of a server in a directory:
+//
+//	key        base64 encoded invite key
+//	users.json users created from invites with their token keys
+//	revoked    IDs of revoked invites, one per line
+//
+// The server writes the users, while the revoked file is written by the invite
+// command and reloaded by the server.
+package invites
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+	"github.com/julienschmidt/quictun/internal/atomicfile"
+)
+
+// keySize is the size of generated invite keys.
+const keySize = 32
+
+// user is a user created from an invite.
+type user struct {
+	Key      []byte    `json:"key"`
+	Invite   string    `json:"invite"`
+	Redeemed time.Time `json:"redeemed"`
+}
+
+// Store is the invite store of a server. It implements quictun.InviteStore.
+type Store struct {
+	dir string
+	key []byte
+
+	// Reserved reports whether a user with the given name exists outside
+	// the store, e.g. in the config of the server. Invites are not redeemed
+	// for such names. It must be set before the store is used.
+	Reserved func(name string) bool
+
+	lock    sync.RWMutex
+	users   map[string]user
+	revoked map[string]bool
+	modTime time.Time // of the revoked file
+}
+
+// LoadKey returns the invite key in the directory. If create is set, a new key
+// is generated if there is none yet.
+func LoadKey(dir string, create bool) ([]byte, error) {
+	path := filepath.Join(dir, "key")
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) && create {
+		key := make([]byte, keySize)
+		if _, err = rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err = os.MkdirAll(dir, 0700); err != nil {
+			return nil, err
+		}
+		data = []byte(base64.StdEncoding.EncodeToString(key) + "\n")
+		// never overwrite an existing key
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return nil, err
+		}
+		_, err = f.Write(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < keySize {
+		return nil, fmt.Errorf("invalid invite key in %s", path)
+	}
+	return key, nil
+}
+
+// Open opens the store in the given directory, whose key must exist.
+func Open(dir string) (*Store, error) {
+	key, err := LoadKey(dir, false)
+	if err != nil {
+		return nil, err
+	}
+	s := &Store{
+		dir:   dir,
+		key:   key,
+		users: make(map[string]user),
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "users.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err = json.Unmarshal(data, &s.users); err != nil {
+			return nil, fmt.Errorf("loading %s: %s", filepath.Join(dir, "users.json"), err)
+		}
+	}
+	if err = s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Key returns the key invites are signed with.
+func (s *Store) Key() []byte {
+	return s.key
+}
+
+// TokenKey returns the token key of the given user, or nil if the user is
+// unknown or its invite was revoked.
+func (s *Store) TokenKey(name string) []byte {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	u, ok := s.users[name]
+	if !ok || s.revoked[u.Invite] {
+		return nil
+	}
+	return u.Key
+}
+
+// Revoked reports whether the invite with the given ID was revoked.
+func (s *Store) Revoked(id string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.revoked[id]
+}
+
+// Redeem creates the user for the invite and persists it, unless the invite was
+// already redeemed for inv.MaxUses users.
+func (s *Store) Redeem(inv *quictun.Invite, name string, key []byte) error {
+	if s.Reserved != nil && s.Reserved(name) {
+		return fmt.Errorf("user %s already exists", name)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if u, ok := s.users[name]; ok {
+		if u.Invite == inv.ID && hmac.Equal(u.Key, key) {
+			// retry of the same client
+			return nil
+		}
+		if u.Invite == inv.ID && inv.MaxUses == 1 {
+			return quictun.ErrInviteUsed
+		}
+		return fmt.Errorf("user %s already exists", name)
+	}
+	uses := 0
+	for _, u := range s.users {
+		if u.Invite == inv.ID {
+			uses++
+		}
+	}
+	if uses >= inv.MaxUses {
+		return quictun.ErrInviteUsed
+	}
+
+	s.users[name] = user{Key: key, Invite: inv.ID, Redeemed: time.Now().UTC()}
+	if err := s.write(); err != nil {
+		delete(s.users, name)
+		return err
+	}
+	return nil
+}
+
+// write atomically replaces the users file. s.lock must be held.
+func (s *Store) write() error {
+	data, err := json.MarshalIndent(s.users, "", "\t")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(filepath.Join(s.dir, "users.json"), data)
+}
+
+// readRevoked reads the IDs in the revoked file of the directory.
+func readRevoked(dir string) (map[string]bool, error) {
+	revoked := make(map[string]bool)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "revoked"))
+	if os.IsNotExist(err) {
+		return revoked, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		revoked[strings.Fields(line)[0]] = true
+	}
+	return revoked, scanner.Err()
+}
+
+// Reload loads the revoked invites from their file again. If it fails to load,
+// the previous ones are kept and an error is returned.
+func (s *Store) Reload() error {
+	modTime := s.revokedModTime()
+	revoked, err := readRevoked(s.dir)
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	s.revoked = revoked
+	s.modTime = modTime
+	s.lock.Unlock()
+	return nil
+}
+
+// revokedModTime returns the modification time of the revoked file.
+func (s *Store) revokedModTime() time.Time {
+	if fi, err := os.Stat(filepath.Join(s.dir, "revoked")); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// Changed reports whether the revoked file changed since it was loaded.
+func (s *Store) Changed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return !s.revokedModTime().Equal(s.modTime)
+}
+
+// Watch checks the revoked file for changes in the given interval and reloads
+// it if it changed, until stop is closed. Reload errors are passed to the
+// given function.
+func (s *Store) Watch(interval time.Duration, stop <-chan struct{}, errFn func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !s.Changed() {
+			continue
+		}
+		if err := s.Reload(); err != nil && errFn != nil {
+			errFn(err)
+		}
+	}
+}
+
+// Revoke adds the invite with the given ID to the revoked file of the
+// directory. Users created from the invite are rejected as well, once the
+// server reloaded the file.
+func Revoke(dir, id, comment string) error {
+	if id == "" || strings.ContainsAny(id, " \t\r\n#") {
+		return errors.New("invalid invite ID")
+	}
+	revoked, err := readRevoked(dir)
+	if err != nil {
+		return err
+	}
+	if revoked[id] {
+		return nil
+	}
+	path := filepath.Join(dir, "revoked")
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(data) > 0 && data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	line := id
+	if comment != "" {
+		line += " # " + strings.Replace(comment, "\n", " ", -1)
+	}
+	return atomicfile.WriteFile(path, append(data, line+"\n"...))
+}
@@ -0,0 +1,137 @@
+package invites
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/quictun"
+)
+
+func TestLoadKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dir = filepath.Join(dir, "invites")
+
+	if _, err = LoadKey(dir, false); err == nil {
+		t.Fatal("no error for missing key")
+	}
+	if _, err = Open(dir); err == nil {
+		t.Fatal("store without key opened")
+	}
+	key, err := LoadKey(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != keySize {
+		t.Fatalf("generated key has %d bytes", len(key))
+	}
+	loaded, err := LoadKey(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(loaded, key) {
+		t.Fatal("existing key replaced")
+	}
+}
+
+func TestStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "invites")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err = LoadKey(dir, true); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	single := &quictun.Invite{ID: "1", Name: "alice", MaxUses: 1}
+	multi := &quictun.Invite{ID: "2", Name: "team", MaxUses: 2}
+	aliceKey := quictun.DeriveTokenKey("alice", "secret")
+	if err = s.Redeem(single, "alice", aliceKey); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Redeem(single, "alice", aliceKey); err != nil {
+		t.Fatalf("retry failed: %v", err)
+	}
+	if err = s.Redeem(single, "alice", []byte("other")); err != quictun.ErrInviteUsed {
+		t.Fatalf("expected ErrInviteUsed, got %v", err)
+	}
+	if err = s.Redeem(single, "alice-2", []byte("other")); err != quictun.ErrInviteUsed {
+		t.Fatalf("expected ErrInviteUsed, got %v", err)
+	}
+	if err = s.Redeem(multi, "team-1", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Redeem(multi, "team-2", []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Redeem(multi, "team-3", []byte("c")); err != quictun.ErrInviteUsed {
+		t.Fatalf("expected ErrInviteUsed for the third client, got %v", err)
+	}
+	third := &quictun.Invite{ID: "3", Name: "other", MaxUses: 2}
+	if err = s.Redeem(third, "alice", []byte("c")); err == nil {
+		t.Fatal("existing user replaced")
+	}
+	s.Reserved = func(name string) bool { return name == "bob" }
+	if err = s.Redeem(third, "bob", []byte("c")); err == nil {
+		t.Fatal("reserved user created")
+	}
+	s.Reserved = nil
+
+	// the users are persisted
+	s, err = Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.TokenKey("alice"), aliceKey) || !bytes.Equal(s.TokenKey("team-2"), []byte("b")) {
+		t.Fatal("users not persisted")
+	}
+	if s.TokenKey("bob") != nil {
+		t.Fatal("unknown user has a key")
+	}
+
+	// revoking an invite rejects its users after the reload
+	if err = Revoke(dir, "2", "team invite"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Revoke(dir, "2", ""); err != nil {
+		t.Fatal(err)
+	}
+	if err = Revoke(dir, "3 # x", ""); err == nil {
+		t.Fatal("no error for invalid ID")
+	}
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(filepath.Join(dir, "revoked"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Changed() {
+		t.Fatal("changed revoked file not detected")
+	}
+	if err = s.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Revoked("2") || s.Revoked("1") {
+		t.Fatal("revoked invites not loaded")
+	}
+	if s.TokenKey("team-1") != nil || s.TokenKey("alice") == nil {
+		t.Fatal("users of the revoked invite not rejected")
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "revoked"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "2 # team invite\n" {
+		t.Fatalf("unexpected revoked file %q", data)
+	}
+}
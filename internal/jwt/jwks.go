@@ -0,0 +1,214 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+)
+
+// minRSABits is the min size of accepted RSA keys.
+const minRSABits = 2048
+
+// A key is a public key of a key set.
+type key struct {
+	id  string
+	alg string // algorithm the key is restricted to, if any
+	pub crypto.PublicKey
+}
+
+// jsonKey is a JSON Web Key (RFC 7517).
+type jsonKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC and OKP
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// decodeInt decodes a base64url encoded big-endian integer.
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(b) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+// publicKey returns the public key of the JWK.
+func (k *jsonKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil || !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		if n.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key smaller than %d bits", minRSABits)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	case "OKP":
+		if k.Crv != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, errors.New("invalid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// KeySet holds the public keys of a JSON Web Key Set (JWKS) file, which can be
+// reloaded without a restart, e.g. after a key rotation.
+type KeySet struct {
+	path string
+
+	lock    sync.RWMutex
+	keys    []key
+	modTime time.Time
+}
+
+// LoadKeySet returns the key set in the given JWKS file.
+// Keys which are not signature keys are ignored.
+func LoadKeySet(path string) (*KeySet, error) {
+	s := &KeySet{path: path}
+	if err := s.Reload(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reload loads the keys from the file again. If it fails to load, the previous
+// keys are kept and an error is returned.
+func (s *KeySet) Reload() error {
+	modTime := s.fileModTime()
+	data, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	var jwks struct {
+		Keys []jsonKey `json:"keys"`
+	}
+	if err = json.Unmarshal(data, &jwks); err != nil {
+		return fmt.Errorf("loading %s: %s", s.path, err)
+	}
+	var keys []key
+	for i, k := range jwks.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		pub, err := k.publicKey()
+		if err != nil {
+			return fmt.Errorf("loading %s: key %d (%q): %s", s.path, i, k.Kid, err)
+		}
+		keys = append(keys, key{id: k.Kid, alg: k.Alg, pub: pub})
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("no signature keys found in %s", s.path)
+	}
+
+	s.lock.Lock()
+	s.keys = keys
+	s.modTime = modTime
+	s.lock.Unlock()
+	return nil
+}
+
+// lookup returns the keys for the given key ID and algorithm. If the ID is
+// empty, all keys usable with the algorithm are returned.
+func (s *KeySet) lookup(id, alg string) []key {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	var keys []key
+	for _, k := range s.keys {
+		if (id == "" || k.id == id) && (k.alg == "" || k.alg == alg) {
+			keys = append(keys, k)
+		}
+	}
+	return keys
+}
+
+// fileModTime returns the modification time of the file.
+func (s *KeySet) fileModTime() time.Time {
+	if fi, err := os.Stat(s.path); err == nil {
+		return fi.ModTime()
+	}
+	return time.Time{}
+}
+
+// Changed reports whether the file changed since it was loaded.
+func (s *KeySet) Changed() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return !s.fileModTime().Equal(s.modTime)
+}
+
+// Watch checks the file for changes in the given interval and reloads it if it
+// changed, until stop is closed. Reload errors are passed to the given
+// function.
+func (s *KeySet) Watch(interval time.Duration, stop <-chan struct{}, errFn func(error)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if !s.Changed() {
+			continue
+		}
+		if err := s.Reload(); err != nil && errFn != nil {
+			errFn(err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+// Package jwt validates JSON Web Tokens (JWT, RFC 7519) signed with the keys of
+// a local JSON Web Key Set, which authenticate clients as bearer tokens.
+//
+// Supported are the algorithms RS256, RS384, RS512, PS256, PS384, PS512, ES256,
+// ES384, ES512 and EdDSA (Ed25519). Symmetric algorithms and unsigned tokens
+// are rejected.
+package jwt
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	_ "crypto/sha256" // hash functions of the algorithms
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+var (
+	ErrMalformed = errors.New("malformed token")
+	ErrAlgorithm = errors.New("unsupported signature algorithm")
+	ErrSignature = errors.New("invalid signature")
+	ErrExpired   = errors.New("token expired or not yet valid")
+	ErrAudience  = errors.New("token not intended for this audience")
+	ErrClaims    = errors.New("required claims missing")
+)
+
+// hashes of the algorithms
+var algorithms = map[string]crypto.Hash{
+	"RS256": crypto.SHA256,
+	"RS384": crypto.SHA384,
+	"RS512": crypto.SHA512,
+	"PS256": crypto.SHA256,
+	"PS384": crypto.SHA384,
+	"PS512": crypto.SHA512,
+	"ES256": crypto.SHA256,
+	"ES384": crypto.SHA384,
+	"ES512": crypto.SHA512,
+	"EdDSA": 0,
+}
+
+// curve sizes of the ECDSA algorithms in bits
+var ecdsaCurves = map[string]int{
+	"ES256": 256,
+	"ES384": 384,
+	"ES512": 521,
+}
+
+// Policy maps tokens to a policy of the application, e.g. an ACL.
+type Policy struct {
+	// Name identifies the policy.
+	Name string
+
+	// Claim and Value match tokens like Require. A policy without a claim
+	// matches all tokens.
+	Claim string
+	Value string
+}
+
+// Identity is the identity of the client authenticated by a token.
+type Identity struct {
+	User string
+
+	// Policy is the name of the first policy matching the token, or empty if
+	// none matches.
+	Policy string
+
+	// ID is the jti claim of the token, if any, which identifies the token for
+	// replay protection.
+	ID string
+
+	// Expires is the time until which the token is accepted, i.e. its exp
+	// claim plus the Leeway.
+	Expires time.Time
+}
+
+// Validator validates tokens and maps their claims to users and policies.
+type Validator struct {
+	// Keys are the keys the tokens must be signed with.
+	Keys *KeySet
+
+	// Audience must be contained in the aud claim of the tokens, thus tokens
+	// for other services are rejected. Must be set.
+	Audience string
+
+	// Issuer must equal the iss claim of the tokens, if set.
+	Issuer string
+
+	// UserClaim is the claim holding the user name. Defaults to "sub".
+	UserClaim string
+
+	// Require maps claims to values the tokens must have. A claim matches if
+	// it equals the value, if it is an array containing the value or if it is
+	// a string containing the value in its space-separated list, like scope.
+	Require map[string]string
+
+	// Policies map the claims of tokens to policies in order of precedence.
+	Policies []Policy
+
+	// Leeway is the tolerated clock skew for the exp, nbf and iat claims.
+	Leeway time.Duration
+
+	now func() time.Time // for testing
+}
+
+// Validate validates the given token and returns the identity of its client.
+// Tokens must have an exp claim.
+func (v *Validator) Validate(token string) (id Identity, err error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrMalformed
+	}
+	var header struct {
+		Alg  string   `json:"alg"`
+		Kid  string   `json:"kid"`
+		Crit []string `json:"crit"`
+	}
+	if err = decodeSegment(parts[0], &header); err != nil {
+		return Identity{}, err
+	}
+	if len(header.Crit) > 0 {
+		// no extensions are understood
+		return Identity{}, ErrMalformed
+	}
+	hash, ok := algorithms[header.Alg]
+	if !ok {
+		return Identity{}, ErrAlgorithm
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrMalformed
+	}
+
+	// verify the signature with the key of the ID or, without ID, any key
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, k := range v.Keys.lookup(header.Kid, header.Alg) {
+		if verify(header.Alg, hash, k.pub, signed, sig) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return Identity{}, ErrSignature
+	}
+
+	var claims map[string]interface{}
+	if err = decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, err
+	}
+	if id.Expires, err = v.checkTimes(claims); err != nil {
+		return Identity{}, err
+	}
+	if !contains(claims["aud"], v.Audience, false) {
+		return Identity{}, ErrAudience
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return Identity{}, fmt.Errorf("%s: iss", ErrClaims)
+	}
+	for claim, value := range v.Require {
+		if !contains(claims[claim], value, true) {
+			return Identity{}, fmt.Errorf("%s: %s", ErrClaims, claim)
+		}
+	}
+
+	userClaim := v.UserClaim
+	if userClaim == "" {
+		userClaim = "sub"
+	}
+	id.User, _ = claims[userClaim].(string)
+	if id.User == "" {
+		return Identity{}, fmt.Errorf("%s: %s", ErrClaims, userClaim)
+	}
+	for _, p := range v.Policies {
+		if p.Claim == "" || contains(claims[p.Claim], p.Value, true) {
+			id.Policy = p.Name
+			break
+		}
+	}
+	if jti, present := claims["jti"]; present {
+		if id.ID, ok = jti.(string); !ok {
+			return Identity{}, ErrMalformed
+		}
+	}
+	return id, nil
+}
+
+// checkTimes checks the exp, nbf and iat claims and returns the time until
+// which the token is accepted.
+func (v *Validator) checkTimes(claims map[string]interface{}) (time.Time, error) {
+	now := time.Now()
+	if v.now != nil {
+		now = v.now()
+	}
+	exp, ok := numericDate(claims["exp"])
+	if !ok || !now.Before(exp.Add(v.Leeway)) {
+		return time.Time{}, ErrExpired
+	}
+	for _, claim := range []string{"nbf", "iat"} {
+		value, present := claims[claim]
+		if !present {
+			continue
+		}
+		t, ok := numericDate(value)
+		if !ok || now.Add(v.Leeway).Before(t) {
+			return time.Time{}, ErrExpired
+		}
+	}
+	return exp.Add(v.Leeway), nil
+}
+
+// decodeSegment decodes a base64url encoded JSON segment of a token.
+func decodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return ErrMalformed
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err = dec.Decode(v); err != nil {
+		return ErrMalformed
+	}
+	return nil
+}
+
+// numericDate converts a NumericDate claim to a time.
+func numericDate(v interface{}) (time.Time, bool) {
+	n, ok := v.(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	f, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(f), 0), true
+}
+
+// contains reports whether the claim equals the value or is an array
+// containing it. If split is set, space-separated strings are treated as
+// arrays.
+func contains(claim interface{}, value string, split bool) bool {
+	switch claim := claim.(type) {
+	case string:
+		if claim == value {
+			return true
+		}
+		if split {
+			for _, field := range strings.Fields(claim) {
+				if field == value {
+					return true
+				}
+			}
+		}
+	case []interface{}:
+		for _, v := range claim {
+			if s, ok := v.(string); ok && s == value {
+				return true
+			}
+		}
+	case json.Number:
+		return claim.String() == value
+	case bool:
+		return fmt.Sprint(claim) == value
+	}
+	return false
+}
+
+// verify verifies the signature with the public key.
+func verify(alg string, hash crypto.Hash, pub crypto.PublicKey, signed, sig []byte) bool {
+	var digest []byte
+	if hash != 0 {
+		h := hash.New()
+		h.Write(signed)
+		digest = h.Sum(nil)
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, sig) == nil
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, sig, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash}) == nil
+		}
+	case *ecdsa.PublicKey:
+		// the signature is the concatenation of r and s
+		bits, ok := ecdsaCurves[alg]
+		size := (bits + 7) / 8
+		if !ok || pub.Curve.Params().BitSize != bits || len(sig) != 2*size {
+			return false
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		return ecdsa.Verify(pub, digest, r, s)
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(pub, signed, sig)
+	}
+	return false
+}
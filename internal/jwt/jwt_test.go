@@ -0,0 +1,389 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// jwk returns the JWK of the public key.
+func jwk(kid, alg string, pub crypto.PublicKey) map[string]string {
+	k := map[string]string{"kid": kid, "use": "sig"}
+	if alg != "" {
+		k["alg"] = alg
+	}
+	switch pub := pub.(type) {
+	case *rsa.PublicKey:
+		k["kty"] = "RSA"
+		k["n"] = b64(pub.N.Bytes())
+		k["e"] = b64(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		k["kty"] = "EC"
+		k["crv"] = pub.Curve.Params().Name
+		k["x"] = b64(pub.X.FillBytes(make([]byte, size)))
+		k["y"] = b64(pub.Y.FillBytes(make([]byte, size)))
+	case ed25519.PublicKey:
+		k["kty"] = "OKP"
+		k["crv"] = "Ed25519"
+		k["x"] = b64(pub)
+	}
+	return k
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	data, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sign creates a token with the given header fields and claims.
+func sign(t *testing.T, alg, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	header := map[string]string{"alg": alg, "typ": "JWT"}
+	if kid != "" {
+		header["kid"] = kid
+	}
+	h, _ := json.Marshal(header)
+	c, _ := json.Marshal(claims)
+	signed := b64(h) + "." + b64(c)
+
+	hash := algorithms[alg]
+	msg := []byte(signed)
+	if hash != 0 {
+		d := hash.New()
+		d.Write(msg)
+		msg = d.Sum(nil)
+	}
+	var sig []byte
+	var err error
+	switch key := key.(type) {
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		if r, s, err = ecdsa.Sign(rand.Reader, key, msg); err == nil {
+			size := (key.Curve.Params().BitSize + 7) / 8
+			sig = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+		}
+	case *rsa.PrivateKey:
+		if strings.HasPrefix(alg, "PS") {
+			sig, err = rsa.SignPSS(rand.Reader, key, hash, msg, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, key, hash, msg)
+		}
+	default:
+		sig, err = key.Sign(rand.Reader, msg, crypto.Hash(0))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed + "." + b64(sig)
+}
+
+func TestValidate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path,
+		jwk("rsa", "", rsaKey.Public()),
+		jwk("p256", "ES256", p256Key.Public()),
+		jwk("p384", "", p384Key.Public()),
+		jwk("ed", "", edKey.Public()),
+		map[string]string{"kty": "oct", "kid": "enc", "use": "enc", "k": "c2VjcmV0"},
+	)
+	keys, err := LoadKeySet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	v := &Validator{
+		Keys:     keys,
+		Audience: "quictun",
+		Issuer:   "https://id.example.com",
+		Require:  map[string]string{"scope": "tunnel"},
+		Leeway:   time.Minute,
+		now:      func() time.Time { return now },
+	}
+	claims := func(modify func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub":   "alice",
+			"aud":   "quictun",
+			"iss":   "https://id.example.com",
+			"scope": "profile tunnel",
+			"iat":   now.Unix(),
+			"exp":   now.Add(5 * time.Minute).Unix(),
+		}
+		if modify != nil {
+			modify(c)
+		}
+		return c
+	}
+	valid := sign(t, "ES256", "p256", p256Key, claims(nil))
+	parts := strings.Split(valid, ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"RS256", sign(t, "RS256", "rsa", rsaKey, claims(nil)), nil},
+		{"PS384", sign(t, "PS384", "rsa", rsaKey, claims(nil)), nil},
+		{"ES256", valid, nil},
+		{"ES384", sign(t, "ES384", "p384", p384Key, claims(nil)), nil},
+		{"EdDSA", sign(t, "EdDSA", "ed", edKey, claims(nil)), nil},
+		{"without kid", sign(t, "EdDSA", "", edKey, claims(nil)), nil},
+		{"audience array", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"other", "quictun"}
+		})), nil},
+		{"scope array", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["scope"] = []string{"tunnel"}
+		})), nil},
+		{"within leeway", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-30 * time.Second).Unix()
+		})), nil},
+
+		{"empty", "", ErrMalformed},
+		{"garbage", "a.b.c", ErrMalformed},
+		{"tampered", parts[0] + "." + b64([]byte(`{"sub":"mallory"}`)) + "." + parts[2], ErrSignature},
+		{"none", b64([]byte(`{"alg":"none"}`)) + "." + parts[1] + ".", ErrAlgorithm},
+		{"HS256", b64([]byte(`{"alg":"HS256"}`)) + "." + parts[1] + "." + parts[2], ErrAlgorithm},
+		{"crit", b64([]byte(`{"alg":"ES256","crit":["x"]}`)) + "." + parts[1] + "." + parts[2], ErrMalformed},
+		{"unknown key", sign(t, "ES256", "p256", otherKey, claims(nil)), ErrSignature},
+		{"unknown kid", sign(t, "ES256", "other", p256Key, claims(nil)), ErrSignature},
+		{"restricted algorithm", sign(t, "ES384", "p256", p256Key, claims(nil)), ErrSignature},
+		{"wrong curve", sign(t, "ES256", "p384", p384Key, claims(nil)), ErrSignature},
+		{"expired", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["exp"] = now.Add(-2 * time.Minute).Unix()
+		})), ErrExpired},
+		{"no exp", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			delete(c, "exp")
+		})), ErrExpired},
+		{"not yet valid", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["nbf"] = now.Add(2 * time.Minute).Unix()
+		})), ErrExpired},
+		{"other audience", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["aud"] = "other"
+		})), ErrAudience},
+		{"no audience", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			delete(c, "aud")
+		})), ErrAudience},
+		{"other issuer", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["iss"] = "https://evil.example.com"
+		})), ErrClaims},
+		{"missing scope", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["scope"] = "profile tunnels"
+		})), ErrClaims},
+		{"no subject", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			delete(c, "sub")
+		})), ErrClaims},
+		{"invalid jti", sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+			c["jti"] = 42
+		})), ErrMalformed},
+	}
+	for _, test := range tests {
+		id, err := v.Validate(test.token)
+		if test.err == nil {
+			if err != nil || id.User != "alice" {
+				t.Errorf("%s: expected user alice, got %q, %v", test.name, id.User, err)
+			}
+			continue
+		}
+		if err == nil || !strings.HasPrefix(err.Error(), test.err.Error()) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// the ID and the expiry including the leeway identify the token
+	token := sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+		c["jti"] = "c2f1"
+	}))
+	id, err := v.Validate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expires := now.Add(6 * time.Minute); id.ID != "c2f1" || !id.Expires.Equal(expires) {
+		t.Errorf("expected ID c2f1 expiring at %s, got %q expiring at %s", expires, id.ID, id.Expires)
+	}
+
+	// custom user claim
+	v.UserClaim = "email"
+	token = sign(t, "ES256", "p256", p256Key, claims(func(c map[string]interface{}) {
+		c["email"] = "alice@example.com"
+	}))
+	if id, err := v.Validate(token); err != nil || id.User != "alice@example.com" {
+		t.Errorf("user claim: expected alice@example.com, got %q, %v", id.User, err)
+	}
+}
+
+func TestPolicies(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, jwk("ed", "", key.Public()))
+	keys, err := LoadKeySet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Unix(1500000000, 0)
+	v := &Validator{
+		Keys:     keys,
+		Audience: "quictun",
+		Policies: []Policy{
+			{Name: "admin", Claim: "groups", Value: "admins"},
+			{Name: "web", Claim: "scope", Value: "web"},
+		},
+		now: func() time.Time { return now },
+	}
+	token := func(claims map[string]interface{}) string {
+		claims["sub"] = "alice"
+		claims["aud"] = "quictun"
+		claims["exp"] = now.Add(5 * time.Minute).Unix()
+		return sign(t, "EdDSA", "ed", key, claims)
+	}
+
+	tests := []struct {
+		name   string
+		claims map[string]interface{}
+		policy string
+	}{
+		{"group", map[string]interface{}{"groups": []string{"users", "admins"}}, "admin"},
+		{"scope", map[string]interface{}{"scope": "profile web"}, "web"},
+		{"precedence", map[string]interface{}{"groups": "admins", "scope": "web"}, "admin"},
+		{"no match", map[string]interface{}{"groups": []string{"users"}, "scope": "website"}, ""},
+	}
+	for _, test := range tests {
+		id, err := v.Validate(token(test.claims))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if id.User != "alice" || id.Policy != test.policy {
+			t.Errorf("%s: expected alice with policy %q, got %q with policy %q", test.name, test.policy, id.User, id.Policy)
+		}
+	}
+
+	// a policy without claim matches all tokens
+	v.Policies = append(v.Policies, Policy{Name: "default"})
+	if id, err := v.Validate(token(map[string]interface{}{})); err != nil || id.Policy != "default" {
+		t.Errorf("default: expected policy default, got %q, %v", id.Policy, err)
+	}
+}
+
+func TestKeySetReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jwt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	oldKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "jwks.json")
+	writeJWKS(t, path, jwk("old", "", oldKey.Public()))
+	keys, err := LoadKeySet(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys.Changed() {
+		t.Fatal("key set reported as changed")
+	}
+
+	v := &Validator{Keys: keys, Audience: "quictun"}
+	claims := map[string]interface{}{"sub": "alice", "aud": "quictun", "exp": time.Now().Add(time.Minute).Unix()}
+	oldToken := sign(t, "ES256", "old", oldKey, claims)
+	newToken := sign(t, "ES256", "new", newKey, claims)
+	if _, err = v.Validate(newToken); err != ErrSignature {
+		t.Fatalf("expected ErrSignature before the rotation, got %v", err)
+	}
+
+	// rotate the key
+	writeJWKS(t, path, jwk("new", "", newKey.Public()))
+	future := time.Now().Add(time.Minute)
+	if err = os.Chtimes(path, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !keys.Changed() {
+		t.Fatal("changed key set not detected")
+	}
+	if err = keys.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = v.Validate(newToken); err != nil {
+		t.Fatalf("token of the new key rejected: %v", err)
+	}
+	if _, err = v.Validate(oldToken); err != ErrSignature {
+		t.Fatalf("expected ErrSignature for the old key, got %v", err)
+	}
+
+	// invalid key sets are rejected and the previous keys are kept
+	for _, data := range []string{"{", `{"keys":[]}`, `{"keys":[{"kty":"RSA","n":"AQAB","e":"AQAB"}]}`, `{"keys":[{"kty":"EC","crv":"P-256","x":"AQ","y":"AQ"}]}`} {
+		if err = ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err = keys.Reload(); err == nil {
+			t.Errorf("no error for key set %s", data)
+		}
+	}
+	if _, err = v.Validate(newToken); err != nil {
+		t.Fatalf("previous keys not kept: %v", err)
+	}
+}
@@ -2,100 +2,349 @@ package lru
 
 import (
 	"sync"
+	"time"
 )
 
 type entry struct {
-	key   uint64
-	value uint32
-	next  *entry
+	key     uint64
+	value   uint32
+	expires int64  // in Unix nanoseconds, 0 if the entry never expires
+	seen    uint64 // bitmap of the values accepted within the window below value
+	prev    *entry
+	next    *entry
+}
+
+// Options configures an LRU cache.
+type Options struct {
+	// Shards is the number of independently synchronized parts the cache is
+	// split into. Keys are distributed over the shards by their hash.
+	// More shards reduce the lock contention under concurrent access, but the
+	// LRU order is only maintained per shard.
+	// The number is rounded up to the next power of two. Defaults to 1.
+	Shards int
+
+	// TTL is the duration after which an entry expires, if it was not set
+	// again in the meantime. If zero, entries never expire.
+	TTL time.Duration
+
+	// Window is the size of the anti-replay window used by SetIfGreater, at most
+	// 64. If greater than 1, values smaller than the current value are also
+	// accepted, if they are within the window and were not accepted before.
+	// This allows clients to use multiple sessions in parallel or requests to be
+	// reordered, similar to the anti-replay window of IPsec.
+	// Defaults to 1, i.e. only strictly increasing values are accepted.
+	Window int
+
+	// NoEvict makes SetIfGreater refuse new keys instead of evicting the least
+	// recently used entry of a full shard, unless that entry expired. This is
+	// meant for caches of nonces, which must be kept until they expire, see
+	// TTL. Set always evicts.
+	NoEvict bool
+}
+
+// Stats are statistics about the usage of an LRU cache.
+type Stats struct {
+	Len         int    // current number of entries
+	Hits        uint64 // number of lookups of an existing entry
+	Misses      uint64 // number of lookups of a missing or expired entry
+	Evictions   uint64 // number of entries removed due to the capacity limit
+	Expirations uint64 // number of entries removed due to the TTL
+	Refusals    uint64 // number of new keys refused due to NoEvict
 }
 
 // LRU is an LRU cache.
 // Concurrent access is synchronized.
 //
-// A map is used as the index.
-// The LRU order is tracked in a linked list.
+// The cache is split into shards. Each shard uses a map as the index and tracks
+// the LRU order in a doubly linked list. Thus all operations are O(1).
 type LRU struct {
+	shards  []shard
+	shift   uint // shift of the key hash to get the shard index
+	ttl     int64
+	window  uint32
+	noEvict bool
+	now     func() int64 // returns the current time in Unix nanoseconds
+}
+
+type shard struct {
 	capacity int               // max number of entries
-	head     *entry            // first entry in LRU order
+	head     *entry            // most recently used entry
+	tail     *entry            // least recently used entry
 	cache    map[uint64]*entry // mapping of all key-value pairs
-	lock     sync.Mutex        // guards the whole struct
+	stats    Stats
+	lock     sync.Mutex // guards the whole struct
 }
 
-// NewLRU creates a new LRU cache with the given capacity
+// New creates a new LRU cache with the given capacity, consisting of a single
+// shard and without expiry of entries.
 func New(capacity int) *LRU {
+	return NewWithOptions(capacity, Options{})
+}
+
+// NewWithOptions creates a new LRU cache with the given total capacity and
+// options. The capacity is split as evenly as possible between the shards, so
+// that the total capacity is exactly the given one.
+func NewWithOptions(capacity int, opts Options) *LRU {
 	if capacity < 2 {
 		panic("capacity must be at least 2")
 	}
-	return &LRU{
-		capacity: capacity,
-		cache:    make(map[uint64]*entry, capacity),
+	numShards, shift := 1, uint(64)
+	for numShards < opts.Shards {
+		numShards <<= 1
+		shift--
+	}
+	if capacity < numShards {
+		panic("capacity must be at least the number of shards")
+	}
+	if opts.Window > 64 {
+		panic("window must be at most 64")
+	}
+	window := uint32(1)
+	if opts.Window > 1 {
+		window = uint32(opts.Window)
+	}
+
+	l := &LRU{
+		shards:  make([]shard, numShards),
+		shift:   shift,
+		ttl:     int64(opts.TTL),
+		window:  window,
+		noEvict: opts.NoEvict,
+		now:     func() int64 { return time.Now().UnixNano() },
+	}
+	for i := range l.shards {
+		// the first shards take the remainder
+		l.shards[i].capacity = capacity / numShards
+		if i < capacity%numShards {
+			l.shards[i].capacity++
+		}
+		l.shards[i].cache = make(map[uint64]*entry)
+	}
+	return l
+}
+
+// shard returns the shard responsible for the given key.
+func (l *LRU) shard(key uint64) *shard {
+	if len(l.shards) == 1 {
+		return &l.shards[0]
 	}
+	// Fibonacci hashing, as keys are not necessarily uniformly distributed
+	return &l.shards[(key*0x9E3779B97F4A7C15)>>l.shift]
+}
+
+// expires returns the expiry time for an entry set now.
+func (l *LRU) expires() int64 {
+	if l.ttl == 0 {
+		return 0
+	}
+	return l.now() + l.ttl
 }
 
 // Set sets the value for the given key. If an entry for the given key already
 // exists, it is overwritten.
 func (l *LRU) Set(key uint64, value uint32) (old uint32) {
-	l.lock.Lock()
-	if ep, ok := l.cache[key]; ok {
+	s := l.shard(key)
+	s.lock.Lock()
+	if ep := l.lookup(s, key); ep != nil {
 		old = ep.value
 		ep.value = value
-		l.moveToFront(ep)
-		l.lock.Unlock()
+		ep.seen = 1
+		ep.expires = l.expires()
+		s.moveToFront(ep)
+		s.lock.Unlock()
 		return
 	}
+	s.insert(key, value, l.expires())
+	s.lock.Unlock()
+	return
+}
 
-	// insert new entry for key
-	ep := new(entry)
-	ep.key = key
-	ep.value = value
-	ep.next = l.head
-	l.head = ep
-	l.cache[key] = ep
-
-	if len(l.cache) > l.capacity {
-		l.removeLast()
+// SetIfGreater sets the value for the given key only if it is greater than the
+// current value and reports whether it did so. If no entry for the given key
+// exists, the current value is 0.
+// If a window is configured, smaller values within the window below the
+// current value are also accepted once, but do not change the current value.
+func (l *LRU) SetIfGreater(key uint64, value uint32) bool {
+	s := l.shard(key)
+	s.lock.Lock()
+	if ep := l.lookup(s, key); ep != nil {
+		s.moveToFront(ep)
+		if value <= ep.value {
+			// check whether the value is within the window and unseen
+			diff := ep.value - value
+			if value == 0 || diff >= l.window || ep.seen&(1<<diff) != 0 {
+				s.lock.Unlock()
+				return false
+			}
+			ep.seen |= 1 << diff
+			ep.expires = l.expires()
+			s.lock.Unlock()
+			return true
+		}
+		// slide the window
+		if diff := value - ep.value; diff < 64 {
+			ep.seen = ep.seen<<diff | 1
+		} else {
+			ep.seen = 1
+		}
+		ep.value = value
+		ep.expires = l.expires()
+		s.lock.Unlock()
+		return true
 	}
-	l.lock.Unlock()
-	return
+	if value == 0 || (l.noEvict && !l.makeRoom(s)) {
+		s.lock.Unlock()
+		return false
+	}
+	s.insert(key, value, l.expires())
+	s.lock.Unlock()
+	return true
 }
 
 // Get returns the current value for the given key.
 // If no value for the given key exists, 0 is returned.
 func (l *LRU) Get(key uint64) (value uint32) {
-	l.lock.Lock()
-	if ep, ok := l.cache[key]; ok {
+	s := l.shard(key)
+	s.lock.Lock()
+	if ep := l.lookup(s, key); ep != nil {
 		value = ep.value
-		l.moveToFront(ep)
+		s.moveToFront(ep)
 	}
-	l.lock.Unlock()
+	s.lock.Unlock()
 	return value
 }
 
-func (l *LRU) moveToFront(ep *entry) {
-	// move entry to front
-	if l.head != ep {
-		after := ep.next
-		cur := l.head
-		ep.next = cur
-		for cur.next != ep {
-			cur = cur.next
+// Range calls fn for each entry in the cache, starting with the least recently
+// used one of each shard. The LRU order is not modified.
+// fn must not access the cache.
+func (l *LRU) Range(fn func(key uint64, value uint32)) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.lock.Lock()
+		for ep := s.tail; ep != nil; ep = ep.prev {
+			fn(ep.key, ep.value)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Len returns the number of entries in the cache.
+func (l *LRU) Len() int {
+	n := 0
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.lock.Lock()
+		n += len(s.cache)
+		s.lock.Unlock()
+	}
+	return n
+}
+
+// Stats returns statistics about the usage of the cache.
+func (l *LRU) Stats() (stats Stats) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		s.lock.Lock()
+		stats.Len += len(s.cache)
+		stats.Hits += s.stats.Hits
+		stats.Misses += s.stats.Misses
+		stats.Evictions += s.stats.Evictions
+		stats.Expirations += s.stats.Expirations
+		stats.Refusals += s.stats.Refusals
+		s.lock.Unlock()
+	}
+	return stats
+}
+
+// lookup returns the entry for the given key, or nil if none exists. Expired
+// entries are removed.
+// s.lock must be held.
+func (l *LRU) lookup(s *shard, key uint64) *entry {
+	ep, ok := s.cache[key]
+	if !ok {
+		s.stats.Misses++
+		return nil
+	}
+	if ep.expires != 0 && ep.expires <= l.now() {
+		s.remove(ep)
+		s.stats.Expirations++
+		s.stats.Misses++
+		return nil
+	}
+	s.stats.Hits++
+	return ep
+}
+
+// makeRoom removes expired entries from the end of the full shard and reports
+// whether there is room for a new entry then.
+// s.lock must be held.
+func (l *LRU) makeRoom(s *shard) bool {
+	now := l.now()
+	for len(s.cache) >= s.capacity {
+		ep := s.tail
+		if ep.expires == 0 || ep.expires > now {
+			s.stats.Refusals++
+			return false
 		}
-		cur.next = after
-		l.head = ep
+		s.remove(ep)
+		s.stats.Expirations++
+	}
+	return true
+}
+
+// insert inserts a new entry at the front and evicts the least recently used
+// entry if the capacity is exceeded.
+func (s *shard) insert(key uint64, value uint32, expires int64) {
+	ep := &entry{
+		key:     key,
+		value:   value,
+		expires: expires,
+		seen:    1,
+	}
+	s.pushFront(ep)
+	s.cache[key] = ep
+
+	if len(s.cache) > s.capacity {
+		s.remove(s.tail)
+		s.stats.Evictions++
 	}
 }
 
-func (l *LRU) removeLast() {
-	// remove last entry from list
-	prev := l.head
-	last := prev.next
-	for last.next != nil {
-		prev = last
-		last = last.next
+func (s *shard) pushFront(ep *entry) {
+	ep.prev = nil
+	ep.next = s.head
+	if s.head != nil {
+		s.head.prev = ep
 	}
-	prev.next = nil
+	s.head = ep
+	if s.tail == nil {
+		s.tail = ep
+	}
+}
+
+func (s *shard) unlink(ep *entry) {
+	if ep.prev != nil {
+		ep.prev.next = ep.next
+	} else {
+		s.head = ep.next
+	}
+	if ep.next != nil {
+		ep.next.prev = ep.prev
+	} else {
+		s.tail = ep.prev
+	}
+	ep.prev = nil
+	ep.next = nil
+}
+
+func (s *shard) moveToFront(ep *entry) {
+	if s.head != ep {
+		s.unlink(ep)
+		s.pushFront(ep)
+	}
+}
 
-	// remove from cache
-	delete(l.cache, last.key)
+func (s *shard) remove(ep *entry) {
+	s.unlink(ep)
+	delete(s.cache, ep.key)
 }
@@ -2,11 +2,15 @@ package lru
 
 import (
 	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func printList(l *LRU) {
-	cur := l.head
+	cur := l.shards[0].head
 	i := 0
 	for cur != nil {
 		fmt.Println(i, cur.key, cur.value)
@@ -16,9 +20,9 @@ func printList(l *LRU) {
 }
 
 func TestLRU(t *testing.T) {
-	lru := NewLRU(2)
+	lru := New(2)
 
-	if n := len(lru.cache); n != 0 {
+	if n := len(lru.shards[0].cache); n != 0 {
 		t.Fatalf("cache should be empty, actually has %d elements", n)
 	}
 
@@ -28,7 +32,7 @@ func TestLRU(t *testing.T) {
 		t.Fatalf("old value for new key is %d, should be 0", old)
 	}
 
-	if n := len(lru.cache); n != 1 {
+	if n := len(lru.shards[0].cache); n != 1 {
 		t.Fatalf("cache should have 1 element, actually has %d elements", n)
 	}
 
@@ -38,7 +42,7 @@ func TestLRU(t *testing.T) {
 		t.Fatalf("old value for existing key is %d, should be 42", old)
 	}
 
-	if n := len(lru.cache); n != 1 {
+	if n := len(lru.shards[0].cache); n != 1 {
 		t.Fatalf("cache should have 1 element, actually has %d elements", n)
 	}
 
@@ -48,11 +52,11 @@ func TestLRU(t *testing.T) {
 		t.Fatalf("old value for new key is %d, should be 0", old)
 	}
 
-	if n := len(lru.cache); n != 2 {
+	if n := len(lru.shards[0].cache); n != 2 {
 		t.Fatalf("cache should have 2 elements, actually has %d elements", n)
 	}
 
-	if head := lru.head.key; head != 1338 {
+	if head := lru.shards[0].head.key; head != 1338 {
 		t.Fatalf("newly inserted element is not head, key of head is %d", head)
 	}
 
@@ -61,7 +65,7 @@ func TestLRU(t *testing.T) {
 		t.Fatalf("value of the first entry changed, should be 43, is %d", v1)
 	}
 
-	if head := lru.head.key; head != 1337 {
+	if head := lru.shards[0].head.key; head != 1337 {
 		t.Fatalf("accessed element is not head, key of head is %d", head)
 	}
 
@@ -71,7 +75,7 @@ func TestLRU(t *testing.T) {
 		t.Fatalf("old value for existing key is %d, should be 43", old)
 	}
 
-	if n := len(lru.cache); n != 2 {
+	if n := len(lru.shards[0].cache); n != 2 {
 		t.Fatalf("cache should have 2 elements, actually has %d elements", n)
 	}
 
@@ -83,13 +87,378 @@ func TestLRU(t *testing.T) {
 		t.Fatalf("old value for new key is %d, should be 0", old)
 	}
 
-	if n := len(lru.cache); n != 2 {
+	if n := len(lru.shards[0].cache); n != 2 {
 		t.Fatalf("cache should have 2 elements, actually has %d elements", n)
 	}
 
-	if head := lru.head.key; head != 1339 {
+	if head := lru.shards[0].head.key; head != 1339 {
 		t.Fatalf("newly inserted element is not head, key of head is %d", head)
 	}
 
 	//printList(lru)
 }
+
+func TestSetIfGreater(t *testing.T) {
+	lru := New(2)
+
+	// 0 is never greater than the value of a missing entry
+	if lru.SetIfGreater(1337, 0) {
+		t.Fatal("value 0 was set for a new key")
+	}
+	if n := len(lru.shards[0].cache); n != 0 {
+		t.Fatalf("cache should be empty, actually has %d elements", n)
+	}
+
+	if !lru.SetIfGreater(1337, 42) {
+		t.Fatal("value for new key was not set")
+	}
+
+	// stale values must not downgrade the stored value
+	if lru.SetIfGreater(1337, 41) {
+		t.Fatal("smaller value was set")
+	}
+	if lru.SetIfGreater(1337, 42) {
+		t.Fatal("equal value was set")
+	}
+	if v := lru.Get(1337); v != 42 {
+		t.Fatalf("value is %d, should still be 42", v)
+	}
+
+	if !lru.SetIfGreater(1337, 43) {
+		t.Fatal("greater value was not set")
+	}
+	if v := lru.Get(1337); v != 43 {
+		t.Fatalf("value is %d, should be 43", v)
+	}
+
+	// a rejected value still counts as usage
+	lru.SetIfGreater(1338, 1)
+	lru.SetIfGreater(1337, 1)
+	if head := lru.shards[0].head.key; head != 1337 {
+		t.Fatalf("accessed element is not head, key of head is %d", head)
+	}
+}
+
+func TestWindow(t *testing.T) {
+	lru := NewWithOptions(2, Options{Window: 4})
+
+	if !lru.SetIfGreater(1337, 10) {
+		t.Fatal("value for new key was not set")
+	}
+
+	// unseen values within the window are accepted once
+	for _, v := range []uint32{8, 7, 9} {
+		if !lru.SetIfGreater(1337, v) {
+			t.Fatalf("unseen value %d within the window was rejected", v)
+		}
+		if lru.SetIfGreater(1337, v) {
+			t.Fatalf("value %d was accepted twice", v)
+		}
+	}
+	if lru.SetIfGreater(1337, 10) {
+		t.Fatal("current value was accepted twice")
+	}
+	if lru.SetIfGreater(1337, 6) {
+		t.Fatal("value below the window was accepted")
+	}
+	if v := lru.Get(1337); v != 10 {
+		t.Fatalf("value is %d, should still be 10", v)
+	}
+
+	// sliding the window keeps the seen values within it
+	if !lru.SetIfGreater(1337, 12) {
+		t.Fatal("greater value was not set")
+	}
+	if lru.SetIfGreater(1337, 10) || lru.SetIfGreater(1337, 9) {
+		t.Fatal("value seen before sliding the window was accepted")
+	}
+	if !lru.SetIfGreater(1337, 11) {
+		t.Fatal("unseen value within the slid window was rejected")
+	}
+	if lru.SetIfGreater(1337, 8) {
+		t.Fatal("value below the slid window was accepted")
+	}
+
+	// jumps larger than the bitmap reset it
+	if !lru.SetIfGreater(1337, 1000) {
+		t.Fatal("greater value was not set")
+	}
+	if !lru.SetIfGreater(1337, 999) {
+		t.Fatal("unseen value within the window was rejected after a large jump")
+	}
+
+	// Set resets the window
+	lru.Set(1338, 3)
+	if !lru.SetIfGreater(1338, 2) || !lru.SetIfGreater(1338, 1) {
+		t.Fatal("unseen value within the window was rejected after Set")
+	}
+	if lru.SetIfGreater(1338, 0) {
+		t.Fatal("value 0 was accepted")
+	}
+}
+
+func TestSetIfGreaterConcurrent(t *testing.T) {
+	lru := New(2)
+
+	const n = 1000
+	var accepted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for v := uint32(1); v <= n; v++ {
+				if lru.SetIfGreater(1337, v) {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every value must have been accepted exactly once
+	if accepted != n {
+		t.Fatalf("%d values were accepted, should be %d", accepted, n)
+	}
+	if v := lru.Get(1337); v != n {
+		t.Fatalf("value is %d, should be %d", v, n)
+	}
+}
+
+// checkList verifies that the linked list of each shard is consistent with the
+// index.
+func checkList(t *testing.T, l *LRU) {
+	for i := range l.shards {
+		s := &l.shards[i]
+		n := 0
+		var prev *entry
+		for cur := s.head; cur != nil; cur = cur.next {
+			if cur.prev != prev {
+				t.Fatalf("shard %d: broken prev link at key %d", i, cur.key)
+			}
+			if s.cache[cur.key] != cur {
+				t.Fatalf("shard %d: key %d is not indexed", i, cur.key)
+			}
+			prev = cur
+			n++
+		}
+		if s.tail != prev {
+			t.Fatalf("shard %d: tail is not the last entry", i)
+		}
+		if n != len(s.cache) {
+			t.Fatalf("shard %d: list has %d entries, index %d", i, n, len(s.cache))
+		}
+		if n > s.capacity {
+			t.Fatalf("shard %d: %d entries exceed the capacity %d", i, n, s.capacity)
+		}
+	}
+}
+
+func TestEviction(t *testing.T) {
+	lru := New(3)
+	for key := uint64(1); key <= 3; key++ {
+		lru.Set(key, 1)
+	}
+	lru.Get(1) // 2 is now the least recently used entry
+	lru.Set(4, 1)
+	checkList(t, lru)
+
+	if v := lru.Get(2); v != 0 {
+		t.Fatal("least recently used entry was not evicted")
+	}
+	for _, key := range []uint64{1, 3, 4} {
+		if v := lru.Get(key); v != 1 {
+			t.Fatalf("entry %d was evicted", key)
+		}
+	}
+
+	// Range starts with the least recently used entry
+	var keys []uint64
+	lru.Range(func(key uint64, value uint32) {
+		keys = append(keys, key)
+	})
+	if fmt.Sprint(keys) != "[1 3 4]" {
+		t.Fatalf("Range returned the keys %v, expected [1 3 4]", keys)
+	}
+}
+
+func TestShardCapacity(t *testing.T) {
+	for _, test := range []struct{ capacity, shards int }{
+		{2, 1}, {2, 2}, {10, 4}, {1000, 8}, {1001, 16}, {1023, 64},
+	} {
+		lru := NewWithOptions(test.capacity, Options{Shards: test.shards})
+		total := 0
+		for i := range lru.shards {
+			capacity := lru.shards[i].capacity
+			if capacity < 1 {
+				t.Fatalf("%v: shard %d has capacity %d", test, i, capacity)
+			}
+			total += capacity
+		}
+		if total != test.capacity {
+			t.Fatalf("%v: total capacity of the shards is %d", test, total)
+		}
+
+		for key := uint64(0); key < uint64(10*test.capacity); key++ {
+			lru.Set(key, uint32(key))
+		}
+		if n := lru.Len(); n > test.capacity {
+			t.Fatalf("%v: cache has %d entries, exceeding the capacity", test, n)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Fatal("no panic for a capacity of 1")
+		}
+	}()
+	New(1)
+}
+
+func TestShards(t *testing.T) {
+	lru := NewWithOptions(1000, Options{Shards: 6})
+	if n := len(lru.shards); n != 8 {
+		t.Fatalf("cache has %d shards, should be rounded up to 8", n)
+	}
+
+	for key := uint64(0); key < 10000; key++ {
+		lru.Set(key, uint32(key))
+	}
+	checkList(t, lru)
+	if n := lru.Len(); n > 1000 {
+		t.Fatalf("cache has %d entries, exceeding the capacity", n)
+	}
+
+	// sequential keys must be spread over all shards
+	for i := range lru.shards {
+		if len(lru.shards[i].cache) == 0 {
+			t.Fatalf("shard %d is empty", i)
+		}
+	}
+
+	// the most recently set key must still be present
+	if v := lru.Get(9999); v != 9999 {
+		t.Fatalf("value is %d, should be 9999", v)
+	}
+}
+
+func TestTTL(t *testing.T) {
+	lru := NewWithOptions(10, Options{TTL: time.Minute})
+	var now int64
+	lru.now = func() int64 { return now }
+
+	lru.Set(1337, 42)
+	lru.Set(1338, 42)
+
+	now += int64(30 * time.Second)
+	if !lru.SetIfGreater(1338, 43) {
+		t.Fatal("greater value was not set")
+	}
+
+	// 1337 expired, 1338 was renewed 30s ago
+	now += int64(45 * time.Second)
+	if v := lru.Get(1337); v != 0 {
+		t.Fatalf("value of expired entry is %d, should be 0", v)
+	}
+	if v := lru.Get(1338); v != 43 {
+		t.Fatalf("value of renewed entry is %d, should be 43", v)
+	}
+	checkList(t, lru)
+
+	// an expired entry is treated like a missing one
+	now += int64(time.Minute)
+	if !lru.SetIfGreater(1338, 1) {
+		t.Fatal("value for expired entry was not set")
+	}
+}
+
+func TestNoEvict(t *testing.T) {
+	lru := NewWithOptions(2, Options{TTL: time.Minute, NoEvict: true})
+	var now int64
+	lru.now = func() int64 { return now }
+
+	if !lru.SetIfGreater(1, 1) || !lru.SetIfGreater(2, 1) {
+		t.Fatal("new keys were refused")
+	}
+	// the full cache refuses new keys instead of evicting any
+	if lru.SetIfGreater(3, 1) {
+		t.Fatal("new key was accepted by the full cache")
+	}
+	if lru.SetIfGreater(1, 1) {
+		t.Fatal("existing key was accepted again")
+	}
+	if v := lru.Get(1); v != 1 {
+		t.Fatalf("value of key 1 is %d, should still be 1", v)
+	}
+
+	// once entries expired, they make room for new keys
+	now += int64(2 * time.Minute)
+	if !lru.SetIfGreater(3, 1) {
+		t.Fatal("new key was refused after entries expired")
+	}
+	checkList(t, lru)
+	if stats := lru.Stats(); stats.Refusals != 1 || stats.Evictions != 0 {
+		t.Fatalf("stats are %+v, expected 1 refusal and no evictions", stats)
+	}
+}
+
+func TestStats(t *testing.T) {
+	lru := NewWithOptions(2, Options{TTL: time.Minute})
+	var now int64
+	lru.now = func() int64 { return now }
+
+	lru.Set(1, 1) // miss
+	lru.Set(2, 1) // miss
+	lru.Get(1)    // hit
+	lru.Set(3, 1) // miss, evicts 2
+	lru.Get(2)    // miss
+	now += int64(2 * time.Minute)
+	lru.Get(1) // miss, expired
+
+	expected := Stats{
+		Len:         1,
+		Hits:        1,
+		Misses:      5,
+		Evictions:   1,
+		Expirations: 1,
+	}
+	if stats := lru.Stats(); stats != expected {
+		t.Fatalf("stats are %+v, expected %+v", stats, expected)
+	}
+}
+
+const benchmarkCapacity = 1 << 20
+
+func newFilledLRU(shards int) *LRU {
+	lru := NewWithOptions(benchmarkCapacity, Options{Shards: shards})
+	for key := uint64(0); key < benchmarkCapacity; key++ {
+		lru.Set(key, 1)
+	}
+	return lru
+}
+
+func benchmarkSetIfGreater(b *testing.B, shards int) {
+	lru := newFilledLRU(shards)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		for value := uint32(2); pb.Next(); value++ {
+			// a mix of hits and misses, which cause evictions
+			lru.SetIfGreater(uint64(rng.Int63n(2*benchmarkCapacity)), value)
+		}
+	})
+}
+
+func BenchmarkSetIfGreater1M(b *testing.B)         { benchmarkSetIfGreater(b, 1) }
+func BenchmarkSetIfGreater1M16Shards(b *testing.B) { benchmarkSetIfGreater(b, 16) }
+
+func BenchmarkGet1M(b *testing.B) {
+	lru := newFilledLRU(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rng := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			lru.Get(uint64(rng.Int63n(benchmarkCapacity)))
+		}
+	})
+}
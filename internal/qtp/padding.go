@@ -0,0 +1,87 @@
+package qtp
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"time"
+)
+
+// coverInterval is the mean interval between two cover frames.
+const coverInterval = 100 * time.Millisecond
+
+// SetPadding makes the writer append a padding frame of random length up to max
+// bytes to every frame, so that the sizes of the written frames do not reveal
+// the sizes of the tunneled writes. Close frames are preceded by the padding
+// instead, as nothing may follow them. A max of 0 disables padding.
+func (w *Writer) SetPadding(max int) {
+	if max > MaxPayload {
+		max = MaxPayload
+	}
+	w.lock.Lock()
+	w.maxPadding = max
+	w.lock.Unlock()
+}
+
+// StartCover starts sending padding frames at a rate of about rate bytes per
+// second while no other frames are written, so that idle periods can not be
+// told apart from periods with little traffic.
+// The cover traffic stops when the writer is closed or a write fails.
+func (w *Writer) StartCover(rate int) {
+	if rate <= 0 {
+		return
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.closed || w.stopCover != nil {
+		return
+	}
+	w.stopCover = make(chan struct{})
+	go w.cover(rate, w.stopCover)
+}
+
+func (w *Writer) cover(rate int, stop <-chan struct{}) {
+	for {
+		// randomize the intervals to avoid a regular pattern
+		jitter, err := randN(int(coverInterval))
+		if err != nil {
+			return
+		}
+		interval := coverInterval/2 + time.Duration(jitter)
+		timer := time.NewTimer(interval)
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		w.lock.Lock()
+		if w.closed {
+			w.lock.Unlock()
+			return
+		}
+		if time.Since(w.lastWrite) >= interval {
+			size := int(int64(rate) * int64(interval) / int64(time.Second))
+			if size > MaxPayload {
+				size = MaxPayload
+			}
+			_, err = w.w.Write(appendFrame(nil, FramePadding, make([]byte, size)))
+		}
+		w.lock.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// randN returns a uniformly distributed random number in [0, n).
+func randN(n int) (int, error) {
+	if n <= 1 {
+		return 0, nil
+	}
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return 0, err
+	}
+	return int(binary.BigEndian.Uint64(b[:]) % uint64(n)), nil
+}
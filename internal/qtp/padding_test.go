@@ -0,0 +1,118 @@
+package qtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+type countingReader struct {
+	rd io.Reader
+	n  int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.rd.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestPadding(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetPadding(100)
+
+	var data []byte
+	for i := 0; i < 100; i++ {
+		chunk := bytes.Repeat([]byte{byte(i)}, i)
+		data = append(data, chunk...)
+		if _, err := w.Write(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close(CloseNormal)
+
+	// 100 data frames and a close frame without any padding
+	unpadded := len(data) + 101*headerLen + 1
+	if buf.Len() <= unpadded {
+		t.Fatalf("wrote %d bytes, expected padding on top of %d bytes", buf.Len(), unpadded)
+	}
+
+	r := NewReader(bufio.NewReader(&buf))
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %x, expected %x", got, data)
+	}
+	if reason, closed := r.Reason(); !closed || reason != CloseNormal {
+		t.Fatalf("reader has close reason %d (closed: %v), expected %d", reason, closed, CloseNormal)
+	}
+}
+
+func TestPaddedClose(t *testing.T) {
+	sizes := make(map[int]bool)
+	for i := 0; i < 20; i++ {
+		var buf bytes.Buffer
+		w := NewWriter(&buf)
+		w.SetPadding(100)
+		w.Close(CloseProtocolError)
+		sizes[buf.Len()] = true
+
+		// the padding precedes the close frame, after which nothing is read
+		r := NewReader(bufio.NewReader(&buf))
+		if _, err := ioutil.ReadAll(r); err != nil {
+			t.Fatal(err)
+		}
+		if reason, closed := r.Reason(); !closed || reason != CloseProtocolError {
+			t.Fatalf("reader has close reason %d (closed: %v), expected %d", reason, closed, CloseProtocolError)
+		}
+		if buf.Len() != 0 {
+			t.Fatalf("%d bytes follow the close frame", buf.Len())
+		}
+	}
+	if len(sizes) < 2 {
+		t.Fatal("close frames are not padded")
+	}
+}
+
+func TestCover(t *testing.T) {
+	pr, pw := io.Pipe()
+	counter := &countingReader{rd: pr}
+	done := make(chan []byte)
+	go func() {
+		got, err := ioutil.ReadAll(NewReader(bufio.NewReader(counter)))
+		if err != nil {
+			t.Error(err)
+		}
+		done <- got
+	}()
+
+	w := NewWriter(pw)
+	w.StartCover(10000)
+	if _, err := w.Write([]byte("idle")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * coverInterval)
+	if _, err := w.Write([]byte("busy")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(CloseNormal); err != nil {
+		t.Fatal(err)
+	}
+	pw.Close()
+
+	got := <-done
+	if string(got) != "idlebusy" {
+		t.Fatalf("read %q, expected %q", got, "idlebusy")
+	}
+	// at least 2 cover frames of at least 500 bytes each
+	if counter.n < 1000 {
+		t.Fatalf("read %d bytes, expected cover traffic", counter.n)
+	}
+
+}
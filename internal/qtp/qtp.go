@@ -0,0 +1,330 @@
+// Package qtp implements the stream framing of version 0.2 of the quictun
+// protocol (QTP).
+//
+// Every tunnel stream is a sequence of frames, each consisting of a 1 byte
+// type, a 2 byte payload length in big endian byte order and the payload.
+// The client starts a stream with a request frame, to which the server answers
+// with a reply frame. Then both send data frames, until they signal the end of
+// their direction with a close frame carrying the reason, after which they close
+// their side of the stream. Frames of unknown types are ignored.
+//
+// Optionally, frames are followed by padding frames and padding frames are sent
+// as cover traffic while the stream is idle, see Writer.SetPadding and
+// Writer.StartCover.
+package qtp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/quictun/internal/socks"
+)
+
+// Frame types
+const (
+	FrameData    = 0x00
+	FrameRequest = 0x01
+	FrameReply   = 0x02
+	FrameClose   = 0x03
+	FramePadding = 0x04
+)
+
+// Close reasons
+const (
+	CloseNormal        = 0x00 // the sender has no more data
+	CloseError         = 0x01 // the connection of the sender failed or was reset
+	CloseIdleTimeout   = 0x02 // the connection was idle for too long
+	CloseProtocolError = 0x03 // the peer violated the protocol
+)
+
+// Metadata keys of requests
+const (
+	metaUserTag     = 0x01 // string
+	metaPriority    = 0x02 // 1 byte
+	metaIdleTimeout = 0x03 // 4 byte, in seconds
+)
+
+const (
+	headerLen = 3
+
+	// MaxPayload is the max payload length of a frame.
+	MaxPayload = 1<<16 - 1
+)
+
+var (
+	ErrUnexpectedFrame = errors.New("unexpected frame type")
+	ErrInvalidFrame    = errors.New("invalid frame payload")
+)
+
+// WriteFrame writes a frame of the given type. The payload must not be longer
+// than MaxPayload.
+func WriteFrame(w io.Writer, typ byte, payload []byte) error {
+	if len(payload) > MaxPayload {
+		return ErrInvalidFrame
+	}
+	_, err := w.Write(appendFrame(nil, typ, payload))
+	return err
+}
+
+func appendFrame(b []byte, typ byte, payload []byte) []byte {
+	var header [headerLen]byte
+	header[0] = typ
+	binary.BigEndian.PutUint16(header[1:], uint16(len(payload)))
+	b = append(b, header[:]...)
+	return append(b, payload...)
+}
+
+// ReadFrame reads the next frame.
+func ReadFrame(rd *bufio.Reader) (typ byte, payload []byte, err error) {
+	var header [headerLen]byte
+	if _, err = io.ReadFull(rd, header[:]); err != nil {
+		return 0, nil, err
+	}
+	payload = make([]byte, binary.BigEndian.Uint16(header[1:]))
+	if _, err = io.ReadFull(rd, payload); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return header[0], payload, err
+}
+
+// Request is the payload of a request frame.
+type Request struct {
+	Dest socks.Addr // destination address
+
+	// optional metadata
+	UserTag     string        // tag for logging and accounting
+	Priority    byte          // traffic class
+	IdleTimeout time.Duration // timeout after which an idle connection is closed
+}
+
+// Marshal encodes the request. The destination address is followed by the
+// metadata as key, length, value triples.
+func (r *Request) Marshal() []byte {
+	b := append([]byte(nil), r.Dest...)
+	if r.UserTag != "" {
+		tag := r.UserTag
+		if len(tag) > 255 {
+			tag = tag[:255]
+		}
+		b = append(b, metaUserTag, byte(len(tag)))
+		b = append(b, tag...)
+	}
+	if r.Priority != 0 {
+		b = append(b, metaPriority, 1, r.Priority)
+	}
+	if r.IdleTimeout > 0 {
+		var timeout [4]byte
+		binary.BigEndian.PutUint32(timeout[:], uint32(r.IdleTimeout/time.Second))
+		b = append(b, metaIdleTimeout, 4)
+		b = append(b, timeout[:]...)
+	}
+	return b
+}
+
+// ParseRequest decodes a request. Unknown metadata is ignored.
+func ParseRequest(b []byte) (*Request, error) {
+	dest, err := socks.ParseAddr(b)
+	if err != nil {
+		return nil, ErrInvalidFrame
+	}
+	r := &Request{Dest: dest}
+	for b = b[len(dest):]; len(b) > 0; {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return nil, ErrInvalidFrame
+		}
+		key, value := b[0], b[2:2+int(b[1])]
+		b = b[2+len(value):]
+		switch key {
+		case metaUserTag:
+			r.UserTag = string(value)
+		case metaPriority:
+			if len(value) != 1 {
+				return nil, ErrInvalidFrame
+			}
+			r.Priority = value[0]
+		case metaIdleTimeout:
+			if len(value) != 4 {
+				return nil, ErrInvalidFrame
+			}
+			r.IdleTimeout = time.Duration(binary.BigEndian.Uint32(value)) * time.Second
+		}
+	}
+	return r, nil
+}
+
+// Reply is the payload of a reply frame.
+type Reply struct {
+	Status byte       // SOCKS status code
+	Bound  socks.Addr // address the server bound to connect, may be nil
+}
+
+// Marshal encodes the reply.
+func (r *Reply) Marshal() []byte {
+	return append([]byte{r.Status}, r.Bound...)
+}
+
+// ParseReply decodes a reply.
+func ParseReply(b []byte) (*Reply, error) {
+	if len(b) < 1 {
+		return nil, ErrInvalidFrame
+	}
+	r := &Reply{Status: b[0]}
+	if len(b) > 1 {
+		bound, err := socks.ParseAddr(b[1:])
+		if err != nil {
+			return nil, ErrInvalidFrame
+		}
+		r.Bound = bound
+	}
+	return r, nil
+}
+
+// Writer writes data frames. It is safe for concurrent use.
+type Writer struct {
+	w io.Writer
+
+	lock       sync.Mutex
+	maxPadding int
+	lastWrite  time.Time
+	closed     bool
+	stopCover  chan struct{}
+}
+
+// NewWriter returns a writer writing frames to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// WriteFrame writes a frame of the given type.
+func (w *Writer) WriteFrame(typ byte, payload []byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writeFrame(typ, payload)
+}
+
+// writeFrame writes a frame followed by padding, or preceded by it in case of
+// a close frame. The lock must be held.
+func (w *Writer) writeFrame(typ byte, payload []byte) error {
+	if len(payload) > MaxPayload {
+		return ErrInvalidFrame
+	}
+	var frame []byte
+	if w.maxPadding > 0 {
+		n, err := randN(w.maxPadding + 1)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			frame = appendFrame(frame, FramePadding, make([]byte, n))
+		}
+	}
+	if typ == FrameClose {
+		frame = append(frame, appendFrame(nil, typ, payload)...)
+	} else {
+		frame = append(appendFrame(nil, typ, payload), frame...)
+	}
+	w.lastWrite = time.Now()
+	_, err := w.w.Write(frame)
+	return err
+}
+
+// Write writes p in data frames.
+func (w *Writer) Write(p []byte) (n int, err error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > MaxPayload {
+			chunk = chunk[:MaxPayload]
+		}
+		if err = w.writeFrame(FrameData, chunk); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close writes a close frame with the given reason and stops the cover traffic.
+// No frames must be written afterwards.
+func (w *Writer) Close(reason byte) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.closed = true
+	if w.stopCover != nil {
+		close(w.stopCover)
+	}
+	return w.writeFrame(FrameClose, []byte{reason})
+}
+
+// Reader reads the payload of data frames.
+type Reader struct {
+	rd        *bufio.Reader
+	remaining int // remaining payload of the current data frame
+
+	closed bool
+	reason byte
+}
+
+// NewReader returns a reader reading frames from rd.
+func NewReader(rd *bufio.Reader) *Reader {
+	return &Reader{rd: rd}
+}
+
+// Read reads data. It returns io.EOF once a close frame was received, and
+// io.ErrUnexpectedEOF if the stream ended without one.
+func (r *Reader) Read(p []byte) (int, error) {
+	for r.remaining == 0 {
+		if r.closed {
+			return 0, io.EOF
+		}
+		var header [headerLen]byte
+		if _, err := io.ReadFull(r.rd, header[:]); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		length := int(binary.BigEndian.Uint16(header[1:]))
+		switch header[0] {
+		case FrameData:
+			r.remaining = length
+		case FrameClose:
+			payload := make([]byte, length)
+			if _, err := io.ReadFull(r.rd, payload); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+			if length > 0 {
+				r.reason = payload[0]
+			}
+			r.closed = true
+		case FrameRequest, FrameReply:
+			return 0, ErrUnexpectedFrame
+		default:
+			// skip padding frames and frames of unknown types
+			if _, err := r.rd.Discard(length); err != nil {
+				return 0, io.ErrUnexpectedEOF
+			}
+		}
+	}
+
+	if len(p) > r.remaining {
+		p = p[:r.remaining]
+	}
+	n, err := r.rd.Read(p)
+	r.remaining -= n
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Reason returns the reason of the close frame, if one was received.
+func (r *Reader) Reason() (reason byte, closed bool) {
+	return r.reason, r.closed
+}
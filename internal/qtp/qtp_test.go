@@ -0,0 +1,141 @@
+package qtp
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/quictun/internal/socks"
+)
+
+func TestRequest(t *testing.T) {
+	req := &Request{
+		Dest:        socks.NewIPAddr(net.IPv4(192, 0, 2, 1), 443),
+		UserTag:     "alice",
+		Priority:    2,
+		IdleTimeout: 90 * time.Second,
+	}
+	b := req.Marshal()
+
+	parsed, err := ParseRequest(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, req) {
+		t.Fatalf("parsed request is %+v, expected %+v", parsed, req)
+	}
+
+	// unknown metadata is ignored
+	parsed, err = ParseRequest(append(b, 0xFF, 2, 'h', 'i'))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(parsed, req) {
+		t.Fatalf("parsed request is %+v, expected %+v", parsed, req)
+	}
+
+	invalid := [][]byte{
+		nil,
+		b[:3],                            // truncated address
+		append(b, metaUserTag, 5, 'a'),   // truncated value
+		append(b, metaPriority, 2, 1, 2), // wrong length
+	}
+	for _, b := range invalid {
+		if _, err := ParseRequest(b); err != ErrInvalidFrame {
+			t.Errorf("expected ErrInvalidFrame for %x, got %v", b, err)
+		}
+	}
+}
+
+func TestReply(t *testing.T) {
+	for _, reply := range []*Reply{
+		{Status: 5},
+		{Status: 0, Bound: socks.NewIPAddr(net.ParseIP("2001:db8::1"), 50000)},
+	} {
+		parsed, err := ParseReply(reply.Marshal())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, reply) {
+			t.Fatalf("parsed reply is %+v, expected %+v", parsed, reply)
+		}
+	}
+	if _, err := ParseReply([]byte{0, 1, 2}); err != ErrInvalidFrame {
+		t.Fatalf("expected ErrInvalidFrame, got %v", err)
+	}
+}
+
+func TestReadWrite(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	data := bytes.Repeat([]byte("0123456789"), MaxPayload/5)
+	if err := w.WriteFrame(FrameReply, []byte{0}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[:MaxPayload+10]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.WriteFrame(0x7F, []byte("unknown")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data[MaxPayload+10:]); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(CloseIdleTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	rd := bufio.NewReader(&buf)
+	typ, payload, err := ReadFrame(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if typ != FrameReply || !bytes.Equal(payload, []byte{0}) {
+		t.Fatalf("read frame %d %x, expected reply frame", typ, payload)
+	}
+
+	r := NewReader(rd)
+	if _, closed := r.Reason(); closed {
+		t.Fatal("reader is closed before reading the close frame")
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("read %d bytes of data, expected %d", len(got), len(data))
+	}
+	if reason, closed := r.Reason(); !closed || reason != CloseIdleTimeout {
+		t.Fatalf("reader has close reason %d (closed: %v), expected %d", reason, closed, CloseIdleTimeout)
+	}
+}
+
+func TestReadErrors(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.Write([]byte("data"))
+	truncated := buf.Bytes()[:buf.Len()-1]
+
+	// the stream ends without a close frame
+	r := NewReader(bufio.NewReader(bytes.NewReader(buf.Bytes())))
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+	r = NewReader(bufio.NewReader(bytes.NewReader(truncated)))
+	if _, err := ioutil.ReadAll(r); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for truncated frame, got %v", err)
+	}
+
+	// request frames are only allowed at the start
+	buf.Reset()
+	w.WriteFrame(FrameRequest, nil)
+	r = NewReader(bufio.NewReader(&buf))
+	if _, err := ioutil.ReadAll(r); err != ErrUnexpectedFrame {
+		t.Fatalf("expected ErrUnexpectedFrame, got %v", err)
+	}
+}
@@ -0,0 +1,378 @@
+// Package redis implements a sequence cache backed by a key-value store
+// speaking the Redis protocol (RESP), which can be shared by multiple server
+// instances.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"strconv"
+	"time"
+)
+
+const (
+	// number of idle connections kept open
+	maxIdleConns = 8
+
+	// max number of attempts of a compare-and-set transaction
+	maxRetries = 64
+)
+
+var (
+	// ErrConflict is returned if a compare-and-set transaction repeatedly
+	// failed because the key was modified concurrently.
+	ErrConflict = errors.New("redis: too many conflicting transactions")
+
+	errProtocol = errors.New("redis: protocol error")
+)
+
+// Error is an error reply sent by the server.
+type Error string
+
+func (e Error) Error() string {
+	return "redis: " + string(e)
+}
+
+// Cache is a cache for client sequence numbers backed by a Redis-protocol
+// store. Concurrent access is synchronized.
+//
+// Every modification is performed as an optimistic transaction
+// (WATCH/MULTI/EXEC), so that concurrent modifications, possibly by other
+// server instances, can not get lost. Entries expire after the configured
+// expiry duration, which limits the size of the store.
+type Cache struct {
+	addr      string
+	keyPrefix string
+	expiry    time.Duration
+
+	// DialTimeout is the timeout for establishing connections to the store.
+	DialTimeout time.Duration
+
+	// Timeout is the timeout for sending a command and reading its reply.
+	// Connections on which a command timed out are closed, so that a stalled
+	// store can not block callers forever.
+	Timeout time.Duration
+
+	// Password is sent with the AUTH command on every new connection, if set.
+	// Username is only sent with it if set as well, for stores with ACLs.
+	Username string
+	Password string
+
+	idle chan *conn
+}
+
+// New creates a new cache using the store at the given address.
+// All keys are prefixed with keyPrefix. Entries expire after the given expiry
+// duration, which must be at least one millisecond.
+func New(addr, keyPrefix string, expiry time.Duration) *Cache {
+	if expiry < time.Millisecond {
+		panic("expiry must be at least 1ms")
+	}
+	return &Cache{
+		addr:        addr,
+		keyPrefix:   keyPrefix,
+		expiry:      expiry,
+		DialTimeout: 5 * time.Second,
+		Timeout:     2 * time.Second,
+		idle:        make(chan *conn, maxIdleConns),
+	}
+}
+
+// Set sets the value for the given key and returns the previous value.
+// If the store can not be reached, Set returns the maximum value, so that a
+// sequence number is never mistakenly accepted.
+func (c *Cache) Set(key uint64, value uint32) (old uint32) {
+	old, _, err := c.compareAndSet(key, func(uint32) (uint32, bool) {
+		return value, true
+	})
+	if err != nil {
+		fmt.Println("sequence cache:", err)
+		return math.MaxUint32
+	}
+	return old
+}
+
+// SetIfGreater sets the value for the given key only if it is greater than the
+// current value and reports whether it did so.
+// If the store can not be reached, false is returned.
+func (c *Cache) SetIfGreater(key uint64, value uint32) bool {
+	_, ok, err := c.compareAndSet(key, func(old uint32) (uint32, bool) {
+		return value, value > old
+	})
+	if err != nil {
+		fmt.Println("sequence cache:", err)
+		return false
+	}
+	return ok
+}
+
+// Get returns the current value for the given key.
+// If no value for the given key exists or the store can not be reached, 0 is
+// returned.
+func (c *Cache) Get(key uint64) (value uint32) {
+	cn, err := c.get()
+	if err != nil {
+		fmt.Println("sequence cache:", err)
+		return 0
+	}
+	value, err = cn.getValue(c.key(key))
+	c.put(cn, err)
+	if err != nil {
+		fmt.Println("sequence cache:", err)
+		return 0
+	}
+	return value
+}
+
+// Close closes all idle connections to the store.
+func (c *Cache) Close() error {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// compareAndSet atomically replaces the value for the given key by the value
+// returned by update, if update returns true. The old value is returned, as
+// well as whether the value was replaced.
+func (c *Cache) compareAndSet(key uint64, update func(old uint32) (uint32, bool)) (old uint32, ok bool, err error) {
+	k := c.key(key)
+	expiry := strconv.FormatInt(int64(c.expiry/time.Millisecond), 10)
+
+	cn, err := c.get()
+	if err != nil {
+		return 0, false, err
+	}
+	defer func() { c.put(cn, err) }()
+
+	for i := 0; i < maxRetries; i++ {
+		if _, err = cn.do("WATCH", k); err != nil {
+			return 0, false, err
+		}
+		if old, err = cn.getValue(k); err != nil {
+			return 0, false, err
+		}
+		value, ok := update(old)
+		if !ok {
+			_, err = cn.do("UNWATCH")
+			return old, false, err
+		}
+
+		// the transaction is only executed if the key was not modified since
+		// the WATCH command
+		if _, err = cn.do("MULTI"); err != nil {
+			return 0, false, err
+		}
+		if _, err = cn.do("SET", k, strconv.FormatUint(uint64(value), 10), "PX", expiry); err != nil {
+			return 0, false, err
+		}
+		reply, err := cn.do("EXEC")
+		if err != nil {
+			return 0, false, err
+		}
+		if reply != nil {
+			return old, true, nil
+		}
+
+		// the key was modified concurrently, back off and try again
+		time.Sleep(backoff(i))
+	}
+	return 0, false, ErrConflict
+}
+
+// backoff returns a randomized, exponentially increasing delay for the given
+// attempt, which reduces the likelihood of repeated conflicts.
+func backoff(attempt int) time.Duration {
+	max := 50 * time.Microsecond << uint(attempt)
+	if max > 10*time.Millisecond {
+		max = 10 * time.Millisecond
+	}
+	return time.Duration(rand.Int63n(int64(max)))
+}
+
+func (c *Cache) key(key uint64) string {
+	return fmt.Sprintf("%s%016X", c.keyPrefix, key)
+}
+
+// get returns an idle connection or dials a new one.
+func (c *Cache) get() (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	nc, err := net.DialTimeout("tcp", c.addr, c.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{
+		Conn:    nc,
+		rd:      bufio.NewReader(nc),
+		wr:      bufio.NewWriter(nc),
+		timeout: c.Timeout,
+	}
+	if c.Password != "" {
+		args := []string{"AUTH", c.Password}
+		if c.Username != "" {
+			args = []string{"AUTH", c.Username, c.Password}
+		}
+		if _, err = cn.do(args...); err != nil {
+			cn.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+// put returns the connection to the idle pool. Connections on which an error
+// other than an error reply occurred are closed instead, as their state is
+// unknown.
+func (c *Cache) put(cn *conn, err error) {
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			cn.Close()
+			return
+		}
+		// make sure no transaction or watched key is left behind
+		for _, cmd := range []string{"DISCARD", "UNWATCH"} {
+			if _, err = cn.do(cmd); err != nil {
+				if _, ok := err.(Error); !ok {
+					cn.Close()
+					return
+				}
+			}
+		}
+	}
+	select {
+	case c.idle <- cn:
+	default:
+		cn.Close()
+	}
+}
+
+// conn is a connection to the store.
+type conn struct {
+	net.Conn
+	rd      *bufio.Reader
+	wr      *bufio.Writer
+	timeout time.Duration
+}
+
+// do sends a command and reads the reply within the timeout of the
+// connection.
+func (cn *conn) do(args ...string) (interface{}, error) {
+	if cn.timeout > 0 {
+		if err := cn.SetDeadline(time.Now().Add(cn.timeout)); err != nil {
+			return nil, err
+		}
+	}
+	fmt.Fprintf(cn.wr, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(cn.wr, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if err := cn.wr.Flush(); err != nil {
+		return nil, err
+	}
+	return readReply(cn.rd)
+}
+
+// getValue returns the value stored for the given key, or 0 if none exists.
+func (cn *conn) getValue(key string) (uint32, error) {
+	reply, err := cn.do("GET", key)
+	if err != nil {
+		return 0, err
+	}
+	switch v := reply.(type) {
+	case nil:
+		return 0, nil
+	case []byte:
+		value, err := strconv.ParseUint(string(v), 10, 32)
+		if err != nil {
+			return 0, errProtocol
+		}
+		return uint32(value), nil
+	default:
+		return 0, errProtocol
+	}
+}
+
+// readReply reads a single RESP reply. Depending on the type, the reply is
+// returned as string (simple string), int64 (integer), []byte (bulk string) or
+// []interface{} (array). Null replies are returned as nil. Error replies are
+// returned as an error of type Error.
+func readReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errProtocol
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, Error(line[1:])
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, errProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, errProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		buf := make([]byte, n+2)
+		if _, err = io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < -1 {
+			return nil, errProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		array := make([]interface{}, n)
+		for i := range array {
+			// error replies within an array are not fatal
+			if array[i], err = readReply(rd); err != nil {
+				if _, ok := err.(Error); !ok {
+					return nil, err
+				}
+				array[i] = err
+			}
+		}
+		return array, nil
+	default:
+		return nil, errProtocol
+	}
+}
+
+func readLine(rd *bufio.Reader) (string, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", errProtocol
+	}
+	return line[:len(line)-2], nil
+}
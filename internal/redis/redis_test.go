@@ -0,0 +1,468 @@
+package redis
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeServer is a minimal in-process stand-in for a Redis server, supporting
+// just the commands used by the cache.
+type fakeServer struct {
+	ln net.Listener
+
+	lock     sync.Mutex
+	password string // required with AUTH, if set
+	values   map[string]fakeValue
+	versions map[string]uint64 // incremented on every modification of a key
+}
+
+type fakeValue struct {
+	value   string
+	expires time.Time
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeServer{
+		ln:       ln,
+		values:   make(map[string]fakeValue),
+		versions: make(map[string]uint64),
+	}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) Addr() string { return s.ln.Addr().String() }
+func (s *fakeServer) Close()       { s.ln.Close() }
+
+func (s *fakeServer) serve(c net.Conn) {
+	defer c.Close()
+	rd := bufio.NewReader(c)
+	wr := bufio.NewWriter(c)
+
+	var watched map[string]uint64
+	var queued [][]string
+	inMulti := false
+	s.lock.Lock()
+	authenticated := s.password == ""
+	s.lock.Unlock()
+
+	for {
+		args, err := readCommand(rd)
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(args[0])
+
+		if cmd == "AUTH" {
+			s.lock.Lock()
+			authenticated = args[len(args)-1] == s.password
+			s.lock.Unlock()
+			if authenticated {
+				wr.WriteString("+OK\r\n")
+			} else {
+				wr.WriteString("-WRONGPASS invalid username-password pair\r\n")
+			}
+			wr.Flush()
+			continue
+		}
+		if !authenticated {
+			wr.WriteString("-NOAUTH Authentication required.\r\n")
+			wr.Flush()
+			continue
+		}
+
+		if inMulti && cmd != "EXEC" && cmd != "DISCARD" {
+			queued = append(queued, args)
+			wr.WriteString("+QUEUED\r\n")
+			wr.Flush()
+			continue
+		}
+
+		switch cmd {
+		case "WATCH":
+			if watched == nil {
+				watched = make(map[string]uint64)
+			}
+			s.lock.Lock()
+			for _, key := range args[1:] {
+				watched[key] = s.versions[key]
+			}
+			s.lock.Unlock()
+			wr.WriteString("+OK\r\n")
+		case "UNWATCH":
+			watched = nil
+			wr.WriteString("+OK\r\n")
+		case "MULTI":
+			inMulti = true
+			wr.WriteString("+OK\r\n")
+		case "DISCARD":
+			if !inMulti {
+				wr.WriteString("-ERR DISCARD without MULTI\r\n")
+				break
+			}
+			inMulti, queued, watched = false, nil, nil
+			wr.WriteString("+OK\r\n")
+		case "EXEC":
+			if !inMulti {
+				wr.WriteString("-ERR EXEC without MULTI\r\n")
+				break
+			}
+			s.lock.Lock()
+			aborted := false
+			for key, version := range watched {
+				if s.versions[key] != version {
+					aborted = true
+				}
+			}
+			if aborted {
+				wr.WriteString("*-1\r\n")
+			} else {
+				fmt.Fprintf(wr, "*%d\r\n", len(queued))
+				for _, args := range queued {
+					wr.WriteString(s.exec(args))
+				}
+			}
+			s.lock.Unlock()
+			inMulti, queued, watched = false, nil, nil
+		default:
+			s.lock.Lock()
+			wr.WriteString(s.exec(args))
+			s.lock.Unlock()
+		}
+		wr.Flush()
+	}
+}
+
+// exec executes a simple command and returns the encoded reply.
+// s.lock must be held.
+func (s *fakeServer) exec(args []string) string {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		return "+PONG\r\n"
+	case "GET":
+		v, ok := s.values[args[1]]
+		if !ok || (!v.expires.IsZero() && time.Now().After(v.expires)) {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(v.value), v.value)
+	case "SET":
+		v := fakeValue{value: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, err := strconv.Atoi(args[4])
+			if err != nil {
+				return "-ERR value is not an integer or out of range\r\n"
+			}
+			v.expires = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.values[args[1]] = v
+		s.versions[args[1]]++
+		return "+OK\r\n"
+	default:
+		return "-ERR unknown command '" + args[0] + "'\r\n"
+	}
+}
+
+func readCommand(rd *bufio.Reader) ([]string, error) {
+	line, err := readLine(rd)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[0] != '*' {
+		return nil, errProtocol
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 1 {
+		return nil, errProtocol
+	}
+	args := make([]string, n)
+	for i := range args {
+		reply, err := readReply(rd)
+		if err != nil {
+			return nil, err
+		}
+		arg, ok := reply.([]byte)
+		if !ok {
+			return nil, errProtocol
+		}
+		args[i] = string(arg)
+	}
+	return args, nil
+}
+
+func TestSetGet(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	c := New(s.Addr(), "quictun:", time.Minute)
+	defer c.Close()
+
+	if v := c.Get(1337); v != 0 {
+		t.Fatalf("value for new key is %d, should be 0", v)
+	}
+	if old := c.Set(1337, 42); old != 0 {
+		t.Fatalf("old value for new key is %d, should be 0", old)
+	}
+	if old := c.Set(1337, 43); old != 42 {
+		t.Fatalf("old value for existing key is %d, should be 42", old)
+	}
+	if v := c.Get(1337); v != 43 {
+		t.Fatalf("value is %d, should be 43", v)
+	}
+	if v := c.Get(1338); v != 0 {
+		t.Fatalf("value for other key is %d, should be 0", v)
+	}
+
+	// keys are stored with the configured prefix
+	s.lock.Lock()
+	_, ok := s.values["quictun:0000000000000539"]
+	s.lock.Unlock()
+	if !ok {
+		t.Fatal("key is not stored with the configured prefix")
+	}
+}
+
+func TestSetIfGreater(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	c := New(s.Addr(), "", time.Minute)
+	defer c.Close()
+
+	if !c.SetIfGreater(1337, 42) {
+		t.Fatal("value for new key was not set")
+	}
+	if c.SetIfGreater(1337, 41) {
+		t.Fatal("smaller value was set")
+	}
+	if c.SetIfGreater(1337, 42) {
+		t.Fatal("equal value was set")
+	}
+	if v := c.Get(1337); v != 42 {
+		t.Fatalf("value is %d, should still be 42", v)
+	}
+	if !c.SetIfGreater(1337, 43) {
+		t.Fatal("greater value was not set")
+	}
+}
+
+// Concurrently checked values, e.g. a request replayed on another server
+// instance, must be accepted at most once.
+func TestSetIfGreaterConcurrent(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	instances := []*Cache{
+		New(s.Addr(), "", time.Minute),
+		New(s.Addr(), "", time.Minute),
+	}
+
+	const n = 50
+	var accepted int32
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(c *Cache) {
+			defer wg.Done()
+			for v := uint32(1); v <= n; v++ {
+				if c.SetIfGreater(1337, v) {
+					atomic.AddInt32(&accepted, 1)
+				}
+			}
+		}(instances[i%len(instances)])
+	}
+	wg.Wait()
+
+	if accepted != n {
+		t.Fatalf("%d values were accepted, should be %d", accepted, n)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	c := New(s.Addr(), "", 20*time.Millisecond)
+	defer c.Close()
+
+	c.Set(1337, 42)
+	time.Sleep(50 * time.Millisecond)
+	if v := c.Get(1337); v != 0 {
+		t.Fatalf("value of expired key is %d, should be 0", v)
+	}
+}
+
+// Concurrent modifications, e.g. by multiple server instances, must not get
+// lost: Every written value must be returned as the old value of exactly one
+// other Set call, apart from the one which is written last.
+func TestConcurrentSet(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	instances := []*Cache{
+		New(s.Addr(), "", time.Minute),
+		New(s.Addr(), "", time.Minute),
+	}
+
+	const writers, writes = 4, 50
+	olds := make(chan uint32, writers*writes)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := instances[i%len(instances)]
+			for j := 0; j < writes; j++ {
+				olds <- c.Set(1337, uint32(i*writes+j+1))
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(olds)
+
+	seen := make(map[uint32]bool)
+	for old := range olds {
+		if old == math.MaxUint32 {
+			t.Fatal("Set failed")
+		}
+		if seen[old] {
+			t.Fatalf("value %d was returned as old value multiple times", old)
+		}
+		seen[old] = true
+	}
+	last := instances[0].Get(1337)
+	if seen[last] {
+		t.Fatalf("last value %d was also returned as old value", last)
+	}
+	seen[last] = true
+	for v := uint32(0); v <= writers*writes; v++ {
+		if !seen[v] {
+			t.Fatalf("value %d got lost", v)
+		}
+	}
+}
+
+func TestUnreachable(t *testing.T) {
+	s := newFakeServer(t)
+	addr := s.Addr()
+	s.Close()
+
+	c := New(addr, "", time.Minute)
+	c.DialTimeout = time.Second
+	if old := c.Set(1337, 42); old != math.MaxUint32 {
+		t.Fatalf("old value is %d, should be the max value if the store is unreachable", old)
+	}
+	if c.SetIfGreater(1337, 42) {
+		t.Fatal("value was accepted although the store is unreachable")
+	}
+}
+
+func TestReadReply(t *testing.T) {
+	tests := []struct {
+		in  string
+		out interface{}
+	}{
+		{"+OK\r\n", "OK"},
+		{":42\r\n", int64(42)},
+		{"$3\r\nfoo\r\n", []byte("foo")},
+		{"$-1\r\n", nil},
+		{"*-1\r\n", nil},
+	}
+	for _, test := range tests {
+		out, err := readReply(bufio.NewReader(strings.NewReader(test.in)))
+		if err != nil {
+			t.Fatalf("%q: %v", test.in, err)
+		}
+		if fmt.Sprintf("%#v", out) != fmt.Sprintf("%#v", test.out) {
+			t.Fatalf("%q: got %#v, expected %#v", test.in, out, test.out)
+		}
+	}
+
+	_, err := readReply(bufio.NewReader(strings.NewReader("-ERR foo\r\n")))
+	if err != Error("ERR foo") {
+		t.Fatalf("expected error reply, got %v", err)
+	}
+	_, err = readReply(bufio.NewReader(strings.NewReader("$5\r\nfoo")))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF for truncated reply, got %v", err)
+	}
+}
+
+func TestAuth(t *testing.T) {
+	s := newFakeServer(t)
+	defer s.Close()
+	s.lock.Lock()
+	s.password = "secret"
+	s.lock.Unlock()
+
+	for _, password := range []string{"", "wrong"} {
+		c := New(s.Addr(), "", time.Minute)
+		c.Password = password
+		if c.SetIfGreater(1337, 42) {
+			t.Fatalf("value was accepted with password %q", password)
+		}
+		c.Close()
+	}
+
+	c := New(s.Addr(), "", time.Minute)
+	defer c.Close()
+	c.Password = "secret"
+	if !c.SetIfGreater(1337, 42) {
+		t.Fatal("value was not accepted with the password")
+	}
+	if v := c.Get(1337); v != 42 {
+		t.Fatalf("value is %d, should be 42", v)
+	}
+}
+
+func TestTimeout(t *testing.T) {
+	// a store which accepts connections but never replies
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, c)
+		}
+	}()
+
+	c := New(ln.Addr().String(), "", time.Minute)
+	c.Timeout = 50 * time.Millisecond
+	start := time.Now()
+	if c.SetIfGreater(1337, 42) {
+		t.Fatal("value was accepted although the store stalled")
+	}
+	if old := c.Set(1337, 42); old != math.MaxUint32 {
+		t.Fatalf("old value is %d, should be the max value if the store stalled", old)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("commands took %v despite the timeout", elapsed)
+	}
+	select {
+	case <-c.idle:
+		t.Fatal("connection was kept after a timeout")
+	default:
+	}
+}
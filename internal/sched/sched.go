@@ -0,0 +1,285 @@
+// Package sched implements weighted fair queuing of writes to a shared link,
+// such as the streams of a QUIC session.
+package sched
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// MaxChunk is the max number of bytes written at once by a Writer.
+// Smaller chunks allow a finer interleaving of the flows.
+const MaxChunk = 8 << 10
+
+// idleGrace is the duration for which a flow without pending writes is still
+// considered backlogged. A flow writing continuously, e.g. copying from a
+// socket, is not backlogged between two writes, but should not lose its share.
+const idleGrace = 5 * time.Millisecond
+
+// Scheduler schedules the writes of multiple flows with weighted fair queuing,
+// specifically WF2Q+: Every write is tagged with a virtual start and finish
+// time, based on its size and the weight of its flow. The virtual time of the
+// scheduler advances with every granted write, inversely proportional to the
+// total weight of the backlogged flows. Among the writes whose start tag is not
+// after the virtual time, the one with the smallest finish tag is granted next.
+// Thus every backlogged flow gets a share of the link proportional to its
+// weight, and small writes of flows with a high weight, like interactive ones,
+// only wait for about a single write on the link.
+//
+// Only a limited number of writes is granted at once. Since a write might
+// block, e.g. because the stream is limited by flow control, a grant is revoked
+// after MaxHold, so that one blocked flow does not stall all others.
+type Scheduler struct {
+	// MaxHold is the max duration a grant is held. Defaults to 20ms.
+	MaxHold time.Duration
+
+	lock    sync.Mutex
+	vtime   float64    // virtual time
+	weights float64    // total weight of the backlogged flows
+	active  int        // number of currently granted writes
+	limit   int        // max number of concurrently granted writes
+	queue   []*request // pending writes
+	seq     uint64     // arrival counter, for FIFO order of equal tags
+}
+
+// New creates a new scheduler, which grants at most concurrency writes at once.
+func New(concurrency int) *Scheduler {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	return &Scheduler{
+		MaxHold: 20 * time.Millisecond,
+		limit:   concurrency,
+	}
+}
+
+// Flow is a sequence of writes with a weight.
+// A flow must only be used by one goroutine at once.
+type Flow struct {
+	s      *Scheduler
+	weight float64
+
+	// guarded by s.lock
+	finish   float64 // finish tag of the last write
+	backlog  int     // number of pending or granted writes
+	weighted bool    // whether the weight is included in s.weights
+	idleGen  uint64  // incremented when the backlog changes
+}
+
+// NewFlow creates a new flow with the given weight, which must be positive.
+func (s *Scheduler) NewFlow(weight int) *Flow {
+	if weight < 1 {
+		weight = 1
+	}
+	return &Flow{s: s, weight: float64(weight)}
+}
+
+type request struct {
+	f             *Flow
+	size          int
+	start, finish float64
+	seq           uint64
+	queued        bool
+	granted       chan struct{}
+}
+
+// Acquire blocks until a write of n bytes of the flow is granted.
+// The returned function must be called once the write is done.
+func (f *Flow) Acquire(n int) (release func()) {
+	return f.request(n).wait()
+}
+
+// request enqueues a write of n bytes of the flow, which is granted
+// immediately if possible.
+func (f *Flow) request(n int) *request {
+	s := f.s
+	s.lock.Lock()
+	start := f.finish
+	if s.vtime > start {
+		start = s.vtime
+	}
+	f.finish = start + float64(n)/f.weight
+	if !f.weighted {
+		s.weights += f.weight
+		f.weighted = true
+	}
+	f.backlog++
+	f.idleGen++
+
+	req := &request{
+		f:       f,
+		size:    n,
+		start:   start,
+		finish:  f.finish,
+		seq:     s.seq,
+		queued:  true,
+		granted: make(chan struct{}),
+	}
+	s.seq++
+	s.queue = append(s.queue, req)
+	s.dispatch()
+	s.lock.Unlock()
+	return req
+}
+
+// cancel withdraws the request, or releases it if it was already granted.
+func (req *request) cancel() {
+	s := req.f.s
+	s.lock.Lock()
+	if req.queued {
+		for i, r := range s.queue {
+			if r == req {
+				s.queue = append(s.queue[:i], s.queue[i+1:]...)
+				break
+			}
+		}
+		req.queued = false
+		s.done(req.f)
+		s.lock.Unlock()
+		return
+	}
+	s.lock.Unlock()
+	req.wait()()
+}
+
+// wait blocks until the request is granted.
+func (req *request) wait() (release func()) {
+	<-req.granted
+	return req.f.s.newRelease(req.f)
+}
+
+// done removes a write of the flow from its backlog.
+// s.lock must be held.
+func (s *Scheduler) done(f *Flow) {
+	f.backlog--
+	if f.backlog > 0 {
+		return
+	}
+	f.idleGen++
+	gen := f.idleGen
+	time.AfterFunc(idleGrace, func() {
+		s.lock.Lock()
+		if f.idleGen == gen && f.weighted {
+			s.weights -= f.weight
+			f.weighted = false
+		}
+		s.lock.Unlock()
+	})
+}
+
+// newRelease returns a function releasing a grant of the given flow, which is
+// called automatically after MaxHold.
+func (s *Scheduler) newRelease(f *Flow) func() {
+	var once sync.Once
+	release := func() {
+		once.Do(func() {
+			s.lock.Lock()
+			s.active--
+			s.done(f)
+			s.dispatch()
+			s.lock.Unlock()
+		})
+	}
+	timer := time.AfterFunc(s.MaxHold, release)
+	return func() {
+		timer.Stop()
+		release()
+	}
+}
+
+// dispatch grants pending writes as long as the limit allows it.
+// s.lock must be held.
+func (s *Scheduler) dispatch() {
+	for s.active < s.limit && len(s.queue) > 0 {
+		// If the link was idle, advance the virtual time to the earliest start
+		// tag, so that at least one write is eligible.
+		minStart := s.queue[0].start
+		for _, req := range s.queue[1:] {
+			if req.start < minStart {
+				minStart = req.start
+			}
+		}
+		if s.vtime < minStart {
+			s.vtime = minStart
+		}
+
+		// grant the eligible write with the smallest finish tag
+		next := -1
+		for i, req := range s.queue {
+			if req.start > s.vtime {
+				continue
+			}
+			if next < 0 || req.before(s.queue[next]) {
+				next = i
+			}
+		}
+		req := s.queue[next]
+		s.queue = append(s.queue[:next], s.queue[next+1:]...)
+		req.queued = false
+
+		s.active++
+		s.vtime += float64(req.size) / s.weights
+		close(req.granted)
+	}
+}
+
+// before reports whether the request should be granted before the other one,
+// if both are eligible.
+func (req *request) before(other *request) bool {
+	if req.finish != other.finish {
+		return req.finish < other.finish
+	}
+	return req.seq < other.seq
+}
+
+// Writer returns a writer, which writes to w in chunks of at most MaxChunk
+// bytes, each of which is scheduled as a write of the flow.
+func (f *Flow) Writer(w io.WriteCloser) io.WriteCloser {
+	return &writer{w, f}
+}
+
+type writer struct {
+	io.WriteCloser
+	f *Flow
+}
+
+// Write writes p in chunks. The next chunk is always requested before the
+// grant for the current one is released, so that the flow stays backlogged
+// from the perspective of the scheduler and gets its fair share.
+func (w *writer) Write(p []byte) (n int, err error) {
+	if len(p) == 0 {
+		// there is no chunk which would release a grant
+		return 0, nil
+	}
+	chunk := nextChunk(p)
+	req := w.f.request(len(chunk))
+	for len(chunk) > 0 {
+		release := req.wait()
+		p = p[len(chunk):]
+		next := nextChunk(p)
+		if len(next) > 0 {
+			req = w.f.request(len(next))
+		}
+
+		m, err := w.WriteCloser.Write(chunk)
+		release()
+		n += m
+		if err != nil {
+			if len(next) > 0 {
+				req.cancel()
+			}
+			return n, err
+		}
+		chunk = next
+	}
+	return n, nil
+}
+
+// nextChunk returns the next chunk of p to write.
+func nextChunk(p []byte) []byte {
+	if len(p) > MaxChunk {
+		return p[:MaxChunk]
+	}
+	return p
+}
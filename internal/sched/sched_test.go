@@ -0,0 +1,189 @@
+package sched
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// sink simulates a link, on which every write takes some time.
+type sink struct {
+	delay  time.Duration
+	onData func(p []byte)
+}
+
+func (s *sink) Write(p []byte) (int, error) {
+	time.Sleep(s.delay)
+	s.onData(p)
+	return len(p), nil
+}
+
+func (s *sink) Close() error { return nil }
+
+// Writes of an interactive flow must not queue up behind the writes of bulk
+// flows, i.e. at most the bulk write which is currently on the link may be
+// written in between. Thus the latency is bounded by the time of a single
+// chunk on the link, regardless of the number of bulk flows.
+func TestInteractiveLatency(t *testing.T) {
+	const (
+		bulkFlows    = 8
+		interactives = 20
+	)
+	s := New(1)
+
+	var bulkChunks int64
+	var interactiveChunks int64
+	link := &sink{
+		delay: time.Millisecond,
+		onData: func(p []byte) {
+			if len(p) == MaxChunk {
+				atomic.AddInt64(&bulkChunks, 1)
+			} else {
+				atomic.AddInt64(&interactiveChunks, 1)
+			}
+		},
+	}
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < bulkFlows; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := s.NewFlow(1).Writer(link)
+			buf := make([]byte, 4*MaxChunk)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w.Write(buf)
+			}
+		}()
+	}
+
+	// wait until the bulk flows are backlogged
+	for atomic.LoadInt64(&bulkChunks) < 2*bulkFlows {
+		time.Sleep(time.Millisecond)
+	}
+
+	// count the bulk chunks written between the start of an interactive write
+	// and its arrival on the link
+	var interactiveLatency []int64
+	var before int64
+	w := s.NewFlow(16).Writer(&sink{
+		onData: func(p []byte) {
+			interactiveLatency = append(interactiveLatency, atomic.LoadInt64(&bulkChunks)-before)
+			link.onData(p)
+		},
+	})
+	for i := 0; i < interactives; i++ {
+		before = atomic.LoadInt64(&bulkChunks)
+		w.Write(make([]byte, 100))
+		time.Sleep(3 * time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+
+	for i, chunks := range interactiveLatency {
+		if chunks > 1 {
+			t.Errorf("write %d waited for %d bulk chunks, at most 1 expected", i, chunks)
+		}
+	}
+	if n := atomic.LoadInt64(&interactiveChunks); n != interactives {
+		t.Fatalf("%d interactive writes arrived, expected %d", n, interactives)
+	}
+}
+
+// Backlogged flows share the link proportionally to their weights.
+func TestWeights(t *testing.T) {
+	s := New(1)
+
+	// take a snapshot of the written bytes while both flows are backlogged
+	const limit = 512 * MaxChunk
+	var lock sync.Mutex
+	var bytes, snapshot [2]int
+	done := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i, weight := range []int{1, 3} {
+		wg.Add(1)
+		go func(i, weight int) {
+			defer wg.Done()
+			w := s.NewFlow(weight).Writer(&sink{
+				delay: 50 * time.Microsecond,
+				onData: func(p []byte) {
+					lock.Lock()
+					bytes[i] += len(p)
+					if bytes[0]+bytes[1] == limit {
+						snapshot = bytes
+						close(done)
+					}
+					lock.Unlock()
+				},
+			})
+			buf := make([]byte, 16*MaxChunk)
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				w.Write(buf)
+			}
+		}(i, weight)
+	}
+	wg.Wait()
+
+	ratio := float64(snapshot[1]) / float64(snapshot[0])
+	if ratio < 2.5 || ratio > 3.5 {
+		t.Fatalf("flows with weights 1 and 3 wrote %d and %d bytes, ratio %.2f", snapshot[0], snapshot[1], ratio)
+	}
+}
+
+// A blocked write must not stall the other flows forever.
+func TestMaxHold(t *testing.T) {
+	s := New(1)
+	s.MaxHold = 10 * time.Millisecond
+
+	blocked := make(chan struct{})
+	defer close(blocked)
+	go s.NewFlow(1).Writer(&sink{
+		onData: func(p []byte) { <-blocked },
+	}).Write(make([]byte, 1))
+	time.Sleep(time.Millisecond)
+
+	written := make(chan struct{})
+	go s.NewFlow(1).Writer(&sink{
+		onData: func(p []byte) { close(written) },
+	}).Write(make([]byte, 1))
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("write was stalled by a blocked flow")
+	}
+}
+
+// An empty write must not hold a grant, which would stall all other writes.
+func TestEmptyWrite(t *testing.T) {
+	s := New(1)
+	w := s.NewFlow(1).Writer(&sink{onData: func(p []byte) {}})
+	if n, err := w.Write(nil); n != 0 || err != nil {
+		t.Fatalf("empty write returned %d, %v", n, err)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		w.Write(make([]byte, 1))
+		s.NewFlow(1).Writer(&sink{onData: func(p []byte) {}}).Write(make([]byte, 1))
+		close(written)
+	}()
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatal("writes were stalled by an empty write")
+	}
+}
@@ -152,6 +152,12 @@ func (r Request) Cmd() byte {
 	return r[1]
 }
 
+// Reserved returns the value of the reserved field (RSV), which is 0 in plain
+// SOCKS requests.
+func (r Request) Reserved() byte {
+	return r[2]
+}
+
 func (r Request) Dest() Addr {
 	return Addr(r[3:])
 }
@@ -159,6 +165,31 @@ func (r Request) Dest() Addr {
 // Addr is a pair of IPv4, IPv6 or Domain and a port
 type Addr []byte
 
+// ParseAddr parses the address at the beginning of b.
+func ParseAddr(b []byte) (Addr, error) {
+	if len(b) < 1 {
+		return nil, io.ErrUnexpectedEOF
+	}
+	var n int
+	switch b[0] {
+	case AtypIPv4:
+		n = 1 + net.IPv4len + 2
+	case AtypDomain:
+		if len(b) < 2 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		n = 1 + 1 + int(b[1]) + 2
+	case AtypIPv6:
+		n = 1 + net.IPv6len + 2
+	default:
+		return nil, ErrAtypNotSupported
+	}
+	if len(b) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return Addr(b[:n]), nil
+}
+
 // Type returns the address type
 func (a Addr) Type() byte {
 	return a[0]
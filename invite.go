@@ -0,0 +1,195 @@
+package quictun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// An invite is a signed, expiring credential for onboarding a client without
+// creating a user on the server first. It has the form
+// "i1.<id>.<name>.<expires>.<uses>.<mac>", where id is a random 64 bit
+// number in hex, name the base64url encoded name of the user to create,
+// expires the expiry time in Unix seconds, uses the max number of clients
+// which can redeem the invite in decimal, and mac the base64url encoded
+// HMAC-SHA256 over all other fields using the invite key of the server.
+//
+// The client redeems the invite with a request carrying the InviteHeader and
+// a password it generated in the InvitePasswordHeader, before its first
+// upgrade request. The server creates a regular user for it and returns its
+// name in the InviteUserHeader. The client then authenticates with replay
+// protection tokens derived from the name and its password, while the server
+// only stores the derived key.
+const inviteVersion = "i1"
+
+const (
+	// InviteHeader is the name of the header field carrying the invite in
+	// redemption requests.
+	InviteHeader = "QTP-Invite"
+
+	// InvitePasswordHeader is the name of the header field carrying the
+	// password chosen by the client in redemption requests.
+	InvitePasswordHeader = "QTP-Password"
+
+	// InviteUserHeader is the name of the header field carrying the name of
+	// the created user in responses to redemption requests.
+	InviteUserHeader = "QTP-User"
+)
+
+// minInvitePasswordLength is the min length of passwords chosen by clients
+// redeeming invites, which are generated and thus can be long.
+const minInvitePasswordLength = 16
+
+var (
+	ErrInvalidInvite = errors.New("invite invalid")
+	ErrInviteExpired = errors.New("invite expired")
+	ErrInviteRevoked = errors.New("invite was revoked")
+	ErrInviteUsed    = errors.New("invite was already redeemed by the max number of clients")
+)
+
+// Invite is the content of an invite.
+type Invite struct {
+	// ID identifies the invite, e.g. for revoking it.
+	ID string
+
+	// Name is the name of the created user. Users redeeming invites which
+	// can be redeemed more than once get a unique suffix.
+	Name string
+
+	// Expires is the time until which the invite can be redeemed. Users
+	// created from the invite do not expire.
+	Expires time.Time
+
+	// MaxUses is the max number of clients which can redeem the invite. It
+	// must be at least 1.
+	MaxUses int
+}
+
+// inviteMAC computes the MAC of an invite.
+func inviteMAC(key []byte, fields []string) []byte {
+	mac := hmac.New(sha256.New, key)
+	writeFields(mac, fields...)
+	return mac.Sum(nil)
+}
+
+// Sign returns the invite signed with the given key. A random ID is assigned
+// to invites without one.
+func (inv *Invite) Sign(key []byte) (string, error) {
+	if inv.Name == "" {
+		return "", errors.New("invite needs a name")
+	}
+	if inv.MaxUses < 1 {
+		return "", errors.New("invite needs at least one use")
+	}
+	if inv.ID == "" {
+		var id [8]byte
+		if _, err := rand.Read(id[:]); err != nil {
+			return "", err
+		}
+		inv.ID = hex.EncodeToString(id[:])
+	}
+	fields := []string{
+		inviteVersion,
+		inv.ID,
+		base64.RawURLEncoding.EncodeToString([]byte(inv.Name)),
+		strconv.FormatInt(inv.Expires.Unix(), 10),
+		strconv.Itoa(inv.MaxUses),
+	}
+	mac := inviteMAC(key, fields)
+	return strings.Join(append(fields, base64.RawURLEncoding.EncodeToString(mac)), "."), nil
+}
+
+// ParseInvite parses an invite and verifies that it was signed with the given
+// key. Its expiry is not checked.
+func ParseInvite(key []byte, token string) (*Invite, error) {
+	fields := strings.Split(token, ".")
+	if len(fields) != 6 || fields[0] != inviteVersion {
+		return nil, ErrInvalidInvite
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(fields[5])
+	if err != nil || !hmac.Equal(mac, inviteMAC(key, fields[:5])) {
+		return nil, ErrInvalidInvite
+	}
+	name, err := base64.RawURLEncoding.DecodeString(fields[2])
+	if err != nil || len(name) == 0 {
+		return nil, ErrInvalidInvite
+	}
+	expires, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return nil, ErrInvalidInvite
+	}
+	uses, err := strconv.Atoi(fields[4])
+	if err != nil || uses < 1 {
+		return nil, ErrInvalidInvite
+	}
+	return &Invite{
+		ID:      fields[1],
+		Name:    string(name),
+		Expires: time.Unix(expires, 0),
+		MaxUses: uses,
+	}, nil
+}
+
+// InviteStore stores the users created from invites.
+type InviteStore interface {
+	// Revoked reports whether the invite with the given ID was revoked.
+	Revoked(id string) bool
+
+	// Redeem creates the user with the given token key, as derived by
+	// DeriveTokenKey, for the invite. Redeeming the same invite again for the
+	// same user and key must succeed, so that clients can retry, while other
+	// redemptions of invites which were already redeemed for MaxUses users
+	// must fail with ErrInviteUsed. Existing users, including those not
+	// created from invites, must not be replaced.
+	Redeem(inv *Invite, user string, key []byte) error
+}
+
+// IsInviteRequest returns whether the request with the given header redeems an
+// invite, which must be answered with RedeemInvite.
+func IsInviteRequest(header http.Header) bool {
+	return header.Get("Upgrade") == "" && header.Get(InviteHeader) != ""
+}
+
+// RedeemInvite verifies the invite sent by a client in a redemption request
+// and creates a user with the password sent by the client in the InviteStore.
+// It returns the name of the user, which must be sent to the client in the
+// InviteUserHeader.
+//
+// Users of invites which can be redeemed more than once are named after the
+// invite with a suffix derived from the password, so that every client gets its
+// own user.
+func (s *Server) RedeemInvite(invite, password string) (user string, err error) {
+	if s.InviteKey == nil || s.Invites == nil {
+		return "", ErrInvalidInvite
+	}
+	inv, err := ParseInvite(s.InviteKey, invite)
+	if err != nil {
+		return "", err
+	}
+	if time.Now().After(inv.Expires) {
+		return "", ErrInviteExpired
+	}
+	if s.Invites.Revoked(inv.ID) {
+		return "", ErrInviteRevoked
+	}
+	if len(password) < minInvitePasswordLength {
+		return "", ErrWrongCredentials
+	}
+
+	user = inv.Name
+	if inv.MaxUses > 1 {
+		suffix := sha256.Sum256([]byte(password))
+		user += "-" + hex.EncodeToString(suffix[:4])
+	}
+	if err = s.Invites.Redeem(inv, user, DeriveTokenKey(user, password)); err != nil {
+		return "", err
+	}
+	return user, nil
+}
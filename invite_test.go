@@ -0,0 +1,152 @@
+package quictun
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryInvites is an in-memory InviteStore.
+type memoryInvites struct {
+	revoked  map[string]bool
+	users    map[string][]byte
+	redeemed map[string][]string // users by invite ID
+}
+
+func newMemoryInvites() *memoryInvites {
+	return &memoryInvites{
+		revoked:  make(map[string]bool),
+		users:    make(map[string][]byte),
+		redeemed: make(map[string][]string),
+	}
+}
+
+func (m *memoryInvites) Revoked(id string) bool {
+	return m.revoked[id]
+}
+
+func (m *memoryInvites) Redeem(inv *Invite, user string, key []byte) error {
+	for _, prev := range m.redeemed[inv.ID] {
+		if prev == user && bytes.Equal(m.users[user], key) {
+			return nil
+		}
+	}
+	if len(m.redeemed[inv.ID]) >= inv.MaxUses {
+		return ErrInviteUsed
+	}
+	m.users[user] = key
+	m.redeemed[inv.ID] = append(m.redeemed[inv.ID], user)
+	return nil
+}
+
+func TestInvite(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	inv := &Invite{Name: "alice", Expires: time.Unix(2000000000, 0), MaxUses: 1}
+	token, err := inv.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inv.ID == "" {
+		t.Fatal("no ID assigned")
+	}
+	parsed, err := ParseInvite(key, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *parsed != *inv {
+		t.Fatalf("parsed invite %+v differs from %+v", parsed, inv)
+	}
+
+	fields := strings.Split(token, ".")
+	for name, invalid := range map[string]string{
+		"empty":          "",
+		"other key":      mustSign(t, []byte("other key"), inv),
+		"tampered name":  strings.Join(append(append(fields[:2:2], "Ym9i"), fields[3:]...), "."),
+		"more uses":      strings.Join(append(append(fields[:4:4], "100"), fields[5]), "."),
+		"unknown format": "i2" + token[2:],
+	} {
+		if _, err = ParseInvite(key, invalid); err != ErrInvalidInvite {
+			t.Errorf("%s: expected ErrInvalidInvite, got %v", name, err)
+		}
+	}
+
+	if _, err = (&Invite{Name: "alice", Expires: inv.Expires}).Sign(key); err == nil {
+		t.Error("invite without uses signed")
+	}
+}
+
+func mustSign(t *testing.T, key []byte, inv *Invite) string {
+	token, err := inv.Sign(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestRedeemInvite(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	invites := newMemoryInvites()
+	s := &Server{InviteKey: key, Invites: invites}
+	expires := time.Now().Add(time.Hour)
+	password := "0123456789abcdefghij"
+
+	single := mustSign(t, key, &Invite{Name: "alice", Expires: expires, MaxUses: 1})
+	user, err := s.RedeemInvite(single, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user != "alice" {
+		t.Fatalf("single-use invite redeemed as %q, should be alice", user)
+	}
+	if !bytes.Equal(invites.users["alice"], DeriveTokenKey("alice", password)) {
+		t.Fatal("token key of the user not stored")
+	}
+	// retries of the same client succeed, other clients fail
+	if user, err = s.RedeemInvite(single, password); err != nil || user != "alice" {
+		t.Fatalf("retry failed: %q, %v", user, err)
+	}
+	if _, err = s.RedeemInvite(single, password+"x"); err != ErrInviteUsed {
+		t.Fatalf("expected ErrInviteUsed, got %v", err)
+	}
+
+	// every client of an invite for several clients gets its own user, up to
+	// the max number of clients
+	multi := mustSign(t, key, &Invite{Name: "team", Expires: expires, MaxUses: 2})
+	first, err := s.RedeemInvite(multi, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := s.RedeemInvite(multi, password+"x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(first, "team-") || !strings.HasPrefix(second, "team-") || first == second {
+		t.Fatalf("multi-use invite redeemed as %q and %q", first, second)
+	}
+	if _, err = s.RedeemInvite(multi, password+"y"); err != ErrInviteUsed {
+		t.Fatalf("expected ErrInviteUsed for the third client, got %v", err)
+	}
+
+	revokedInvite := &Invite{Name: "bob", Expires: expires, MaxUses: 1}
+	revoked := mustSign(t, key, revokedInvite)
+	invites.revoked[revokedInvite.ID] = true
+
+	tests := []struct {
+		name     string
+		invite   string
+		password string
+		err      error
+	}{
+		{"invalid", "i1.x", password, ErrInvalidInvite},
+		{"other key", mustSign(t, []byte("other key"), &Invite{Name: "mallory", Expires: expires, MaxUses: 1}), password, ErrInvalidInvite},
+		{"expired", mustSign(t, key, &Invite{Name: "carol", Expires: time.Now().Add(-time.Second), MaxUses: 1}), password, ErrInviteExpired},
+		{"revoked", revoked, password, ErrInviteRevoked},
+		{"short password", multi, "secret", ErrWrongCredentials},
+	}
+	for _, test := range tests {
+		if _, err = s.RedeemInvite(test.invite, test.password); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+}
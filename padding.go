@@ -0,0 +1,31 @@
+package quictun
+
+import (
+	"io"
+
+	"github.com/julienschmidt/quictun/internal/qtp"
+)
+
+// Padding configures the traffic padding of QTP/0.2 streams. Padding hides the
+// sizes and the timing of the tunneled traffic within the QUIC session at the
+// cost of additional bandwidth. Both ends pad the data they send according to
+// their own configuration. Padding is stripped by the receiver, also by
+// endpoints without padding support.
+type Padding struct {
+	// Max is the max length of the random padding appended to every frame.
+	// 0 disables padding.
+	Max int
+
+	// CoverRate is the rate in bytes per second of the cover traffic, which is
+	// sent on every tunneled connection while it is idle. 0 disables cover
+	// traffic.
+	CoverRate int
+}
+
+// newWriter returns a frame writer padding frames according to the config.
+// Cover traffic must be started separately once the stream is established.
+func (p *Padding) newWriter(w io.Writer) *qtp.Writer {
+	frameWr := qtp.NewWriter(w)
+	frameWr.SetPadding(p.Max)
+	return frameWr
+}
@@ -0,0 +1,149 @@
+package quictun
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// ErrPinMismatch is returned if the certificate chain of the server contains
+// no pinned key and is not valid for the fallback to CA validation either.
+var ErrPinMismatch = errors.New("server certificate does not match any pin")
+
+// A Pin is the SHA-256 hash of the DER encoded SubjectPublicKeyInfo of a
+// certificate, like the pin-sha256 directive of HTTP Public Key Pinning
+// (RFC 7469). Pinning the key instead of the certificate keeps the pin valid
+// across certificate renewals which reuse the key.
+type Pin [sha256.Size]byte
+
+// SPKIPin returns the pin of the given certificate.
+func SPKIPin(cert *x509.Certificate) Pin {
+	return sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+}
+
+// ParsePin parses a pin encoded by Pin.String. The prefix "sha256/" may be
+// omitted.
+//
+// Pins of a certificate in a PEM file can be generated with:
+//
+//	openssl x509 -in cert.pem -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64
+func ParsePin(s string) (Pin, error) {
+	var p Pin
+	b, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, "sha256/"))
+	if err != nil {
+		return p, fmt.Errorf("invalid pin %q: %s", s, err)
+	}
+	if len(b) != len(p) {
+		return p, fmt.Errorf("invalid pin %q: not a SHA-256 hash", s)
+	}
+	copy(p[:], b)
+	return p, nil
+}
+
+// String returns the pin in the form sha256/BASE64.
+func (p Pin) String() string {
+	return "sha256/" + base64.StdEncoding.EncodeToString(p[:])
+}
+
+// pinnedTLSConfig returns a copy of the TLS config of the client, with which
+// the QUIC handshake accepts any certificate chain of the server. The chain
+// must be verified against the pins of the client with verifySession after the
+// handshake, before the session is used.
+func (c *Client) pinnedTLSConfig() *tls.Config {
+	var tlsCfg *tls.Config
+	if c.TlsCfg != nil {
+		tlsCfg = c.TlsCfg.Clone()
+	} else {
+		tlsCfg = &tls.Config{}
+	}
+	// The QUIC handshake does not call VerifyPeerCertificate, thus the
+	// default verification can not be replaced but only be skipped.
+	tlsCfg.InsecureSkipVerify = true
+	return tlsCfg
+}
+
+// verifySession verifies the certificate chain the server presented in the
+// handshake of the session with verifyPins.
+func (c *Client) verifySession(session quic.Session, serverName string) error {
+	var roots *x509.CertPool
+	if c.TlsCfg != nil {
+		roots = c.TlsCfg.RootCAs
+		if c.TlsCfg.ServerName != "" {
+			serverName = c.TlsCfg.ServerName
+		}
+	}
+	peerCerts := session.ConnectionState().PeerCertificates
+	rawCerts := make([][]byte, len(peerCerts))
+	for i, cert := range peerCerts {
+		rawCerts[i] = cert.Raw
+	}
+	return c.verifyPins(rawCerts, serverName, roots)
+}
+
+// verifyPins verifies the certificate chain of the server. The chain is valid
+// if its leaf certificate has a pinned key, or if it is a valid chain for the
+// server name up to a certificate with a pinned key. Otherwise, if PinFallback
+// is enabled, the chain must be valid according to the given roots.
+func (c *Client) verifyPins(rawCerts [][]byte, serverName string, roots *x509.CertPool) error {
+	if len(rawCerts) == 0 {
+		return errors.New("server sent no certificate")
+	}
+	chain := make([]*x509.Certificate, len(rawCerts))
+	for i, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return err
+		}
+		chain[i] = cert
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		intermediates.AddCert(cert)
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       serverName,
+		Intermediates: intermediates,
+	}
+
+	for i, cert := range chain {
+		if !c.pinned(SPKIPin(cert)) {
+			continue
+		}
+		if i == 0 {
+			// the key of the server itself is pinned
+			return nil
+		}
+		// The key of a CA is pinned. The chain must actually lead from the
+		// leaf to it, as anyone can send the certificate of the CA along.
+		opts.Roots = x509.NewCertPool()
+		opts.Roots.AddCert(cert)
+		if _, err := chain[0].Verify(opts); err == nil {
+			return nil
+		}
+	}
+
+	if !c.PinFallback {
+		return ErrPinMismatch
+	}
+	opts.Roots = roots
+	if _, err := chain[0].Verify(opts); err != nil {
+		return fmt.Errorf("%s, CA validation failed: %s", ErrPinMismatch, err)
+	}
+	return nil
+}
+
+// pinned reports whether the given pin is one of the pins of the client.
+func (c *Client) pinned(p Pin) bool {
+	for _, pin := range c.Pins {
+		if pin == p {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package quictun
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/quictun/internal/certs"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// newCert creates a certificate for the given name, which is signed by the
+// given parent or self-signed if parent is nil.
+func newCert(t *testing.T, name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if isCA {
+		template.KeyUsage = x509.KeyUsageCertSign
+	} else {
+		template.DNSNames = []string{name}
+		template.KeyUsage = x509.KeyUsageDigitalSignature
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func rawChain(certs ...*x509.Certificate) [][]byte {
+	raw := make([][]byte, len(certs))
+	for i, cert := range certs {
+		raw[i] = cert.Raw
+	}
+	return raw
+}
+
+func TestParsePin(t *testing.T) {
+	cert, _ := newCert(t, "example.com", false, nil, nil)
+	pin := SPKIPin(cert)
+	parsed, err := ParsePin(pin.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != pin {
+		t.Fatalf("parsed pin %s differs from %s", parsed, pin)
+	}
+	parsed, err = ParsePin(pin.String()[len("sha256/"):])
+	if err != nil || parsed != pin {
+		t.Fatalf("pin without prefix not parsed: %s", err)
+	}
+
+	for _, invalid := range []string{"", "sha256/", "sha256/!!!", "sha256/AAAA"} {
+		if _, err = ParsePin(invalid); err == nil {
+			t.Errorf("no error for invalid pin %q", invalid)
+		}
+	}
+}
+
+func TestVerifyPins(t *testing.T) {
+	ca, caKey := newCert(t, "CA", true, nil, nil)
+	leaf, _ := newCert(t, "example.com", false, ca, caKey)
+	selfSigned, _ := newCert(t, "example.com", false, nil, nil)
+	otherCA, otherKey := newCert(t, "Other CA", true, nil, nil)
+	otherLeaf, _ := newCert(t, "example.com", false, otherCA, otherKey)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	tests := []struct {
+		name     string
+		pins     []*x509.Certificate
+		fallback bool
+		chain    [][]byte
+		host     string
+		ok       bool
+	}{
+		{"pinned self-signed leaf", []*x509.Certificate{selfSigned}, false, rawChain(selfSigned), "example.com", true},
+		{"pinned leaf", []*x509.Certificate{leaf}, false, rawChain(leaf, ca), "example.com", true},
+		{"unpinned leaf", []*x509.Certificate{selfSigned}, false, rawChain(leaf, ca), "example.com", false},
+		{"pinned CA", []*x509.Certificate{ca}, false, rawChain(leaf, ca), "example.com", true},
+		{"pinned CA, wrong host", []*x509.Certificate{ca}, false, rawChain(leaf, ca), "example.org", false},
+		{"pinned CA appended", []*x509.Certificate{ca}, false, rawChain(otherLeaf, ca), "example.com", false},
+		{"fallback", []*x509.Certificate{selfSigned}, true, rawChain(leaf, ca), "example.com", true},
+		{"fallback, wrong host", []*x509.Certificate{selfSigned}, true, rawChain(leaf, ca), "example.org", false},
+		{"fallback, untrusted", []*x509.Certificate{selfSigned}, true, rawChain(otherLeaf, otherCA), "example.com", false},
+		{"no certificate", []*x509.Certificate{selfSigned}, true, nil, "example.com", false},
+		{"garbage", []*x509.Certificate{selfSigned}, true, [][]byte{{1, 2, 3}}, "example.com", false},
+	}
+	for _, test := range tests {
+		c := &Client{PinFallback: test.fallback}
+		for _, cert := range test.pins {
+			c.Pins = append(c.Pins, SPKIPin(cert))
+		}
+		err := c.verifyPins(test.chain, test.host, roots)
+		if test.ok && err != nil {
+			t.Errorf("%s: unexpected error: %s", test.name, err)
+		} else if !test.ok && err == nil {
+			t.Errorf("%s: chain accepted", test.name)
+		}
+	}
+}
+
+func TestPinnedTLSConfig(t *testing.T) {
+	c := &Client{TlsCfg: &tls.Config{ServerName: "example.com"}}
+	tlsCfg := c.pinnedTLSConfig()
+	if !tlsCfg.InsecureSkipVerify || tlsCfg.ServerName != "example.com" {
+		t.Fatal("default verification not skipped")
+	}
+	if c.TlsCfg.InsecureSkipVerify {
+		t.Fatal("TLS config of the client was modified")
+	}
+}
+
+// The client verifies the certificate chain the server presented in the QUIC
+// handshake against its pins, before it sends anything on the session.
+func TestConnectPinned(t *testing.T) {
+	serverCert, err := certs.SelfSigned([]string{"example.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _ := newCert(t, "example.com", false, nil, nil)
+
+	var session *mockSession
+	defer func(dial func(string, *tls.Config, *quic.Config) (quic.Session, error)) { dialAddr = dial }(dialAddr)
+	dialAddr = func(_ string, tlsCfg *tls.Config, _ *quic.Config) (quic.Session, error) {
+		if !tlsCfg.InsecureSkipVerify {
+			t.Error("QUIC handshake verifies the self-signed certificate against the CAs")
+		}
+		session = newMockSession()
+		session.state = quic.ConnectionState{
+			HandshakeComplete: true,
+			PeerCertificates:  []*x509.Certificate{serverCert.Leaf},
+		}
+		return session, nil
+	}
+
+	c := &Client{
+		TunnelAddr: "https://example.com/secret",
+		Pins:       []Pin{SPKIPin(other)},
+	}
+	if _, err = c.connect(); err != ErrPinMismatch {
+		t.Fatalf("expected ErrPinMismatch for an unpinned certificate, got %v", err)
+	}
+	if session.closeErr != ErrPinMismatch {
+		t.Fatalf("session was closed with %v, expected ErrPinMismatch", session.closeErr)
+	}
+
+	// the mock session fails to open the header stream, which is only
+	// opened once the certificate was accepted
+	c.Pins = []Pin{SPKIPin(serverCert.Leaf)}
+	if _, err = c.connect(); err == nil || !strings.Contains(err.Error(), errNotImplemented.Error()) {
+		t.Fatalf("pinned certificate was not accepted: %v", err)
+	}
+}
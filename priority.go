@@ -0,0 +1,97 @@
+package quictun
+
+import (
+	"errors"
+	"net"
+	"strconv"
+)
+
+// Priority is the traffic class of a tunneled connection.
+// The client classifies every connection and sends the class to the server in
+// the reserved field of the SOCKS request, which is 0 in plain SOCKS requests.
+// Both ends schedule the writes to the streams of a session with weighted fair
+// queuing, using the weight of the class. Thus interactive connections, like
+// SSH, are not slowed down by bulk transfers in the same session.
+type Priority byte
+
+// Priority classes
+const (
+	PriorityNormal Priority = iota
+	PriorityInteractive
+	PriorityBulk
+)
+
+var priorityNames = [...]string{
+	PriorityNormal:      "normal",
+	PriorityInteractive: "interactive",
+	PriorityBulk:        "bulk",
+}
+
+var priorityWeights = [...]int{
+	PriorityNormal:      4,
+	PriorityInteractive: 16,
+	PriorityBulk:        1,
+}
+
+var ErrUnknownPriority = errors.New("unknown priority class")
+
+// ParsePriority returns the priority class with the given name.
+func ParsePriority(name string) (Priority, error) {
+	for p, pName := range priorityNames {
+		if name == pName {
+			return Priority(p), nil
+		}
+	}
+	return PriorityNormal, ErrUnknownPriority
+}
+
+func (p Priority) String() string {
+	if int(p) < len(priorityNames) {
+		return priorityNames[p]
+	}
+	return "priority(" + strconv.Itoa(int(p)) + ")"
+}
+
+// weight returns the scheduling weight of the class. Unknown classes are
+// treated as PriorityNormal.
+func (p Priority) weight() int {
+	if int(p) < len(priorityWeights) {
+		return priorityWeights[p]
+	}
+	return priorityWeights[PriorityNormal]
+}
+
+// DefaultPortPriorities are the priority classes of connections to well-known
+// ports of interactive protocols.
+var DefaultPortPriorities = map[int]Priority{
+	22:   PriorityInteractive, // SSH
+	23:   PriorityInteractive, // Telnet
+	53:   PriorityInteractive, // DNS
+	3389: PriorityInteractive, // RDP
+	5900: PriorityInteractive, // VNC
+}
+
+// ClassifyByPort returns a classifier, which classifies connections by their
+// destination port. Connections to other ports are of PriorityNormal.
+func ClassifyByPort(ports map[int]Priority) func(host string, port int) Priority {
+	return func(host string, port int) Priority {
+		if p, ok := ports[port]; ok {
+			return p
+		}
+		return PriorityNormal
+	}
+}
+
+// classify returns the priority class of a connection to the given address.
+func (c *Client) classify(dest string) Priority {
+	host, portStr, err := net.SplitHostPort(dest)
+	if err != nil {
+		return PriorityNormal
+	}
+	port, _ := strconv.Atoi(portStr)
+	classify := c.Classify
+	if classify == nil {
+		classify = ClassifyByPort(DefaultPortPriorities)
+	}
+	return classify(host, port)
+}
@@ -0,0 +1,133 @@
+package quictun
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/hpack"
+)
+
+// A HeaderProfile controls how the client encodes its requests, so that they
+// resemble the requests of a particular browser on the wire. The header block
+// of a request differs between clients in the set of header fields, their order
+// and values, the HPACK representations and the priority parameters of the
+// HEADERS frame.
+type HeaderProfile struct {
+	// PseudoHeaderOrder is the order of the pseudo-header fields :method,
+	// :authority, :scheme and :path.
+	PseudoHeaderOrder []string
+
+	// UnindexedPath encodes the :path pseudo-header field without indexing
+	// unless its value is in the static table, like Chrome does.
+	UnindexedPath bool
+
+	// Headers are the header fields in the order in which they are sent.
+	// A field with a value is sent with this value unless the request sets it
+	// or omits it with withoutHeaders; fields with an empty value only
+	// determine the position of the field if the request sets it. Sensitive
+	// fields are encoded as never indexed, all other fields with incremental
+	// indexing.
+	// Header fields of the request which are not listed are sent afterwards,
+	// ordered by name.
+	// Names are sent as given, which must be lower case for HTTP/2. Names of
+	// fields set in the request are always sent in lower case.
+	Headers []hpack.HeaderField
+
+	// Priority are the priority parameters of the HEADERS frames.
+	Priority http2.PriorityParam
+}
+
+// ProfileChrome resembles the navigation requests of Chrome 140 on Windows.
+var ProfileChrome = &HeaderProfile{
+	PseudoHeaderOrder: []string{":method", ":authority", ":scheme", ":path"},
+	UnindexedPath:     true,
+	Headers: []hpack.HeaderField{
+		{Name: "content-length"},
+		{Name: "authorization"},
+		{Name: "sec-ch-ua", Value: `"Chromium";v="140", "Not=A?Brand";v="24", "Google Chrome";v="140"`},
+		{Name: "sec-ch-ua-mobile", Value: "?0"},
+		{Name: "sec-ch-ua-platform", Value: `"Windows"`},
+		{Name: "upgrade-insecure-requests", Value: "1"},
+		{Name: "user-agent", Value: "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Safari/537.36"},
+		{Name: "accept", Value: "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"},
+		{Name: "sec-fetch-site", Value: "none"},
+		{Name: "sec-fetch-mode", Value: "navigate"},
+		{Name: "sec-fetch-user", Value: "?1"},
+		{Name: "sec-fetch-dest", Value: "document"},
+		{Name: "referer"},
+		{Name: "accept-encoding", Value: "gzip, deflate, br, zstd"},
+		{Name: "accept-language", Value: "en-US,en;q=0.9"},
+		{Name: "cookie"},
+		{Name: "priority", Value: "u=0, i"},
+	},
+	Priority: http2.PriorityParam{Exclusive: true, Weight: 0xff},
+}
+
+// ProfileChromeAndroid resembles the navigation requests of Chrome 140 on
+// Android. Its user agent and client hints are those Chrome on Android sends,
+// while the order and encoding of the fields equal those of ProfileChrome, as
+// they were not checked against a request of Chrome on an Android device.
+var ProfileChromeAndroid = &HeaderProfile{
+	PseudoHeaderOrder: ProfileChrome.PseudoHeaderOrder,
+	UnindexedPath:     true,
+	Headers: []hpack.HeaderField{
+		{Name: "content-length"},
+		{Name: "authorization"},
+		{Name: "sec-ch-ua", Value: `"Chromium";v="140", "Not=A?Brand";v="24", "Google Chrome";v="140"`},
+		{Name: "sec-ch-ua-mobile", Value: "?1"},
+		{Name: "sec-ch-ua-platform", Value: `"Android"`},
+		{Name: "upgrade-insecure-requests", Value: "1"},
+		{Name: "user-agent", Value: "Mozilla/5.0 (Linux; Android 10; K) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/140.0.0.0 Mobile Safari/537.36"},
+		{Name: "accept", Value: "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,image/apng,*/*;q=0.8,application/signed-exchange;v=b3;q=0.7"},
+		{Name: "sec-fetch-site", Value: "none"},
+		{Name: "sec-fetch-mode", Value: "navigate"},
+		{Name: "sec-fetch-user", Value: "?1"},
+		{Name: "sec-fetch-dest", Value: "document"},
+		{Name: "referer"},
+		{Name: "accept-encoding", Value: "gzip, deflate, br, zstd"},
+		{Name: "accept-language", Value: "en-US,en;q=0.9"},
+		{Name: "cookie"},
+		{Name: "priority", Value: "u=0, i"},
+	},
+	Priority: ProfileChrome.Priority,
+}
+
+// Profiles are the available header profiles by name.
+var Profiles = map[string]*HeaderProfile{
+	"chrome":         ProfileChrome,
+	"chrome-android": ProfileChromeAndroid,
+}
+
+// profile returns the header profile of the client.
+func (c *Client) profile() *HeaderProfile {
+	if c.Profile != nil {
+		return c.Profile
+	}
+	return ProfileChrome
+}
+
+type omittedHeadersKey struct{}
+
+// withoutHeaders returns a shallow copy of the request for which the header
+// fields with the given names are not sent, neither the defaults of the
+// profile nor the fields of the request, e.g. the fields a browser only sends
+// for navigation requests.
+func withoutHeaders(req *http.Request, names ...string) *http.Request {
+	omitted := make(map[string]bool, len(names))
+	for name := range omittedHeaders(req) {
+		omitted[name] = true
+	}
+	for _, name := range names {
+		omitted[strings.ToLower(name)] = true
+	}
+	return req.WithContext(context.WithValue(req.Context(), omittedHeadersKey{}, omitted))
+}
+
+// omittedHeaders returns the lower case names of the header fields which are
+// not sent for the request.
+func omittedHeaders(req *http.Request) map[string]bool {
+	omitted, _ := req.Context().Value(omittedHeadersKey{}).(map[string]bool)
+	return omitted
+}
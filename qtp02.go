@@ -0,0 +1,286 @@
+package quictun
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/julienschmidt/quictun/internal/qtp"
+	"github.com/julienschmidt/quictun/internal/sched"
+	"github.com/julienschmidt/quictun/internal/socks"
+
+	quic "github.com/lucas-clemente/quic-go"
+)
+
+// tunnelQTP02 tunnels a SOCKS connection over a stream in the framing of
+// QTP/0.2. The SOCKS client only gets a reply once the server replied, so that
+// it learns whether the connection succeeded.
+func (c *Client) tunnelQTP02(local net.Conn, localRd *bufio.Reader, req socks.Request, stream quic.Stream, streamWr io.WriteCloser, prio Priority) {
+	request := qtp.Request{
+		Dest:        append(socks.Addr(nil), req.Dest()...),
+		UserTag:     c.UserTag,
+		Priority:    byte(prio),
+		IdleTimeout: c.IdleTimeout,
+	}
+	frameWr := c.Padding.newWriter(streamWr)
+	_, err := localRd.Discard(len(req))
+	if err == nil {
+		err = frameWr.WriteFrame(qtp.FrameRequest, request.Marshal())
+	}
+	if err != nil {
+		fmt.Println(err)
+		stream.Reset(err)
+		local.Close()
+		return
+	}
+
+	// wait for the reply of the server and forward it to the SOCKS client
+	streamRd := bufio.NewReader(stream)
+	reply, err := readReply(streamRd)
+	if err != nil {
+		fmt.Println("reply:", err)
+		socks.SendReply(local, socks.StatusGeneralFailure, nil)
+		stream.Reset(err)
+		local.Close()
+		return
+	}
+	if err = socks.SendReply(local, reply.Status, reply.Bound); err != nil || reply.Status != socks.StatusSucceeded {
+		frameWr.Close(qtp.CloseNormal)
+		stream.Close()
+		local.Close()
+		return
+	}
+
+	fmt.Println("Start proxying...", prio)
+	frameWr.StartCover(c.Padding.CoverRate)
+	done := make(chan struct{})
+	go func() {
+		// recv from stream and send to local
+		frameRd := qtp.NewReader(streamRd)
+		_, err := io.Copy(local, frameRd)
+		reason, _ := frameRd.Reason()
+		if err != nil || reason != qtp.CloseNormal {
+			fmt.Println("stream closed:", closeReasonString(reason, err))
+			resetConn(local)
+		}
+		local.Close()
+		close(done)
+	}()
+	// recv from local and send to stream
+	closeStream(stream, frameWr, copyErr(io.Copy(frameWr, localRd)), false)
+	<-done
+}
+
+func readReply(rd *bufio.Reader) (*qtp.Reply, error) {
+	typ, payload, err := qtp.ReadFrame(rd)
+	if err != nil {
+		return nil, err
+	}
+	if typ != qtp.FrameReply {
+		return nil, qtp.ErrUnexpectedFrame
+	}
+	return qtp.ParseReply(payload)
+}
+
+// handleQTP02 handles a stream in the framing of QTP/0.2, see
+// Client.tunnelQTP02.
+func (s *Server) handleQTP02(stream quic.Stream, streamRd *bufio.Reader, acl ACL, scheduler *sched.Scheduler) {
+	streamID := stream.StreamID()
+	typ, payload, err := qtp.ReadFrame(streamRd)
+	if err == nil && typ != qtp.FrameRequest {
+		err = qtp.ErrUnexpectedFrame
+	}
+	var req *qtp.Request
+	if err == nil {
+		req, err = qtp.ParseRequest(payload)
+	}
+	if err != nil {
+		fmt.Println("stream", streamID, ":", err)
+		s.Padding.newWriter(stream).Close(qtp.CloseProtocolError)
+		stream.Close()
+		return
+	}
+	if req.UserTag != "" {
+		fmt.Println("stream", streamID, "user tag:", req.UserTag)
+	}
+
+	prio := Priority(req.Priority)
+	frameWr := s.Padding.newWriter(scheduler.NewFlow(prio.weight()).Writer(stream))
+
+	remote, err := s.dial(req.Dest.String(), acl)
+	if err != nil {
+		fmt.Printf("stream %d: %#v\n", streamID, err)
+		reply := qtp.Reply{Status: dialStatus(err)}
+		frameWr.WriteFrame(qtp.FrameReply, reply.Marshal())
+		frameWr.Close(qtp.CloseError)
+		stream.Close()
+		return
+	}
+	reply := qtp.Reply{Status: socks.StatusSucceeded}
+	if addr, ok := remote.LocalAddr().(*net.TCPAddr); ok {
+		reply.Bound = socks.NewIPAddr(addr.IP, addr.Port)
+	}
+	if err = frameWr.WriteFrame(qtp.FrameReply, reply.Marshal()); err != nil {
+		fmt.Println("stream", streamID, ":", err)
+		stream.Reset(err)
+		remote.Close()
+		return
+	}
+
+	var idle *idleConn
+	if req.IdleTimeout > 0 {
+		idle = newIdleConn(remote, req.IdleTimeout)
+		remote = idle
+	}
+
+	fmt.Println("Start proxying...", prio)
+	frameWr.StartCover(s.Padding.CoverRate)
+	done := make(chan struct{})
+	go func() {
+		// recv from stream and send to remote
+		frameRd := qtp.NewReader(streamRd)
+		_, err := io.Copy(remote, frameRd)
+		reason, _ := frameRd.Reason()
+		if err != nil || reason != qtp.CloseNormal {
+			fmt.Println("stream", streamID, "closed:", closeReasonString(reason, err))
+			resetConn(remote)
+		}
+		remote.Close()
+		close(done)
+	}()
+	// recv from remote and send to stream
+	err = copyErr(io.Copy(frameWr, remote))
+	closeStream(stream, frameWr, err, idle != nil && idle.expired())
+	<-done
+}
+
+func copyErr(_ int64, err error) error {
+	return err
+}
+
+// closeStream signals the end of the data sent on the stream with the reason
+// for the given error and closes the stream for writing.
+func closeStream(stream quic.Stream, frameWr *qtp.Writer, err error, idleTimeout bool) {
+	reason := byte(qtp.CloseNormal)
+	switch {
+	case idleTimeout:
+		reason = qtp.CloseIdleTimeout
+	case err == qtp.ErrUnexpectedFrame:
+		reason = qtp.CloseProtocolError
+	case err != nil:
+		reason = qtp.CloseError
+	}
+	frameWr.Close(reason)
+	stream.Close()
+}
+
+func closeReasonString(reason byte, err error) string {
+	if err != nil {
+		return err.Error()
+	}
+	switch reason {
+	case qtp.CloseError:
+		return "connection error"
+	case qtp.CloseIdleTimeout:
+		return "idle timeout"
+	case qtp.CloseProtocolError:
+		return "protocol error"
+	default:
+		return fmt.Sprintf("reason %d", reason)
+	}
+}
+
+// resetConn makes closing a TCP connection abort it, so that errors of the
+// tunneled connection are propagated.
+func resetConn(conn net.Conn) {
+	if idle, ok := conn.(*idleConn); ok {
+		conn = idle.Conn
+	}
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetLinger(0)
+	}
+}
+
+// dialStatus returns the SOCKS status for a dial error.
+func dialStatus(err error) byte {
+	if err == ErrNotAllowed {
+		return socks.StatusConnectionNotAllowed
+	}
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return socks.StatusHostUnreachable
+	}
+	switch err := err.(type) {
+	case *net.DNSError:
+		return socks.StatusHostUnreachable
+	case *net.OpError:
+		if sysErr, ok := err.Err.(*os.SyscallError); ok {
+			switch sysErr.Err {
+			case syscall.ECONNREFUSED:
+				return socks.StatusConnectionRefused
+			case syscall.ENETUNREACH:
+				return socks.StatusNetworkUnreachable
+			case syscall.EHOSTUNREACH:
+				return socks.StatusHostUnreachable
+			}
+		}
+		if _, ok := err.Err.(*net.DNSError); ok {
+			return socks.StatusHostUnreachable
+		}
+	}
+	return socks.StatusGeneralFailure
+}
+
+// idleConn closes the connection once there was no traffic in either direction
+// for the timeout.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	timer   *time.Timer
+
+	lock      sync.Mutex
+	isExpired bool
+}
+
+func newIdleConn(conn net.Conn, timeout time.Duration) *idleConn {
+	c := &idleConn{Conn: conn, timeout: timeout}
+	c.timer = time.AfterFunc(timeout, func() {
+		c.lock.Lock()
+		c.isExpired = true
+		c.lock.Unlock()
+		conn.Close()
+	})
+	return c
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.timer.Reset(c.timeout)
+	}
+	return n, err
+}
+
+func (c *idleConn) Close() error {
+	c.timer.Stop()
+	return c.Conn.Close()
+}
+
+// expired returns whether the connection was closed due to the idle timeout.
+func (c *idleConn) expired() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.isExpired
+}
@@ -4,9 +4,10 @@ import (
 	"bytes"
 	"encoding/base64"
 	"fmt"
-	"log"
+	"io"
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -82,14 +83,16 @@ func actualContentLength(req *http.Request) int64 {
 }
 
 type requestWriter struct {
-	headerStream quic.Stream
+	headerStream io.Writer
+	profile      *HeaderProfile
 	henc         *hpack.Encoder
 	hbuf         bytes.Buffer // HPACK encoder writes into this
 }
 
-func newRequestWriter(headerStream quic.Stream) *requestWriter {
+func newRequestWriter(headerStream io.Writer, profile *HeaderProfile) *requestWriter {
 	rw := &requestWriter{
 		headerStream: headerStream,
+		profile:      profile,
 	}
 	rw.henc = hpack.NewEncoder(&rw.hbuf)
 	return rw
@@ -104,8 +107,7 @@ func (rw *requestWriter) WriteRequest(req *http.Request, dataStreamID quic.Strea
 
 	buf, err := rw.encodeHeaders(req, actualContentLength(req))
 	if err != nil {
-		log.Fatal("Failed to encode request headers: ", err)
-		return err
+		return fmt.Errorf("failed to encode request headers: %s", err)
 	}
 	h2framer := http2.NewFramer(rw.headerStream, nil)
 	return h2framer.WriteHeaders(http2.HeadersFrameParam{
@@ -113,10 +115,12 @@ func (rw *requestWriter) WriteRequest(req *http.Request, dataStreamID quic.Strea
 		EndHeaders:    true,
 		EndStream:     endStream,
 		BlockFragment: buf,
-		Priority:      http2.PriorityParam{Weight: 0xff},
+		Priority:      rw.profile.Priority,
 	})
 }
 
+// encodeHeaders encodes the header block of the request according to the
+// header profile.
 func (w *requestWriter) encodeHeaders(req *http.Request, contentLength int64) ([]byte, error) {
 	w.hbuf.Reset()
 
@@ -161,53 +165,133 @@ func (w *requestWriter) encodeHeaders(req *http.Request, contentLength int64) ([
 	// target URI (the path-absolute production and optionally a '?' character
 	// followed by the query production (see Sections 3.3 and 3.4 of
 	// [RFC3986]).
-	w.writeHeader(":authority", host)
-	w.writeHeader(":method", req.Method)
-	w.writeHeader(":path", path)
-	w.writeHeader(":scheme", req.URL.Scheme)
+	pseudo := map[string]string{
+		":authority": host,
+		":method":    req.Method,
+		":path":      path,
+		":scheme":    req.URL.Scheme,
+	}
+	for _, name := range w.profile.PseudoHeaderOrder {
+		hf := hpack.HeaderField{Name: name, Value: pseudo[name]}
+		if name == ":path" && w.profile.UnindexedPath {
+			w.writeUnindexedPath(hf)
+		} else {
+			w.writeHeader(hf)
+		}
+	}
 
-	var didUA bool
+	// collect the header fields of the request
+	omitted := omittedHeaders(req)
+	fields := make(map[string][]string, len(req.Header)+1)
 	for k, vv := range req.Header {
 		lowKey := strings.ToLower(k)
+		if omitted[lowKey] {
+			continue
+		}
 		switch lowKey {
 		case "host", "content-length":
 			// Host is :authority, already sent.
 			// Content-Length is automatic, set below.
 			continue
-		case "connection", "proxy-connection", "transfer-encoding", "upgrade", "keep-alive":
+		case "connection", "proxy-connection", "transfer-encoding", "keep-alive":
 			// Per 8.1.2.2 Connection-Specific Header
 			// Fields, don't send connection-specific
 			// fields. We have already checked if any
 			// are error-worthy so just ignore the rest.
+			// The Upgrade field is sent nevertheless, as the
+			// server needs it for the protocol upgrade.
 			continue
 		case "user-agent":
 			// Match Go's http1 behavior: at most one
-			// User-Agent. If set to nil or empty string,
-			// then omit it. Otherwise if not mentioned,
-			// include the default (below).
-			didUA = true
-			if len(vv) < 1 {
-				continue
-			}
-			vv = vv[:1]
-			if vv[0] == "" {
-				continue
+			// User-Agent.
+			if len(vv) > 1 {
+				vv = vv[:1]
 			}
 		}
-		for _, v := range vv {
-			w.writeHeader(lowKey, v)
-		}
+		fields[lowKey] = append(fields[lowKey], vv...)
 	}
 	if shouldSendReqContentLength(req.Method, contentLength) {
-		w.writeHeader("content-length", strconv.FormatInt(contentLength, 10))
+		fields["content-length"] = []string{strconv.FormatInt(contentLength, 10)}
+	}
+
+	// fields in the order of the profile, with the defaults of the profile
+	for _, hf := range w.profile.Headers {
+		lowKey := strings.ToLower(hf.Name)
+		vv, ok := fields[lowKey]
+		if !ok {
+			if hf.Value != "" && !omitted[lowKey] {
+				w.writeHeader(hf)
+			}
+			continue
+		}
+		delete(fields, lowKey)
+		w.writeFields(lowKey, vv, hf.Sensitive)
+	}
+
+	// remaining fields of the request
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
 	}
-	if !didUA {
-		panic("user agent info is missing")
+	sort.Strings(names)
+	for _, name := range names {
+		w.writeFields(name, fields[name], false)
 	}
 	return w.hbuf.Bytes(), nil
 }
 
-func (w *requestWriter) writeHeader(name, value string) {
-	//fmt.Printf("http2: Transport encoding header %q = %q\n", name, value)
-	w.henc.WriteField(hpack.HeaderField{Name: name, Value: value})
+// writeFields writes a header field with the given values.
+func (w *requestWriter) writeFields(name string, values []string, sensitive bool) {
+	for _, v := range values {
+		w.writeHeader(hpack.HeaderField{Name: name, Value: v, Sensitive: sensitive})
+	}
+}
+
+// writeUnindexedPath writes the :path pseudo-header field as a literal without
+// indexing, which the HPACK encoder does not support, unless the value is in
+// the static table.
+func (w *requestWriter) writeUnindexedPath(hf hpack.HeaderField) {
+	if hf.Value == "/" || hf.Value == "/index.html" {
+		w.writeHeader(hf)
+		return
+	}
+	// literal header field without indexing, indexed name :path (RFC 7541,
+	// section 6.2.2)
+	w.hbuf.Write(appendHpackString([]byte{0x04}, hf.Value))
+}
+
+// appendHpackString appends the string literal s to dst, Huffman encoded if
+// it is shorter.
+func appendHpackString(dst []byte, s string) []byte {
+	huffmanLength := hpack.HuffmanEncodeLength(s)
+	if huffmanLength < uint64(len(s)) {
+		first := len(dst)
+		dst = appendHpackInt(dst, 7, huffmanLength)
+		dst = hpack.AppendHuffmanString(dst, s)
+		dst[first] |= 0x80
+	} else {
+		dst = appendHpackInt(dst, 7, uint64(len(s)))
+		dst = append(dst, s...)
+	}
+	return dst
+}
+
+// appendHpackInt appends i with an n-bit prefix to dst (RFC 7541, section
+// 5.1).
+func appendHpackInt(dst []byte, n byte, i uint64) []byte {
+	k := uint64((1 << n) - 1)
+	if i < k {
+		return append(dst, byte(i))
+	}
+	dst = append(dst, byte(k))
+	i -= k
+	for ; i >= 128; i >>= 7 {
+		dst = append(dst, byte(0x80|(i&0x7f)))
+	}
+	return append(dst, byte(i))
+}
+
+func (w *requestWriter) writeHeader(hf hpack.HeaderField) {
+	//fmt.Printf("http2: Transport encoding header %q = %q\n", hf.Name, hf.Value)
+	w.henc.WriteField(hf)
 }
@@ -0,0 +1,184 @@
+package quictun
+
+import (
+	"bytes"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/net/http2/hpack"
+)
+
+func newUpgradeRequest(t *testing.T) *http.Request {
+	req, err := http.NewRequest("GET", "https://example.com/secret", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "QTP/0.2, QTP/0.1")
+	req.Header.Set("QTP", "0123456789ABCDEF00000001")
+	return req
+}
+
+func decodeHeaders(t *testing.T, block []byte) []hpack.HeaderField {
+	fields, err := hpack.NewDecoder(4096, nil).DecodeFull(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// The golden files are regression snapshots of the HEADERS frames the profiles
+// encode for a navigation request to https://www.example.com/. They are written
+// by the test itself with -update and thus only detect unintended changes of
+// the encoding. Whether a profile matches the browser it resembles must be
+// checked against a capture of the browser when the profile is changed.
+func TestHeaderProfileGolden(t *testing.T) {
+	for name, profile := range Profiles {
+		req, err := http.NewRequest("GET", "https://www.example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var frame bytes.Buffer
+		if err := newRequestWriter(&frame, profile).WriteRequest(req, 1, true); err != nil {
+			t.Fatal(err)
+		}
+		got := hex.Dump(frame.Bytes())
+
+		golden := filepath.Join("testdata", "profile_"+name+".golden")
+		if *update {
+			if err := ioutil.WriteFile(golden, []byte(got), 0644); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(golden)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != string(want) {
+			t.Errorf("%s: HEADERS frame differs from %s:\n%s", name, golden, got)
+		}
+	}
+}
+
+func TestHeaderProfileOrder(t *testing.T) {
+	rw := newRequestWriter(nil, ProfileChrome)
+	req := newUpgradeRequest(t)
+	req.Header.Set("Authorization", "Bearer token")
+	block, err := rw.encodeHeaders(req, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, hf := range decodeHeaders(t, block) {
+		names = append(names, hf.Name)
+	}
+	expected := []string{
+		":method", ":authority", ":scheme", ":path", "authorization",
+		"sec-ch-ua", "sec-ch-ua-mobile", "sec-ch-ua-platform", "upgrade-insecure-requests", "user-agent", "accept",
+		"sec-fetch-site", "sec-fetch-mode", "sec-fetch-user", "sec-fetch-dest",
+		"accept-encoding", "accept-language", "priority",
+		// fields not in the profile, ordered by name
+		"qtp", "upgrade",
+	}
+	if !reflect.DeepEqual(names, expected) {
+		t.Fatalf("header fields are\n%v\nexpected\n%v", names, expected)
+	}
+
+	// request fields override the defaults of the profile, omitted ones
+	// are not sent at all, empty ones are sent empty
+	req = newUpgradeRequest(t)
+	req.Header.Set("User-Agent", "test")
+	req.Header.Set("Accept", "")
+	req.Header.Set("Sec-Fetch-Dest", "style")
+	req = withoutHeaders(req, "Accept-Language", "sec-fetch-dest")
+	rw = newRequestWriter(nil, ProfileChrome)
+	block, err = rw.encodeHeaders(req, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fields := make(map[string]string)
+	for _, hf := range decodeHeaders(t, block) {
+		fields[hf.Name] = hf.Value
+	}
+	if ua := fields["user-agent"]; ua != "test" {
+		t.Errorf("user-agent is %q, expected %q", ua, "test")
+	}
+	if accept, ok := fields["accept"]; !ok || accept != "" {
+		t.Errorf("accept is %q, expected it to be sent empty", accept)
+	}
+	for _, name := range []string{"accept-language", "sec-fetch-dest"} {
+		if _, ok := fields[name]; ok {
+			t.Errorf("omitted %s was sent", name)
+		}
+	}
+}
+
+func TestUnindexedPath(t *testing.T) {
+	rw := newRequestWriter(nil, ProfileChrome)
+	dec := hpack.NewDecoder(4096, nil)
+	literal := appendHpackString([]byte{0x04}, "/secret")
+	for i := 0; i < 2; i++ {
+		block, err := rw.encodeHeaders(newUpgradeRequest(t), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(block, literal) {
+			t.Fatalf("request %d: :path was not encoded as literal without indexing", i)
+		}
+		fields, err := dec.DecodeFull(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var path string
+		for _, hf := range fields {
+			if hf.Name == ":path" {
+				path = hf.Value
+			}
+		}
+		if path != "/secret" {
+			t.Fatalf("request %d: :path is %q", i, path)
+		}
+	}
+}
+
+func TestHeaderProfileNoUserAgent(t *testing.T) {
+	rw := newRequestWriter(nil, &HeaderProfile{
+		PseudoHeaderOrder: ProfileChrome.PseudoHeaderOrder,
+	})
+	block, err := rw.encodeHeaders(newUpgradeRequest(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hf := range decodeHeaders(t, block) {
+		if hf.Name == "user-agent" {
+			t.Fatal("user-agent was sent")
+		}
+	}
+}
+
+func TestEncodeHeadersUpgrade(t *testing.T) {
+	block, err := newRequestWriter(nil, ProfileChrome).encodeHeaders(newUpgradeRequest(t), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var upgrade []string
+	for _, hf := range decodeHeaders(t, block) {
+		switch hf.Name {
+		case "upgrade":
+			upgrade = append(upgrade, hf.Value)
+		case "connection":
+			t.Error("connection-specific field connection was sent")
+		}
+	}
+	if len(upgrade) != 1 || upgrade[0] != "QTP/0.2, QTP/0.1" {
+		t.Fatalf("upgrade fields are %q, expected the offered versions", upgrade)
+	}
+}
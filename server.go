@@ -2,11 +2,16 @@ package quictun
 
 import (
 	"bufio"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 
+	"github.com/julienschmidt/quictun/h2quic"
+	"github.com/julienschmidt/quictun/internal/sched"
 	"github.com/julienschmidt/quictun/internal/socks"
 	quic "github.com/lucas-clemente/quic-go"
 )
@@ -17,13 +22,97 @@ import (
 type SequenceCache interface {
 	Set(key uint64, value uint32) (old uint32)
 	Get(key uint64) (value uint32)
+
+	// SetIfGreater sets the value for the given key only if it is greater than
+	// the current value and reports whether it did so.
+	// Implementations may also accept smaller values within an anti-replay
+	// window, as long as every value is accepted at most once.
+	// The comparison and the modification must be performed atomically.
+	SetIfGreater(key uint64, value uint32) bool
+}
+
+// ACL decides which destinations clients may connect to.
+type ACL interface {
+	// Allow reports whether connections to the given address in the form
+	// host:port are allowed.
+	Allow(addr string) bool
 }
 
+// ErrNotAllowed is returned for connections to destinations denied by the ACL.
+var ErrNotAllowed = errors.New("connection not allowed by ACL")
+
+// streamDataTimeout is the time in which streams accepted outside of the mixed
+// mode must carry data to be taken for tunnel streams.
+const streamDataTimeout = 10 * time.Second
+
 // Server is a quictun server which handles QUIC sessions upgraded to the
 // quictun protocol.
 type Server struct {
 	DialTimeout   time.Duration
 	SequenceCache SequenceCache
+
+	// ACL restricts the destinations of tunneled connections.
+	// If nil, all destinations are allowed.
+	ACL ACL
+
+	// TokenKey returns the key for verifying replay protection tokens of the
+	// given user, as derived by DeriveTokenKey, or nil if the user is unknown.
+	// Only required if tokens are checked.
+	TokenKey func(user string) []byte
+
+	// TokenWindow is the max age of accepted replay protection tokens.
+	// If zero, DefaultTokenWindow is used.
+	TokenWindow time.Duration
+
+	// NonceCache caches the nonces of accepted replay protection tokens.
+	// Its entries must not be evicted before they are twice as old as the
+	// TokenWindow. If it is full, it must refuse new nonces instead, like an
+	// lru.LRU with the NoEvict option. Only required if tokens are checked.
+	NonceCache SequenceCache
+
+	// ClientCAs are the CAs issuing the certificates of clients, which
+	// authenticate with certificate tokens. Only required if certificate
+	// tokens are checked.
+	ClientCAs *x509.CertPool
+
+	// ClientIdentity returns the user of a client certificate, given its
+	// verified chain up to one of the ClientCAs, or an empty string if the
+	// certificate is not mapped to any user or was revoked.
+	// Only required if certificate tokens are checked.
+	ClientIdentity func(chain []*x509.Certificate) string
+
+	// InviteKey is the key invites are signed with, see Invite.
+	// Only required if invites are redeemed.
+	InviteKey []byte
+
+	// Invites stores the users created from invites.
+	// Only required if invites are redeemed.
+	Invites InviteStore
+
+	// RequireBinding makes Upgrade refuse sessions, which were not bound to
+	// the upgrade request with BindSession.
+	RequireBinding bool
+
+	// MaxBindings is the max number of sessions with binding state, see
+	// IssueBinding. If zero, DefaultMaxBindings is used.
+	MaxBindings int
+
+	// MaxBindingsPerAddr is the max number of sessions with binding state per
+	// remote IP address. If zero, DefaultMaxBindingsPerAddr is used.
+	MaxBindingsPerAddr int
+
+	// Versions are the supported protocol versions in order of preference.
+	// Defaults to SupportedVersions.
+	Versions []string
+
+	// Padding configures the padding of the traffic sent to clients.
+	// Applies only to QTP/0.2 streams.
+	Padding Padding
+
+	// binding nonces of QUIC sessions
+	bindingsLock    sync.Mutex
+	bindings        map[quic.Session]*sessionBinding
+	bindingsPerAddr map[string]int // number of bindings by remote IP address
 }
 
 // CheckSequenceNumber checks and caches the sequence number sent by a client
@@ -41,16 +130,47 @@ func (s *Server) CheckSequenceNumber(header string) bool {
 		return false
 	}
 
-	// the new sequence number must be larger than any previously seen number
-	return s.SequenceCache.Set(clientID, uint32(sequenceNumber)) < uint32(sequenceNumber)
+	// the new sequence number must be larger than any previously seen number,
+	// or unseen and within the window of the cache
+	return s.SequenceCache.SetIfGreater(clientID, uint32(sequenceNumber))
 }
 
 // Upgrade starts using a given QUIC session with the quictun protocol.
 // The quictun server immediately starts accepting new QUIC streams and assumes
-// them to speak the quictun protocol (QTP).
+// them to speak the quictun protocol (QTP) in version 0.1.
 // The actual protocol upgrade (via a HTTP/2 request-response) is handled
 // entirely by the web server.
+// The web server keeps handling HTTP requests on the session after the upgrade,
+// e.g. the cover traffic of clients. To tell tunnel streams and data streams
+// of HTTP requests apart reliably, the upgrade response should select the
+// mixed mode of h2quic (see h2quic.MixedModeHeader) if the client offered it.
+//
+// If RequireBinding is set, sessions which were not bound to the upgrade
+// request are closed instead.
 func (s *Server) Upgrade(session quic.Session) {
+	s.upgrade(session, VersionQTP01)
+}
+
+// UpgradeHandler returns a function like Upgrade, which uses the given
+// protocol version, as selected by SelectVersion.
+func (s *Server) UpgradeHandler(version string) func(quic.Session) {
+	return func(session quic.Session) {
+		s.upgrade(session, version)
+	}
+}
+
+func (s *Server) upgrade(session quic.Session, version string) {
+	if s.RequireBinding && !s.isBound(session) {
+		fmt.Println("upgrade:", errSessionNotBound)
+		session.Close(errSessionNotBound)
+		return
+	}
+
+	// schedules the writes to the streams of the session
+	scheduler := sched.New(1)
+	mixed := h2quic.IsMixedMode(session)
+	acl := s.sessionACL(session)
+
 	for {
 		fmt.Println("Waiting for stream...")
 		stream, err := session.AcceptStream()
@@ -60,15 +180,54 @@ func (s *Server) Upgrade(session quic.Session) {
 			return
 		}
 
-		go s.handleQuictunStream(stream)
+		go s.handleQuictunStream(stream, version, mixed, acl, scheduler)
 	}
 }
 
-func (s *Server) handleQuictunStream(stream quic.Stream) {
-	streamID := stream.StreamID()
-	fmt.Println("got stream", streamID)
+func (s *Server) handleQuictunStream(stream quic.Stream, version string, mixed bool, acl ACL, scheduler *sched.Scheduler) {
+	fmt.Println("got stream", stream.StreamID())
 
 	streamRd := bufio.NewReader(stream)
+
+	// Unless the session was upgraded in mixed mode, data streams of HTTP
+	// requests on the session, e.g. the upgrade request or cover traffic of the
+	// client, are accepted as well, but handled by the web server. Unlike
+	// tunnel streams, they do not carry data, as the requests have no body.
+	// Tunnel streams start with a request right away, thus streams without
+	// data are given up after streamDataTimeout.
+	if !mixed {
+		stream.SetReadDeadline(time.Now().Add(streamDataTimeout))
+		_, err := streamRd.Peek(1)
+		stream.SetReadDeadline(time.Time{})
+		if err != nil {
+			return
+		}
+	}
+
+	switch version {
+	case VersionQTP02:
+		s.handleQTP02(stream, streamRd, acl, scheduler)
+	default:
+		s.handleQTP01(stream, streamRd, acl, scheduler)
+	}
+}
+
+// dial connects to the given destination, if the ACL of the server and the
+// given ACL of the session, if any, allow it.
+func (s *Server) dial(addr string, acl ACL) (net.Conn, error) {
+	if s.ACL != nil && !s.ACL.Allow(addr) {
+		return nil, ErrNotAllowed
+	}
+	if acl != nil && !acl.Allow(addr) {
+		return nil, ErrNotAllowed
+	}
+	return net.DialTimeout("tcp", addr, s.DialTimeout)
+}
+
+// handleQTP01 handles a stream in the framing of QTP/0.1, see
+// Client.tunnelQTP01.
+func (s *Server) handleQTP01(stream quic.Stream, streamRd *bufio.Reader, acl ACL, scheduler *sched.Scheduler) {
+	streamID := stream.StreamID()
 	req, err := socks.PeekRequest(streamRd)
 	if err != nil {
 		stream.Reset(err)
@@ -79,13 +238,15 @@ func (s *Server) handleQuictunStream(stream quic.Stream) {
 
 	switch req.Cmd() {
 	case socks.CmdConnect:
-		remote, err := net.DialTimeout("tcp", req.Dest().String(), s.DialTimeout)
+		remote, err := s.dial(req.Dest().String(), acl)
 		if err != nil {
 			fmt.Printf("stream %d: %#v\n", streamID, err)
 			stream.Reset(nil)
 			stream.Close()
 			return
 		}
+		prio := Priority(req.Reserved())
+
 		// remove request header from buffer
 		if _, err = streamRd.Discard(len(req)); err != nil {
 			stream.Reset(nil)
@@ -95,9 +256,11 @@ func (s *Server) handleQuictunStream(stream quic.Stream) {
 			return
 		}
 
-		fmt.Println("Start proxying...")
-		go proxy(stream, remote) // recv from remote and send to stream
-		proxy(remote, streamRd)  // recv from stream and send to remote
+		streamWr := scheduler.NewFlow(prio.weight()).Writer(stream)
+
+		fmt.Println("Start proxying...", prio)
+		go proxy(streamWr, remote) // recv from remote and send to stream
+		proxy(remote, streamRd)    // recv from stream and send to remote
 	default:
 		socks.SendReply(stream, socks.StatusCmdNotSupported, nil)
 		stream.Reset(nil)
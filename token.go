@@ -0,0 +1,190 @@
+package quictun
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// A replay protection token is an alternative to the client ID and sequence
+// number pair sent in the QTP header. It has the form
+// "1.<user>.<timestamp>.<nonce>.<mac>", where user is the base64url encoded
+// user name, timestamp the creation time in Unix seconds, nonce a random 64 bit
+// number in hex and mac the base64url encoded HMAC-SHA256 over all other fields,
+// the request authority and the binding nonce of the session, using a key
+// derived from the user's credentials.
+// Tokens are only valid for the session they were bound to, see CheckBinding.
+// The server only needs to remember the nonces of tokens within the validity
+// window, instead of a sequence number for every client.
+const tokenVersion = "1"
+
+// scrypt parameters of DeriveTokenKey
+const (
+	tokenKeyN   = 1 << 15
+	tokenKeyR   = 8
+	tokenKeyP   = 1
+	tokenKeyLen = 32
+)
+
+// DefaultTokenWindow is the default max age of accepted tokens.
+const DefaultTokenWindow = 2 * time.Minute
+
+var (
+	ErrInvalidToken  = errors.New("replay protection token invalid")
+	ErrTokenExpired  = errors.New("replay protection token expired")
+	ErrTokenReplayed = errors.New("replay protection token was already used")
+
+	// ErrTokenLifetime is returned by CheckTokenID for bearer tokens, which
+	// are valid for longer than their IDs are kept in the nonce cache.
+	ErrTokenLifetime = errors.New("bearer token is valid for too long to be protected against replays")
+)
+
+// DeriveTokenKey derives the key for replay protection tokens from the
+// credentials of a user with scrypt, salted with the user name, so that
+// observed tokens do not allow to cheaply guess the password offline.
+// The server only needs to store the derived key instead of the password.
+// Deriving a key is deliberately expensive, thus it should only be done once
+// per user.
+func DeriveTokenKey(user, password string) []byte {
+	salt := append([]byte("quictun token key\x00"), user...)
+	key, err := scrypt.Key([]byte(password), salt, tokenKeyN, tokenKeyR, tokenKeyP, tokenKeyLen)
+	if err != nil {
+		// only returned for invalid parameters
+		panic(err)
+	}
+	return key
+}
+
+// writeFields writes the given fields of a MAC or signature input, each
+// prefixed with its length, so that no two lists of fields are encoded the same.
+func writeFields(w io.Writer, fields ...string) {
+	for _, field := range fields {
+		var length [4]byte
+		binary.BigEndian.PutUint32(length[:], uint32(len(field)))
+		w.Write(length[:])
+		io.WriteString(w, field)
+	}
+}
+
+// tokenMAC computes the MAC of a token.
+func tokenMAC(key []byte, user, timestamp, nonce, authority, binding string) []byte {
+	mac := hmac.New(sha256.New, key)
+	writeFields(mac, tokenVersion, user, timestamp, nonce, authority, binding)
+	return mac.Sum(nil)
+}
+
+// newToken creates a new replay protection token for the given user, request
+// authority and binding nonce.
+func newToken(key []byte, user, authority, binding string, now time.Time) (string, error) {
+	var nonce [8]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	userField := base64.RawURLEncoding.EncodeToString([]byte(user))
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	nonceField := strconv.FormatUint(binary.BigEndian.Uint64(nonce[:]), 16)
+	mac := tokenMAC(key, userField, timestamp, nonceField, authority, binding)
+
+	return strings.Join([]string{
+		tokenVersion,
+		userField,
+		timestamp,
+		nonceField,
+		base64.RawURLEncoding.EncodeToString(mac),
+	}, "."), nil
+}
+
+// CheckToken checks the replay protection token sent by a client for the given
+// request authority and returns the authenticated user.
+// binding must be the binding nonce checked with CheckBinding or, for binding
+// requests, the value of their BindingHeader. Tokens without a binding are
+// rejected, as they could be replayed on another session.
+//
+// The MAC of the token is verified first, so that forged tokens are rejected
+// without accessing the nonce cache. ErrWrongCredentials is returned for tokens
+// of unknown users or with an invalid MAC.
+func (s *Server) CheckToken(header, authority, binding string) (user string, err error) {
+	fields := strings.Split(header, ".")
+	if len(fields) != 5 || fields[0] != tokenVersion || binding == "" {
+		return "", ErrInvalidToken
+	}
+	userField, timestamp, nonceField := fields[1], fields[2], fields[3]
+
+	rawUser, err := base64.RawURLEncoding.DecodeString(userField)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	created, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	nonce, err := strconv.ParseUint(nonceField, 16, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(fields[4])
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+
+	// verify the MAC
+	user = string(rawUser)
+	key := s.TokenKey(user)
+	if key == nil {
+		return "", ErrWrongCredentials
+	}
+	if !hmac.Equal(mac, tokenMAC(key, userField, timestamp, nonceField, authority, binding)) {
+		return "", ErrWrongCredentials
+	}
+
+	// the token must have been created within the window, which also allows
+	// for some clock skew
+	window := s.TokenWindow
+	if window == 0 {
+		window = DefaultTokenWindow
+	}
+	age := time.Since(time.Unix(created, 0))
+	if age > window || age < -window {
+		return "", ErrTokenExpired
+	}
+
+	// the nonce may only be used once. A full nonce cache refuses new
+	// nonces, which is reported as replay as well.
+	if !s.NonceCache.SetIfGreater(nonce, uint32(created)) {
+		return "", ErrTokenReplayed
+	}
+	return user, nil
+}
+
+// CheckTokenID records the ID of a bearer token, e.g. the jti claim of a JWT or
+// the token itself, in the NonceCache, so that every bearer token is only
+// accepted once. expires is the time until which the token is accepted.
+// As the nonce cache only keeps nonces for twice the TokenWindow, tokens which
+// are accepted for longer than that are rejected with ErrTokenLifetime.
+func (s *Server) CheckTokenID(id string, expires time.Time) error {
+	window := s.TokenWindow
+	if window == 0 {
+		window = DefaultTokenWindow
+	}
+	if time.Until(expires) > 2*window {
+		return ErrTokenLifetime
+	}
+
+	// the IDs share the nonce cache with the random nonces of tokens
+	h := sha256.New()
+	writeFields(h, "quictun bearer token", id)
+	nonce := binary.BigEndian.Uint64(h.Sum(nil))
+	if !s.NonceCache.SetIfGreater(nonce, uint32(expires.Unix())) {
+		return ErrTokenReplayed
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package quictun
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/quictun/internal/lru"
+)
+
+func newTokenServer() *Server {
+	keys := map[string][]byte{
+		"alice": DeriveTokenKey("alice", "secret"),
+	}
+	return &Server{
+		TokenKey: func(user string) []byte {
+			return keys[user]
+		},
+		NonceCache: lru.New(100),
+	}
+}
+
+func TestToken(t *testing.T) {
+	s := newTokenServer()
+
+	token, err := newToken(DeriveTokenKey("alice", "secret"), "alice", "example.com:443", "nonce", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	user, err := s.CheckToken(token, "example.com:443", "nonce")
+	if err != nil {
+		t.Fatalf("valid token was rejected: %v", err)
+	}
+	if user != "alice" {
+		t.Fatalf("authenticated user is %q, should be alice", user)
+	}
+
+	// replay
+	if _, err = s.CheckToken(token, "example.com:443", "nonce"); err != ErrTokenReplayed {
+		t.Fatalf("expected ErrTokenReplayed for replayed token, got %v", err)
+	}
+}
+
+func TestTokenInvalid(t *testing.T) {
+	s := newTokenServer()
+	key := DeriveTokenKey("alice", "secret")
+	now := time.Now()
+
+	newTestToken := func(key []byte, user, authority string, now time.Time) string {
+		token, err := newToken(key, user, authority, "nonce", now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	valid := newTestToken(key, "alice", "example.com:443", now)
+	fields := strings.Split(valid, ".")
+	tampered := strings.Join(append(fields[:3:3], "1", fields[4]), ".")
+
+	tests := []struct {
+		name  string
+		token string
+		err   error
+	}{
+		{"empty", "", ErrInvalidToken},
+		{"sequence number", "0123456789ABCDEF00000001", ErrInvalidToken},
+		{"unknown version", "2" + valid[1:], ErrInvalidToken},
+		{"wrong password", newTestToken(DeriveTokenKey("alice", "guess"), "alice", "example.com:443", now), ErrWrongCredentials},
+		{"unknown user", newTestToken(key, "bob", "example.com:443", now), ErrWrongCredentials},
+		{"other authority", newTestToken(key, "alice", "example.org:443", now), ErrWrongCredentials},
+		{"tampered nonce", tampered, ErrWrongCredentials},
+		{"expired", newTestToken(key, "alice", "example.com:443", now.Add(-time.Hour)), ErrTokenExpired},
+		{"future", newTestToken(key, "alice", "example.com:443", now.Add(time.Hour)), ErrTokenExpired},
+	}
+	for _, test := range tests {
+		if _, err := s.CheckToken(test.token, "example.com:443", "nonce"); err != test.err {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// a token bound to one session must not be accepted for another one
+	bound, err := newToken(key, "alice", "example.com:443", "session nonce", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.CheckToken(bound, "example.com:443", "other nonce"); err != ErrWrongCredentials {
+		t.Errorf("bound token: expected %v, got %v", ErrWrongCredentials, err)
+	}
+	if _, err = s.CheckToken(bound, "example.com:443", ""); err != ErrInvalidToken {
+		t.Errorf("bound token without binding: expected %v, got %v", ErrInvalidToken, err)
+	}
+
+	// tokens must be bound to a session
+	unbound, err := newToken(key, "alice", "example.com:443", "", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = s.CheckToken(unbound, "example.com:443", ""); err != ErrInvalidToken {
+		t.Errorf("unbound token: expected %v, got %v", ErrInvalidToken, err)
+	}
+
+	// forged tokens must not end up in the nonce cache
+	if n := s.NonceCache.(*lru.LRU).Len(); n != 0 {
+		t.Fatalf("nonce cache has %d entries, should be empty", n)
+	}
+}
+
+func TestCheckTokenID(t *testing.T) {
+	s := newTokenServer()
+	expires := time.Now().Add(time.Minute)
+
+	if err := s.CheckTokenID("jti-1", expires); err != nil {
+		t.Fatalf("new token was rejected: %v", err)
+	}
+	if err := s.CheckTokenID("jti-1", expires); err != ErrTokenReplayed {
+		t.Fatalf("replayed token: expected %v, got %v", ErrTokenReplayed, err)
+	}
+	if err := s.CheckTokenID("jti-2", expires); err != nil {
+		t.Fatalf("other token was rejected: %v", err)
+	}
+
+	// the ID must be remembered until the token expires
+	if err := s.CheckTokenID("jti-3", time.Now().Add(time.Hour)); err != ErrTokenLifetime {
+		t.Fatalf("long-lived token: expected %v, got %v", ErrTokenLifetime, err)
+	}
+}
+
+func TestDeriveTokenKey(t *testing.T) {
+	key := DeriveTokenKey("alice", "secret")
+	if len(key) != tokenKeyLen {
+		t.Fatalf("key has %d bytes, should have %d", len(key), tokenKeyLen)
+	}
+	if !bytes.Equal(key, DeriveTokenKey("alice", "secret")) {
+		t.Fatal("key derivation is not deterministic")
+	}
+	// the user name salts the key
+	if bytes.Equal(key, DeriveTokenKey("bob", "secret")) {
+		t.Fatal("users with the same password have the same key")
+	}
+	if bytes.Equal(key, DeriveTokenKey("alice", "guess")) {
+		t.Fatal("different passwords have the same key")
+	}
+}
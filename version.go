@@ -0,0 +1,86 @@
+package quictun
+
+import (
+	"errors"
+	"strings"
+)
+
+// Versions of the quictun protocol (QTP), which are negotiated in the protocol
+// upgrade. The client offers the versions it supports in the Upgrade header
+// in order of preference, e.g. "QTP/0.2, QTP/0.1". The server selects one of
+// them and echoes it in the Upgrade header of its response.
+// The version determines the framing of the tunnel streams.
+const (
+	// VersionQTP01 streams start with the SOCKS request of the client,
+	// followed by the raw data.
+	VersionQTP01 = "QTP/0.1"
+
+	// VersionQTP02 streams consist of frames. They start with a request, which
+	// carries metadata, and a reply of the server, see package internal/qtp.
+	VersionQTP02 = "QTP/0.2"
+)
+
+// SupportedVersions are the protocol versions supported by this implementation
+// in order of preference.
+var SupportedVersions = []string{VersionQTP02, VersionQTP01}
+
+var ErrUnsupportedVersion = errors.New("server does not support any offered protocol version")
+
+// ParseUpgrade returns the protocols listed in the given Upgrade header values.
+func ParseUpgrade(values []string) []string {
+	var protocols []string
+	for _, value := range values {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				protocols = append(protocols, protocol)
+			}
+		}
+	}
+	return protocols
+}
+
+// SelectVersion returns the most preferred version of the server's supported
+// versions, which is also offered by the client in the given Upgrade header
+// values. If there is none, ok is false.
+func SelectVersion(supported []string, upgrade []string) (version string, ok bool) {
+	offered := ParseUpgrade(upgrade)
+	for _, version := range supported {
+		if containsString(offered, version) {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// versions returns the protocol versions offered by the client in order of
+// preference.
+func (c *Client) versions() []string {
+	if len(c.Versions) > 0 {
+		return c.Versions
+	}
+	return SupportedVersions
+}
+
+func containsString(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// versions returns the protocol versions supported by the server in order of
+// preference.
+func (s *Server) versions() []string {
+	if len(s.Versions) > 0 {
+		return s.Versions
+	}
+	return SupportedVersions
+}
+
+// SelectVersion selects the protocol version for a request with the given
+// Upgrade header values, see SelectVersion.
+func (s *Server) SelectVersion(upgrade []string) (version string, ok bool) {
+	return SelectVersion(s.versions(), upgrade)
+}
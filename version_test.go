@@ -0,0 +1,35 @@
+package quictun
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseUpgrade(t *testing.T) {
+	protocols := ParseUpgrade([]string{"QTP/0.2, QTP/0.1", " websocket ,", ""})
+	expected := []string{"QTP/0.2", "QTP/0.1", "websocket"}
+	if !reflect.DeepEqual(protocols, expected) {
+		t.Fatalf("parsed %q, expected %q", protocols, expected)
+	}
+}
+
+func TestSelectVersion(t *testing.T) {
+	supported := []string{"QTP/0.3", "QTP/0.2", "QTP/0.1"}
+	tests := []struct {
+		upgrade []string
+		version string
+		ok      bool
+	}{
+		{[]string{"QTP/0.1"}, "QTP/0.1", true},
+		{[]string{"QTP/0.1, QTP/0.2"}, "QTP/0.2", true},
+		{[]string{"QTP/0.9, QTP/0.2", "QTP/0.3"}, "QTP/0.3", true},
+		{[]string{"QTP/0.9"}, "", false},
+		{nil, "", false},
+	}
+	for _, test := range tests {
+		version, ok := SelectVersion(supported, test.upgrade)
+		if version != test.version || ok != test.ok {
+			t.Errorf("%q: selected %q, %v, expected %q, %v", test.upgrade, version, ok, test.version, test.ok)
+		}
+	}
+}